@@ -18,10 +18,39 @@ const (
 	StateStorePathKey = stateStore + "path"
 	StateStoreGCKey   = stateStore + "gc-interval"
 
+	StateStoreHitEventsRetentionKey = stateStore + "hit-events-retention"
+	StateStoreDailyHitsRetentionKey = stateStore + "daily-hits-retention"
+	StateStoreTrashRetentionKey     = stateStore + "trash-retention"
+	StateStoreExpiredRetentionKey   = stateStore + "expired-retention"
+
+	stateStoreNormalize                 = stateStore + "normalize-keys."
+	StateStoreNormalizeFoldCaseKey      = stateStoreNormalize + "fold-case"
+	StateStoreNormalizeTrailingSlashKey = stateStoreNormalize + "strip-trailing-slash"
+	StateStoreNormalizeSeparatorsKey    = stateStoreNormalize + "equal-separators"
+
 	web          = configRoot + "webserver."
 	WebListenKey = web + "listen"
 	WebPortKey   = web + "port"
 
+	WebRedirectStatusKey = web + "redirect-status"
+
+	auth             = configRoot + "auth."
+	AuthEnabledKey   = auth + "enabled"
+	AuthRootTokenKey = auth + "root-token"
+
+	// List of namespaces, each with a name and optionally the hosts that select it
+	NamespacesKey = configRoot + "namespaces"
+	// List of hosts, each with the namespace of its links, a landing URL and the handling of unknown keys
+	VirtualHostsKey = configRoot + "vhosts"
+
+	keyGen                 = configRoot + "keygen."
+	KeyGenLengthKey        = keyGen + "length"
+	KeyGenAlphabetKey      = keyGen + "alphabet"
+	KeyGenReuseExistingKey = keyGen + "reuse-existing"
+
+	client         = configRoot + "client."
+	ClientTokenKey = client + "token"
+
 	CLI_USER_AGENT = "go-short-cli"
 )
 
@@ -34,8 +63,22 @@ func ReadConfig() *viper.Viper {
 	viper.SetDefault(LogLevelKey, "info")
 	viper.SetDefault(StateStorePathKey, "~/.go-short/state-store")
 	viper.SetDefault(StateStoreGCKey, "1h")
+	viper.SetDefault(StateStoreHitEventsRetentionKey, "720h")
+	viper.SetDefault(StateStoreDailyHitsRetentionKey, "8784h")
+	viper.SetDefault(StateStoreTrashRetentionKey, "720h")
+	viper.SetDefault(StateStoreExpiredRetentionKey, "168h")
+	viper.SetDefault(StateStoreNormalizeFoldCaseKey, false)
+	viper.SetDefault(StateStoreNormalizeTrailingSlashKey, false)
+	viper.SetDefault(StateStoreNormalizeSeparatorsKey, false)
 	viper.SetDefault(WebListenKey, "localhost")
 	viper.SetDefault(WebPortKey, "80")
+	viper.SetDefault(WebRedirectStatusKey, 307)
+	viper.SetDefault(AuthEnabledKey, false)
+	viper.SetDefault(AuthRootTokenKey, "")
+	viper.SetDefault(KeyGenLengthKey, 6)
+	viper.SetDefault(KeyGenAlphabetKey, "base62")
+	viper.SetDefault(KeyGenReuseExistingKey, false)
+	viper.SetDefault(ClientTokenKey, "")
 
 	if err := viper.ReadInConfig(); err != nil {
 		panic(fmt.Errorf("Fatal error: %s\n", err))
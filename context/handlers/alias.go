@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Aliases give a link more keys, like k8s for kubernetes. They are
+ * created with op=alias and deleted like links, while deleting a link
+ * that still has aliases needs cascade=true to take its aliases along
+ */
+
+type AliasCommand struct {
+	key string
+	to  string
+}
+
+func (h *AdminHandler) handleAliasCommand(command AliasCommand, principal *Principal, w http.ResponseWriter) {
+	key := storage.StorageKey(command.key)
+	alias := &storage.Alias{Key: key, Target: storage.StorageKey(command.to), Creator: principal.Name,
+		CreatedAt: time.Now()}
+	existing, err := h.StateStore.LoadAlias(key)
+	if err == nil {
+		if !h.canModifyAlias(principal, existing) {
+			writeAuthError(w, forbiddenToModify(principal, key))
+			return
+		}
+		alias.Creator = existing.Creator
+		alias.CreatedAt = existing.CreatedAt
+	} else if _, ok := err.(storage.KeyNotFound); !ok {
+		writeAdminStorageError(w, err)
+		return
+	}
+	if err = h.StateStore.SaveAlias(alias); err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Aliased %s to %s", command.key, command.to)
+}
+
+func (h *AdminHandler) handleDeleteAlias(alias *storage.Alias, principal *Principal, w http.ResponseWriter) {
+	if !h.canModifyAlias(principal, alias) {
+		writeAuthError(w, forbiddenToModify(principal, alias.Key))
+		return
+	}
+	if _, err := h.StateStore.DeleteAlias(alias.Key); err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Deleted alias %s -> %s", alias.Key, alias.Target)
+}
+
+// Aliases are changed by their creator and by whoever can modify the link they lead to
+func (h *AdminHandler) canModifyAlias(principal *Principal, alias *storage.Alias) bool {
+	if !principal.CanAccess(alias.Key) {
+		return false
+	}
+	if principal.IsAdmin() || (principal.CanCreate() && principal.Name != "" && alias.Creator == principal.Name) {
+		return true
+	}
+	match, err := h.StateStore.LoadLongestPrefix(alias.Key)
+	return err == nil && match.Prefix == alias.Key && principal.CanModify(match.Item.Key, match.Item.Value)
+}
+
+func loadAliasGroups(stateStore storage.StateStore) (map[storage.StorageKey][]storage.StorageKey, error) {
+	aliases, err := stateStore.LoadAllAliases()
+	if err != nil {
+		return nil, err
+	}
+	return storage.GroupAliases(aliases), nil
+}
+
+func joinKeys(keys []storage.StorageKey) string {
+	joined := make([]string, 0, len(keys))
+	for _, key := range keys {
+		joined = append(joined, string(key))
+	}
+	return strings.Join(joined, ", ")
+}
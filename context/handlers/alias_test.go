@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestAliases(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	admin := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	redirect := &RedirectHandler{StateStore: stateStore}
+	editor, _ := IssueToken(stateStore, "editor", storage.RoleEditor)
+	other, _ := IssueToken(stateStore, "other", storage.RoleEditor)
+
+	var tests = []struct {
+		method string
+		url    string
+		token  string
+		status int
+	}{
+		{"POST", "http://go/_admin?key=kubernetes&url=https://kubernetes.io", editor, http.StatusOK},
+		{"POST", "http://go/_admin?op=alias&key=k8s&to=kubernetes", editor, http.StatusOK},
+		{"POST", "http://go/_admin?op=alias&key=kube&to=k8s", other, http.StatusOK},
+		{"POST", "http://go/_admin?op=alias&key=k8s&to=kube", editor, http.StatusConflict},
+		{"POST", "http://go/_admin?op=alias&key=kubernetes&to=k8s", editor, http.StatusConflict},
+		{"POST", "http://go/_admin?op=alias&key=wiki&to=missing", editor, http.StatusNotFound},
+		{"POST", "http://go/_admin?op=alias&key=k8s", editor, http.StatusBadRequest},
+		{"DELETE", "http://go/_admin?key=kubernetes", editor, http.StatusConflict},
+		{"DELETE", "http://go/_admin?key=k8s", other, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, test.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s expected status %d gotten %d - %s", test.method, test.url, test.status, w.Code,
+				w.Body.String())
+		}
+	}
+
+	r, _ := http.NewRequest("PUT", "http://go/_admin", strings.NewReader("k8s,http://evil.example.com"))
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	r.Header.Set("Authorization", "Bearer "+editor)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("PUT of alias key k8s expected status %d gotten %d - %s", http.StatusConflict, w.Code,
+			w.Body.String())
+	}
+	if alias, err := stateStore.LoadAlias("k8s"); err != nil || alias.Target != "kubernetes" {
+		t.Errorf("Expected k8s kept as alias of kubernetes gotten %v - %v", alias, err)
+	}
+
+	r, _ = http.NewRequest("GET", "http://go/kube/docs", nil)
+	w = httptest.NewRecorder()
+	redirect.ServeHTTP(w, r)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://kubernetes.io/docs" {
+		t.Errorf("GET go/kube/docs expected https://kubernetes.io/docs gotten %d %s", w.Code,
+			w.Header().Get("Location"))
+	}
+	if link, _ := stateStore.Load("kubernetes"); link.Hits != 1 {
+		t.Errorf("Expected the hit of kube to count for kubernetes gotten %v", link)
+	}
+
+	r, _ = http.NewRequest("GET", "http://go/_admin", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "Aliases: k8s, kube") || strings.Count(w.Body.String(), "Short: ") != 1 {
+		t.Errorf("Expected k8s and kube listed under kubernetes gotten %s", w.Body.String())
+	}
+
+	// The aliases would be deleted without a revision to check
+	r, _ = http.NewRequest("DELETE", "http://go/_admin?key=kubernetes&cascade=true", nil)
+	r.Header.Set("Authorization", "Bearer "+editor)
+	r.Header.Set("If-Match", `"1"`)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected conditional cascade delete rejected gotten %d %s", w.Code, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("DELETE", "http://go/_admin?key=kubernetes&cascade=true", nil)
+	r.Header.Set("Authorization", "Bearer "+editor)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "Deleted key kubernetes -> https://kubernetes.io and its aliases k8s, kube" {
+		t.Errorf("Expected kubernetes deleted with its aliases gotten %d %s", w.Code, w.Body.String())
+	}
+	if aliases, _ := stateStore.LoadAllAliases(); len(aliases) != 0 {
+		t.Errorf("Expected no aliases left gotten %v", aliases)
+	}
+}
@@ -0,0 +1,613 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+/**
+ * Versioned JSON REST API for links
+ */
+
+const (
+	APIPrefix    = "/api/v1"
+	APILinksPath = APIPrefix + "/links"
+
+	maxAPIBodySize = 1 << 20
+)
+
+type LinksAPIHandler struct {
+	StateStore storage.StateStore
+	Auth       *Authenticator
+	KeyGen     *KeyGenerator
+	Namespaces *Namespaces
+}
+
+type LinkResource struct {
+	Key string `json:"key"`
+	storage.Link
+	// Only set when reading links
+	Aliases []storage.StorageKey `json:"aliases,omitempty"`
+	// Set for links with a password, their URL, destinations and rules are
+	// left out unless the caller can modify them
+	Protected bool `json:"protected,omitempty"`
+}
+
+// Only the fields a client is allowed to change, timestamps
+// and hit counts are maintained by the server
+type LinkPatch struct {
+	URL         *string   `json:"url"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+	// Only admins can hand links over
+	Owner     *string    `json:"owner"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	NotBefore *time.Time `json:"not_before"`
+	// Zero goes back to the default of the server
+	RedirectStatus *int `json:"redirect_status"`
+	// Empty makes the link a plain link again, a new url does the same
+	Destinations *[]*storage.Destination `json:"destinations"`
+	Sticky       *bool                   `json:"sticky"`
+	// Empty removes the rules
+	Rules *[]*storage.Rule `json:"rules"`
+}
+
+type LinkList struct {
+	Count int             `json:"count"`
+	Links []*LinkResource `json:"links"`
+	// Passed as the cursor parameter for the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type APIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+func (h *LinksAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, APILinksPath), "/")
+	var principal *Principal
+	if r.Method != http.MethodGet {
+		var err error
+		principal, err = h.Auth.Authenticate(r)
+		if err != nil {
+			writeAPIAuthError(w, err)
+			return
+		}
+	}
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.listLinks(w, r, h.Auth.reader(r))
+		case http.MethodPost:
+			h.createLink(w, r, principal)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getLink(w, key, h.Auth.reader(r))
+	case http.MethodPut:
+		h.replaceLink(w, r, key, principal)
+	case http.MethodPatch:
+		h.patchLink(w, r, key, principal)
+	case http.MethodDelete:
+		h.deleteLink(w, r, key, principal)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (h *LinksAPIHandler) listLinks(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	options, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Keys of a namespace are listed with its name, global keys without
+	options.Namespace = r.URL.Query().Get("ns")
+	options.Namespaces = h.Namespaces.set()
+	page, err := h.StateStore.LoadPage(options)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	aliases, err := loadAliasGroups(h.StateStore)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	links := make([]*LinkResource, 0, len(page.Items))
+	for _, item := range visibleItems(principal, page.Items) {
+		link := newLinkResource(item)
+		link.Aliases = aliases[item.Key]
+		links = append(links, link)
+	}
+	writeJSON(w, http.StatusOK, LinkList{Count: len(links), Links: links, NextCursor: page.NextCursor})
+}
+
+func (h *LinksAPIHandler) createLink(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	var link LinkResource
+	if !decodeJSONBody(w, r, &link) {
+		return
+	}
+	if link.URL == "" && len(link.Destinations) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "Link is missing url or destinations")
+		return
+	}
+	if !principal.CanCreate() {
+		writeAPIAuthError(w, Forbidden{fmt.Sprintf("%s is not allowed to create links", principal.Name)})
+		return
+	}
+	// Generated keys go to the namespace of the principal
+	key := storage.StorageKey(link.Key)
+	if key == "" {
+		key = storage.NamespacedKey(principal.Namespace, key)
+	}
+	if !principal.CanAccess(key) {
+		writeAPIAuthError(w, forbiddenInNamespace(principal, key))
+		return
+	}
+	item := &storage.StorageItem{Key: storage.StorageKey(link.Key), Value: &storage.Link{
+		URL:            link.URL,
+		Creator:        creator(principal, link.Creator),
+		Owner:          creator(principal, link.Owner),
+		UpdatedBy:      principal.Name,
+		Description:    link.Description,
+		Tags:           link.Tags,
+		ExpiresAt:      link.ExpiresAt,
+		NotBefore:      link.NotBefore,
+		RedirectStatus: link.RedirectStatus,
+		Sticky:         link.Sticky,
+		Rules:          link.Rules,
+	}}
+	item.Value.SetDestinations(link.Destinations)
+	if err := validateLinkSchedule(item.Value, time.Now()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateRedirectStatus(link.RedirectStatus); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(link.Destinations) > 0 {
+		if err := storage.ValidateDestinations(link.Destinations); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := storage.ValidateRules(link.Rules); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if link.Key == "" {
+		h.createLinkWithGeneratedKey(w, principal.Namespace, item)
+		return
+	}
+	if err := h.StateStore.Save(item); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Location", APILinksPath+"/"+string(item.Key))
+	w.Header().Set("ETag", linkETag(item.Value))
+	writeJSON(w, http.StatusCreated, newLinkResource(item))
+}
+
+// Answers with the existing link when its URL is already stored and keys are reused
+func (h *LinksAPIHandler) createLinkWithGeneratedKey(w http.ResponseWriter, namespace string,
+	item *storage.StorageItem) {
+	key, saved, err := keyGeneratorOrDefault(h.KeyGen).Save(h.StateStore, h.Namespaces.set(), namespace, item.Value)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	item.Key = key
+	status := http.StatusCreated
+	if !saved {
+		status = http.StatusOK
+		if item.Value, err = h.StateStore.Load(key); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Location", APILinksPath+"/"+string(key))
+	w.Header().Set("ETag", linkETag(item.Value))
+	writeJSON(w, status, newLinkResource(item))
+}
+
+func (h *LinksAPIHandler) getLink(w http.ResponseWriter, key string, principal *Principal) {
+	value, err := h.StateStore.Load(storage.StorageKey(key))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	aliases, err := loadAliasGroups(h.StateStore)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	link := newLinkResource(&storage.StorageItem{Key: storage.StorageKey(key),
+		Value: visibleLink(principal, storage.StorageKey(key), value)})
+	link.Aliases = aliases[storage.StorageKey(key)]
+	w.Header().Set("ETag", linkETag(value))
+	writeJSON(w, http.StatusOK, link)
+}
+
+func (h *LinksAPIHandler) replaceLink(w http.ResponseWriter, r *http.Request, key string,
+	principal *Principal) {
+	var link LinkResource
+	if !decodeJSONBody(w, r, &link) {
+		return
+	}
+	if link.Key != "" && link.Key != key {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Link key %s does not match path key %s", link.Key, key))
+		return
+	}
+	if link.URL == "" && len(link.Destinations) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "Link is missing url or destinations")
+		return
+	}
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	item := &storage.StorageItem{Key: storage.StorageKey(key), Value: &storage.Link{
+		URL:            link.URL,
+		Creator:        creator(principal, link.Creator),
+		Owner:          creator(principal, link.Owner),
+		UpdatedBy:      principal.Name,
+		Description:    link.Description,
+		Tags:           link.Tags,
+		ExpiresAt:      link.ExpiresAt,
+		NotBefore:      link.NotBefore,
+		RedirectStatus: link.RedirectStatus,
+		Sticky:         link.Sticky,
+		Rules:          link.Rules,
+	}}
+	item.Value.SetDestinations(link.Destinations)
+	if err := validateLinkSchedule(item.Value, time.Now()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateRedirectStatus(link.RedirectStatus); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(link.Destinations) > 0 {
+		if err := storage.ValidateDestinations(link.Destinations); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := storage.ValidateRules(link.Rules); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existing, err := h.StateStore.Load(item.Key)
+	if err != nil {
+		if _, ok := err.(storage.KeyNotFound); !ok {
+			writeStorageError(w, err)
+			return
+		}
+		// There is no revision to match
+		if conditional {
+			writeAPIError(w, http.StatusPreconditionFailed, err.Error())
+			return
+		}
+		if !principal.CanCreate() {
+			writeAPIAuthError(w, Forbidden{fmt.Sprintf("%s is not allowed to create links", principal.Name)})
+			return
+		}
+		if !principal.CanAccess(item.Key) {
+			writeAPIAuthError(w, forbiddenInNamespace(principal, item.Key))
+			return
+		}
+	} else {
+		if !principal.CanModify(item.Key, existing) {
+			writeAPIAuthError(w, forbiddenToModify(principal, item.Key))
+			return
+		}
+		// Replacing a link does not reset its history, ownership or protection
+		item.Value.CreatedAt = existing.CreatedAt
+		item.Value.Creator = existing.Creator
+		item.Value.Owner = existing.Owner
+		item.Value.Hits = existing.Hits
+		item.Value.PasswordHash = existing.PasswordHash
+		item.Value.MaxUses = existing.MaxUses
+	}
+	created := false
+	if conditional {
+		err = h.StateStore.CompareAndSwap(item.Key, revision, item.Value)
+	} else {
+		created, err = h.StateStore.Upsert(item)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	w.Header().Set("ETag", linkETag(item.Value))
+	writeJSON(w, status, newLinkResource(item))
+}
+
+func (h *LinksAPIHandler) patchLink(w http.ResponseWriter, r *http.Request, key string,
+	principal *Principal) {
+	var patch LinkPatch
+	if !decodeJSONBody(w, r, &patch) {
+		return
+	}
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	value, err := h.StateStore.Load(storage.StorageKey(key))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if !principal.CanModify(storage.StorageKey(key), value) {
+		writeAPIAuthError(w, forbiddenToModify(principal, storage.StorageKey(key)))
+		return
+	}
+	if patch.Owner != nil {
+		if !principal.IsAdmin() {
+			writeAPIAuthError(w, Forbidden{fmt.Sprintf("%s is not allowed to change owners", principal.Name)})
+			return
+		}
+		value.Owner = *patch.Owner
+	}
+	if patch.URL != nil {
+		if *patch.URL == "" {
+			writeAPIError(w, http.StatusBadRequest, "Link url cannot be empty")
+			return
+		}
+		value.SetDestinations(nil)
+		value.URL = *patch.URL
+	}
+	if patch.Destinations != nil {
+		if len(*patch.Destinations) > 0 {
+			if err := storage.ValidateDestinations(*patch.Destinations); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		value.SetDestinations(*patch.Destinations)
+	}
+	if patch.Sticky != nil {
+		value.Sticky = *patch.Sticky
+	}
+	if patch.Rules != nil {
+		if err := storage.ValidateRules(*patch.Rules); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		value.Rules = *patch.Rules
+		if len(value.Rules) == 0 {
+			value.Rules = nil
+		}
+	}
+	if patch.Description != nil {
+		value.Description = *patch.Description
+	}
+	if patch.Tags != nil {
+		value.Tags = *patch.Tags
+	}
+	if patch.RedirectStatus != nil {
+		if err := validateRedirectStatus(*patch.RedirectStatus); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		value.RedirectStatus = *patch.RedirectStatus
+	}
+	if patch.ExpiresAt != nil || patch.NotBefore != nil {
+		if patch.ExpiresAt != nil {
+			value.ExpiresAt = patch.ExpiresAt
+		}
+		if patch.NotBefore != nil {
+			value.NotBefore = patch.NotBefore
+		}
+		if err := validateLinkSchedule(value, time.Now()); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	value.UpdatedBy = principal.Name
+	item := &storage.StorageItem{Key: storage.StorageKey(key), Value: value}
+	if conditional {
+		err = h.StateStore.CompareAndSwap(item.Key, revision, item.Value)
+	} else {
+		err = h.StateStore.Update(item)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("ETag", linkETag(item.Value))
+	writeJSON(w, http.StatusOK, newLinkResource(item))
+}
+
+func (h *LinksAPIHandler) deleteLink(w http.ResponseWriter, r *http.Request, key string,
+	principal *Principal) {
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cascade := r.URL.Query().Get("cascade") == "true"
+	if cascade && conditional {
+		writeAPIError(w, http.StatusBadRequest, "Deleting a link with its aliases cannot be conditional on its revision")
+		return
+	}
+	existing, err := h.StateStore.Load(storage.StorageKey(key))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if !principal.CanModify(storage.StorageKey(key), existing) {
+		writeAPIAuthError(w, forbiddenToModify(principal, storage.StorageKey(key)))
+		return
+	}
+	if conditional {
+		if err = h.StateStore.CompareAndDelete(storage.StorageKey(key), revision, principal.Name); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// Links with aliases are only deleted together with them
+	if cascade {
+		if _, _, err = h.StateStore.DeleteWithAliases(storage.StorageKey(key), principal.Name); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	value, err := h.StateStore.Delete(storage.StorageKey(key), principal.Name)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	// Delete does not complain about missing keys
+	if value == nil {
+		writeStorageError(w, storage.KeyNotFound{Key: storage.StorageKey(key)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Authenticated callers cannot claim links on behalf of others
+func creator(principal *Principal, requested string) string {
+	if principal.Name != "" {
+		return principal.Name
+	}
+	return requested
+}
+
+// The revision of a link is its entity tag
+func linkETag(link *storage.Link) string {
+	return fmt.Sprintf(`"%d"`, link.Revision)
+}
+
+// Revision the request expects from the If-Match header, conditional is false when it
+// has no such precondition. Only single strong entity tags can match a revision
+func ifMatchRevision(r *http.Request) (revision uint64, conditional bool, err error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false, fmt.Errorf("Malformed If-Match header %s", header)
+	}
+	revision, err = strconv.ParseUint(header[1:len(header)-1], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Malformed If-Match header %s", header)
+	}
+	return revision, true, nil
+}
+
+func newLinkResource(item *storage.StorageItem) *LinkResource {
+	resource := &LinkResource{Key: string(item.Key), Link: *item.Value, Protected: item.Value.PasswordHash != ""}
+	resource.PasswordHash = ""
+	return resource
+}
+
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Malformed JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Could not encode JSON response %s", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIErrorResponse{
+		Error: APIError{Status: status, Code: apiErrorCode(status), Message: message},
+	})
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case storage.KeyNotFound:
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case storage.KeyAlreadyExists, storage.HasAliases, storage.AliasCycle:
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case storage.RevisionMismatch:
+		writeAPIError(w, http.StatusPreconditionFailed, err.Error())
+	case storage.InvalidCursor:
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeAPIAuthError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case Unauthorized:
+		setAuthenticateHeader(w)
+		writeAPIError(w, http.StatusUnauthorized, err.Error())
+	case Forbidden:
+		writeAPIError(w, http.StatusForbidden, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+func apiErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	default:
+		return "internal_error"
+	}
+}
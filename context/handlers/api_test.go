@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+func TestLinksAPI(t *testing.T) {
+	handler := createLinksAPIHandler(t)
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", APILinksPath, `{"key":"gs","url":"https://github.com/kouzant/go-short"}`, http.StatusCreated},
+		{"POST", APILinksPath, `{"key":"gs","url":"https://github.com"}`, http.StatusConflict},
+		{"POST", APILinksPath, `{"key":"gh"}`, http.StatusBadRequest},
+		{"POST", APILinksPath, `{"key":"gs"`, http.StatusBadRequest},
+		{"POST", APILinksPath, `{"key":"gs","url":"https://github.com","unknown":1}`, http.StatusBadRequest},
+		{"GET", APILinksPath + "/gs", "", http.StatusOK},
+		{"GET", APILinksPath + "/missing", "", http.StatusNotFound},
+		{"PUT", APILinksPath + "/gs", `{"url":"https://golang.org"}`, http.StatusOK},
+		{"PUT", APILinksPath + "/go", `{"url":"https://golang.org"}`, http.StatusCreated},
+		{"PUT", APILinksPath + "/go", `{"key":"other","url":"https://golang.org"}`, http.StatusBadRequest},
+		{"PATCH", APILinksPath + "/gs", `{"url":"https://go.dev"}`, http.StatusOK},
+		{"PATCH", APILinksPath + "/missing", `{"url":"https://go.dev"}`, http.StatusNotFound},
+		{"PATCH", APILinksPath + "/gs", `{"destinations":[{"url":"https://a.example.com","weight":1}]}`, http.StatusBadRequest},
+		{"PUT", APILinksPath + "/ab", `{"destinations":[{"url":"https://a.example.com","weight":1},{"url":"https://b.example.com","weight":1}],"sticky":true}`, http.StatusCreated},
+		{"POST", APILinksPath, `{"key":"ab","destinations":[{"url":"https://a.example.com","weight":0},{"url":"https://b.example.com","weight":1}]}`, http.StatusBadRequest},
+		{"DELETE", APILinksPath + "/ab", "", http.StatusNoContent},
+		{"DELETE", APILinksPath + "/go", "", http.StatusNoContent},
+		{"DELETE", APILinksPath + "/go", "", http.StatusNotFound},
+		{"POST", APILinksPath + "/gs", "", http.StatusMethodNotAllowed},
+		{"DELETE", APILinksPath, "", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		w := doAPIRequest(t, handler, test.method, test.path, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s %s expected status %d gotten %d - %s", test.method, test.path,
+				test.status, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); w.Code != http.StatusNoContent &&
+			contentType != "application/json" {
+			t.Errorf("%s %s expected JSON response gotten %s", test.method, test.path, contentType)
+		}
+		if w.Code >= http.StatusBadRequest {
+			var apiError APIErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &apiError); err != nil {
+				t.Errorf("%s %s returned malformed error %s", test.method, test.path, err)
+			}
+			if apiError.Error.Status != test.status || apiError.Error.Message == "" {
+				t.Errorf("%s %s returned incomplete error %v", test.method, test.path, apiError)
+			}
+		}
+	}
+
+	w := doAPIRequest(t, handler, "GET", APILinksPath+"/gs", "")
+	var link LinkResource
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatalf("Could not decode link %s", err)
+	}
+	if link.Key != "gs" || link.URL != "https://go.dev" {
+		t.Errorf("Expected patched link gs -> https://go.dev gotten %v", link)
+	}
+
+	w = doAPIRequest(t, handler, "GET", APILinksPath, "")
+	var list LinkList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Could not decode link list %s", err)
+	}
+	if list.Count != 1 || len(list.Links) != 1 {
+		t.Errorf("Expected a single link gotten %v", list)
+	}
+}
+
+func TestLinksAPINormalizedKey(t *testing.T) {
+	config := viper.New()
+	config.Set(context.StateStoreNormalizeFoldCaseKey, true)
+	config.Set(context.StateStoreNormalizeSeparatorsKey, true)
+	stateStore := &storage.MemoryStateStore{Config: config}
+	stateStore.Init()
+	handler := &LinksAPIHandler{StateStore: stateStore}
+
+	w := doAPIRequest(t, handler, "POST", APILinksPath, `{"key":"My_Docs","url":"https://wiki.example.com/docs"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != APILinksPath+"/my-docs" {
+		t.Errorf("Expected my-docs created gotten %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestLinksAPIPreconditions(t *testing.T) {
+	handler := createLinksAPIHandler(t)
+	w := doAPIRequest(t, handler, "POST", APILinksPath, `{"key":"gs","url":"https://github.com"}`)
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("Expected ETag \"1\" for a new link gotten %s", etag)
+	}
+
+	var tests = []struct {
+		method  string
+		path    string
+		body    string
+		ifMatch string
+		status  int
+		etag    string
+	}{
+		{"GET", APILinksPath + "/gs", "", "", http.StatusOK, `"1"`},
+		{"PATCH", APILinksPath + "/gs", `{"url":"https://github.com/kouzant"}`, `"1"`, http.StatusOK, `"2"`},
+		{"PATCH", APILinksPath + "/gs", `{"url":"https://golang.org"}`, `"1"`, http.StatusPreconditionFailed, ""},
+		{"PATCH", APILinksPath + "/gs", `{"url":"https://golang.org"}`, `W/"2"`, http.StatusBadRequest, ""},
+		{"PUT", APILinksPath + "/gs", `{"url":"https://github.com/kouzant/go-short"}`, `"2"`, http.StatusOK, `"3"`},
+		{"PUT", APILinksPath + "/gs", `{"url":"https://golang.org"}`, `"2"`, http.StatusPreconditionFailed, ""},
+		{"PUT", APILinksPath + "/go", `{"url":"https://golang.org"}`, `"1"`, http.StatusPreconditionFailed, ""},
+		{"PATCH", APILinksPath + "/gs", `{"description":"go-short"}`, "*", http.StatusOK, `"4"`},
+		{"DELETE", APILinksPath + "/gs", "", `"3"`, http.StatusPreconditionFailed, ""},
+		{"DELETE", APILinksPath + "/gs?cascade=true", "", `"4"`, http.StatusBadRequest, ""},
+		{"DELETE", APILinksPath + "/gs", "", `"4"`, http.StatusNoContent, ""},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, test.path, string2Reader(test.body))
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s If-Match %s expected status %d gotten %d - %s", test.method, test.path,
+				test.ifMatch, test.status, w.Code, w.Body.String())
+		}
+		if etag := w.Header().Get("ETag"); test.etag != "" && etag != test.etag {
+			t.Errorf("%s %s expected ETag %s gotten %s", test.method, test.path, test.etag, etag)
+		}
+	}
+}
+
+func createLinksAPIHandler(t *testing.T) *LinksAPIHandler {
+	stateStore := &storage.MemoryStateStore{}
+	if err := stateStore.Init(); err != nil {
+		t.Fatalf("stateStore.Init() failed with %s", err)
+	}
+	return &LinksAPIHandler{StateStore: stateStore}
+}
+
+func doAPIRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, path, string2Reader(body))
+	if err != nil {
+		t.Fatalf("Error creating new HTTP request %s", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+/**
+ * Bearer token authentication of mutating admin requests. Tokens are
+ * issued through the admin endpoint and only their hash is stored. The
+ * root token from the server configuration is an admin and is needed to
+ * issue the first tokens. Editors can only modify the links they own
+ * and tokens of a namespace can only be used for the links of their
+ * namespace, where their admins can manage the tokens of the namespace
+ */
+
+const (
+	RootTokenName = "root"
+
+	tokenSecretSize = 32
+)
+
+type Principal struct {
+	Name string
+	Role storage.Role
+	// Empty when the principal is not limited to a namespace
+	Namespace string
+}
+
+// Everybody is an anonymous admin when authentication is disabled
+var anonymous = &Principal{Role: storage.RoleAdmin}
+
+func (p *Principal) IsAdmin() bool {
+	return p.Role == storage.RoleAdmin
+}
+
+func (p *Principal) CanCreate() bool {
+	return p.Role == storage.RoleEditor || p.Role == storage.RoleAdmin
+}
+
+func (p *Principal) CanAccess(key storage.StorageKey) bool {
+	return p.Namespace == "" || storage.InNamespace(key, p.Namespace)
+}
+
+func (p *Principal) CanModify(key storage.StorageKey, link *storage.Link) bool {
+	if !p.CanAccess(key) {
+		return false
+	}
+	if p.IsAdmin() {
+		return true
+	}
+	return p.Role == storage.RoleEditor && p.Name != "" && link.Owner == p.Name
+}
+
+type Unauthorized struct {
+	Reason string
+}
+
+func (e Unauthorized) Error() string {
+	return e.Reason
+}
+
+type Forbidden struct {
+	Reason string
+}
+
+func (e Forbidden) Error() string {
+	return e.Reason
+}
+
+func (p *Principal) CanManageTokens(namespace string) bool {
+	return p.IsAdmin() && (p.Namespace == "" || p.Namespace == namespace)
+}
+
+func forbiddenToModify(principal *Principal, key storage.StorageKey) Forbidden {
+	return Forbidden{fmt.Sprintf("%s is not allowed to modify %s", principal.Name, key)}
+}
+
+func forbiddenInNamespace(principal *Principal, key storage.StorageKey) Forbidden {
+	return Forbidden{fmt.Sprintf("%s is only allowed to modify links of the %s namespace, not %s", principal.Name,
+		namespaceName(principal.Namespace), key)}
+}
+
+type Authenticator struct {
+	StateStore    storage.StateStore
+	Enabled       bool
+	rootTokenHash string
+}
+
+func NewAuthenticator(config *viper.Viper, stateStore storage.StateStore) *Authenticator {
+	authenticator := &Authenticator{
+		StateStore: stateStore,
+		Enabled:    config.GetBool(context.AuthEnabledKey),
+	}
+	if rootToken := config.GetString(context.AuthRootTokenKey); rootToken != "" {
+		authenticator.rootTokenHash = HashToken(rootToken)
+	}
+	return authenticator
+}
+
+// Identifies the caller of a request, every caller is anonymous when authentication is disabled
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if !a.IsEnabled() {
+		return anonymous, nil
+	}
+	secret := bearerToken(r)
+	if secret == "" {
+		return nil, Unauthorized{"Missing API token"}
+	}
+	hash := HashToken(secret)
+	if a.rootTokenHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.rootTokenHash)) == 1 {
+		return &Principal{Name: RootTokenName, Role: storage.RoleAdmin}, nil
+	}
+	token, err := a.StateStore.LoadTokenByHash(hash)
+	if err != nil {
+		if _, ok := err.(storage.TokenNotFound); ok {
+			return nil, Unauthorized{"Invalid API token"}
+		}
+		return nil, err
+	}
+	// Tokens issued before roles existed can edit
+	role := token.Role
+	if role == "" {
+		role = storage.RoleEditor
+	}
+	return &Principal{Name: token.Name, Role: role, Namespace: token.Namespace}, nil
+}
+
+func (a *Authenticator) IsEnabled() bool {
+	return a != nil && a.Enabled
+}
+
+// Creates a new token and returns its secret, which is not stored anywhere
+func IssueToken(stateStore storage.StateStore, name string, role storage.Role) (string, error) {
+	return IssueNamespaceToken(stateStore, name, role, "")
+}
+
+func IssueNamespaceToken(stateStore storage.StateStore, name string, role storage.Role,
+	namespace string) (string, error) {
+	if name == RootTokenName {
+		return "", fmt.Errorf("Token name %s is reserved", RootTokenName)
+	}
+	secret, err := generateTokenSecret()
+	if err != nil {
+		return "", err
+	}
+	token := &storage.Token{Name: name, Hash: HashToken(secret), Role: role, CreatedAt: time.Now(),
+		Namespace: namespace}
+	if err = stateStore.SaveToken(token); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateTokenSecret() (string, error) {
+	secret := make([]byte, tokenSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HTML forms cannot set headers so they send the token as a form field
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if isFormContent(r) {
+		return r.PostFormValue("token")
+	}
+	return ""
+}
+
+func setAuthenticateHeader(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, context.AppName))
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case Unauthorized:
+		setAuthenticateHeader(w)
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusUnauthorized)
+	case Forbidden:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusForbidden)
+	default:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+	}
+}
+
+// Role and namespace checks that do not depend on the stored links
+func authorize(command AdminCommand, principal *Principal) error {
+	switch c := command.(type) {
+	case AddCommand, AddBatchCommand, UpdateCommand, UpsertCommand, RenameCommand, RollbackCommand,
+		RestoreCommand, AliasCommand:
+		if !principal.CanCreate() {
+			return Forbidden{fmt.Sprintf("%s is not allowed to create links", principal.Name)}
+		}
+	case IssueTokenCommand:
+		return authorizeTokens(principal, c.namespace)
+	case RevokeTokenCommand:
+		return authorizeTokens(principal, c.namespace)
+	case ListTokensCommand:
+		return authorizeTokens(principal, c.namespace)
+	}
+	for _, key := range commandKeys(command) {
+		if !principal.CanAccess(key) {
+			return forbiddenInNamespace(principal, key)
+		}
+	}
+	return nil
+}
+
+func authorizeTokens(principal *Principal, namespace string) error {
+	if !principal.CanManageTokens(namespace) {
+		return Forbidden{fmt.Sprintf("%s is not allowed to manage tokens of the %s namespace", principal.Name,
+			namespaceName(namespace))}
+	}
+	return nil
+}
+
+func (h *AdminHandler) handleIssueTokenCommand(command IssueTokenCommand, w http.ResponseWriter) {
+	secret, err := IssueNamespaceToken(h.StateStore, command.name, command.role, command.namespace)
+	if err != nil {
+		if _, ok := err.(storage.TokenAlreadyExists); ok {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusConflict)
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	if command.namespace != "" {
+		fmt.Fprintf(w, "> Issued %s token %s of namespace %s: %s\n> It will not be shown again", command.role,
+			command.name, command.namespace, secret)
+		return
+	}
+	fmt.Fprintf(w, "> Issued %s token %s: %s\n> It will not be shown again", command.role, command.name, secret)
+}
+
+func (h *AdminHandler) handleRevokeTokenCommand(command RevokeTokenCommand, w http.ResponseWriter) {
+	// Tokens of other namespaces do not exist for the admins of a namespace
+	_, err := h.StateStore.DeleteToken(command.namespace, command.name)
+	if err != nil {
+		if _, ok := err.(storage.TokenNotFound); ok {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	fmt.Fprintf(w, "Revoked token %s", command.name)
+}
+
+func (h *AdminHandler) handleListTokensCommand(command ListTokensCommand, w http.ResponseWriter) {
+	tokens, err := h.loadTokens(command.namespace)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	var buffer strings.Builder
+	fmt.Fprintf(&buffer, "> Number of tokens: %d\n", len(tokens))
+	for _, token := range tokens {
+		fmt.Fprintf(&buffer, "> Name: %s\t Role: %s\t Namespace: %s\t Created: %s\n", token.Name, token.Role,
+			namespaceName(token.Namespace), token.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Fprint(w, buffer.String())
+}
+
+// All tokens when the namespace is empty
+func (h *AdminHandler) loadTokens(namespace string) ([]*storage.Token, error) {
+	tokens, err := h.StateStore.LoadAllTokens()
+	if err != nil || namespace == "" {
+		return tokens, err
+	}
+	filtered := make([]*storage.Token, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Namespace == namespace {
+			filtered = append(filtered, token)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+const testRootToken = "root-secret"
+
+func TestAdminAuthentication(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	secret, err := IssueToken(stateStore, "antonis", storage.RoleEditor)
+	if err != nil {
+		t.Fatalf("IssueToken returned error %v", err)
+	}
+
+	var tests = []struct {
+		method string
+		params string
+		token  string
+		status int
+	}{
+		{"POST", "key=gs&url=https://github.com/kouzant/go-short", "", http.StatusUnauthorized},
+		{"POST", "key=gs&url=https://github.com/kouzant/go-short", "wrong", http.StatusUnauthorized},
+		{"POST", "key=gs&url=https://github.com/kouzant/go-short", secret, http.StatusOK},
+		{"DELETE", "key=gs", "", http.StatusUnauthorized},
+		{"GET", "", "", http.StatusOK},
+		{"GET", "op=stats&key=gs", "", http.StatusOK},
+		{"GET", "op=tokens", "", http.StatusUnauthorized},
+		{"GET", "op=tokens", secret, http.StatusForbidden},
+		{"GET", "op=tokens", testRootToken, http.StatusOK},
+		{"POST", "op=issue-token&name=other", "", http.StatusUnauthorized},
+		{"POST", "op=issue-token&name=other", testRootToken, http.StatusOK},
+		{"POST", "op=issue-token&name=other", testRootToken, http.StatusConflict},
+		{"POST", "op=issue-token&name=" + RootTokenName, testRootToken, http.StatusBadRequest},
+		{"POST", "op=issue-token&name=third&role=owner", testRootToken, http.StatusBadRequest},
+		{"POST", "op=issue-token&name=third&role=viewer", secret, http.StatusForbidden},
+		{"DELETE", "op=revoke-token&name=antonis", testRootToken, http.StatusOK},
+		{"DELETE", "op=revoke-token&name=antonis", testRootToken, http.StatusNotFound},
+		{"DELETE", "key=gs", secret, http.StatusUnauthorized},
+		{"DELETE", "key=gs", testRootToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://go/_admin?"+test.params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s with token %s expected status %d gotten %d - %s", test.method, test.params,
+				test.token, test.status, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s expected WWW-Authenticate header", test.method, test.params)
+		}
+	}
+}
+
+func TestCreatorFromToken(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	secret, _ := IssueToken(stateStore, "antonis", storage.RoleEditor)
+
+	admin := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	r, _ := http.NewRequest("POST", "http://go/_admin?key=gs&url=https://github.com/kouzant/go-short", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	admin.ServeHTTP(httptest.NewRecorder(), r)
+
+	api := &LinksAPIHandler{StateStore: stateStore, Auth: authenticator}
+	r, _ = http.NewRequest("POST", APILinksPath, strings.NewReader(`{"key":"go","url":"https://golang.org","creator":"someone"}`))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("API POST without token expected status %d gotten %d", http.StatusUnauthorized, w.Code)
+	}
+	r, _ = http.NewRequest("POST", APILinksPath, strings.NewReader(`{"key":"go","url":"https://golang.org","creator":"someone"}`))
+	r.Header.Set("Authorization", "Bearer "+secret)
+	api.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, key := range []storage.StorageKey{"gs", "go"} {
+		link, err := stateStore.Load(key)
+		if err != nil || link.Creator != "antonis" {
+			t.Errorf("Expected %s to be created by antonis gotten %v - %v", key, link, err)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	viewer, _ := IssueToken(stateStore, "viewer", storage.RoleViewer)
+	editor, _ := IssueToken(stateStore, "editor", storage.RoleEditor)
+	other, _ := IssueToken(stateStore, "other", storage.RoleEditor)
+	admin, _ := IssueToken(stateStore, "admin", storage.RoleAdmin)
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	api := &LinksAPIHandler{StateStore: stateStore, Auth: authenticator}
+
+	var tests = []struct {
+		handler http.Handler
+		method  string
+		path    string
+		body    string
+		token   string
+		status  int
+	}{
+		{handler, "POST", "/_admin?key=gs&url=https://github.com/kouzant/go-short", "", viewer, http.StatusForbidden},
+		{handler, "POST", "/_admin?key=gs&url=https://github.com/kouzant/go-short", "", editor, http.StatusOK},
+		{handler, "POST", "/_admin?key=go&url=https://golang.org", "", other, http.StatusOK},
+		{handler, "PUT", "/_admin", "go,https://go.dev", editor, http.StatusForbidden},
+		{handler, "PUT", "/_admin", "gs,https://github.com\nnew,https://example.com", editor, http.StatusOK},
+		{handler, "DELETE", "/_admin?key=go", "", editor, http.StatusForbidden},
+		{handler, "DELETE", "/_admin?key=go", "", viewer, http.StatusForbidden},
+		{handler, "DELETE", "/_admin?key=go", "", other, http.StatusOK},
+		{api, "PATCH", APILinksPath + "/gs", `{"url":"https://go.dev"}`, other, http.StatusForbidden},
+		{api, "PATCH", APILinksPath + "/gs", `{"url":"https://go.dev"}`, editor, http.StatusOK},
+		{api, "PATCH", APILinksPath + "/gs", `{"owner":"other"}`, editor, http.StatusForbidden},
+		{api, "PATCH", APILinksPath + "/gs", `{"owner":"other"}`, admin, http.StatusOK},
+		{api, "PUT", APILinksPath + "/gs", `{"url":"https://github.com"}`, editor, http.StatusForbidden},
+		{api, "PUT", APILinksPath + "/gs", `{"url":"https://github.com"}`, other, http.StatusOK},
+		{api, "POST", APILinksPath, `{"key":"v","url":"https://github.com"}`, viewer, http.StatusForbidden},
+		{api, "DELETE", APILinksPath + "/new", "", other, http.StatusForbidden},
+		{api, "DELETE", APILinksPath + "/new", "", admin, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://go"+test.path, string2Reader(test.body))
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s %s expected status %d gotten %d - %s", test.method, test.path, test.body,
+				test.status, w.Code, w.Body.String())
+		}
+	}
+
+	link, _ := stateStore.Load("gs")
+	if link.Owner != "other" || link.Creator != "editor" {
+		t.Errorf("Expected gs to be created by editor and owned by other gotten %v", link)
+	}
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	authenticator.Enabled = false
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	r, _ := http.NewRequest("POST", "http://go/_admin?key=gs&url=https://github.com/kouzant/go-short", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d without authentication gotten %d", http.StatusOK, w.Code)
+	}
+}
+
+func createAuthenticator(t *testing.T) (storage.StateStore, *Authenticator) {
+	stateStore := &storage.MemoryStateStore{}
+	if err := stateStore.Init(); err != nil {
+		t.Fatalf("stateStore.Init() failed with %s", err)
+	}
+	config := viper.New()
+	config.Set(context.AuthEnabledKey, true)
+	config.Set(context.AuthRootTokenKey, testRootToken)
+	return stateStore, NewAuthenticator(config, stateStore)
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+/**
+ * Links that are only active for a while. Expired and used up links
+ * answer with Gone until the state store removes them, links that are
+ * not active yet answer with Not Found
+ */
+
+var inactive_template = template.Must(template.New("inactive").Parse(inactive_html))
+
+type InactiveLink struct {
+	Key     storage.StorageKey
+	Link    *storage.Link
+	Expired bool
+	UsedUp  bool
+}
+
+// Either a duration from now, like 72h, or an RFC 3339 time
+func parseLinkTime(value string, now time.Time) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		if duration <= 0 {
+			return nil, fmt.Errorf("Duration %s should be positive", value)
+		}
+		t := now.Add(duration)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("Time %s is neither a duration nor an RFC 3339 time", value)
+	}
+	return &t, nil
+}
+
+func validateLinkSchedule(link *storage.Link, now time.Time) error {
+	if link.ExpiresAt == nil {
+		return nil
+	}
+	if !link.ExpiresAt.After(now) {
+		return fmt.Errorf("Link expiry %s is in the past", link.ExpiresAt.Format(time.RFC3339))
+	}
+	if link.NotBefore != nil && !link.ExpiresAt.After(*link.NotBefore) {
+		return fmt.Errorf("Link expiry %s is not after its activation %s", link.ExpiresAt.Format(time.RFC3339),
+			link.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (h *RedirectHandler) handleInactive(w http.ResponseWriter, key storage.StorageKey, link *storage.Link,
+	now time.Time, userAgent string) {
+	inactive := &InactiveLink{Key: key, Link: link, Expired: link.IsExpired(now), UsedUp: link.IsUsedUp()}
+	status := http.StatusNotFound
+	if inactive.Expired || inactive.UsedUp {
+		status = http.StatusGone
+	}
+
+	if userAgent == context.CLI_USER_AGENT {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		var buffer strings.Builder
+		if inactive.Expired {
+			fmt.Fprintf(&buffer, "> Key %s expired at %s\n", key, link.ExpiresAt.Format(time.RFC3339))
+		} else if inactive.UsedUp {
+			fmt.Fprintf(&buffer, "> Key %s has been used %d times and is no longer available\n", key, link.MaxUses)
+		} else {
+			fmt.Fprintf(&buffer, "> Key %s is not active before %s\n", key, link.NotBefore.Format(time.RFC3339))
+		}
+		fmt.Fprint(w, buffer.String())
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := inactive_template.Execute(w, inactive); err != nil {
+			log.Errorf("Could not render inactive link page %s", err)
+		}
+	}
+}
+
+const inactive_html = `
+<html>
+ <head>
+   <style>
+     body {
+     font-family: arial, sans-serif;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+{{if .Expired}}
+    <h1>go/{{.Key}} has expired</h1>
+    <h3>It expired at {{.Link.ExpiresAt.Format "2006-01-02 15:04:05"}}</h3>
+{{else if .UsedUp}}
+    <h1>go/{{.Key}} is no longer available</h1>
+    <h3>It could be used {{.Link.MaxUses}} times</h3>
+{{else}}
+    <h1>go/{{.Key}} is not active yet</h1>
+    <h3>It will be active from {{.Link.NotBefore.Format "2006-01-02 15:04:05"}}</h3>
+{{end}}
+    <h3><a href="/_admin">Back to all links</a></h3>
+    </div>
+  </body>
+</html>
+`
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestParseLinkTime(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		value string
+		want  time.Time
+		fails bool
+	}{
+		{"72h", now.Add(72 * time.Hour), false},
+		{"2019-10-05T08:00:00Z", time.Date(2019, 10, 5, 8, 0, 0, 0, time.UTC), false},
+		{"-1h", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	}
+	for _, test := range tests {
+		parsed, err := parseLinkTime(test.value, now)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseLinkTime(%s) expected error gotten %v", test.value, parsed)
+			}
+		} else if err != nil || !parsed.Equal(test.want) {
+			t.Errorf("parseLinkTime(%s) expected %v gotten %v - %v", test.value, test.want, parsed, err)
+		}
+	}
+	if parsed, err := parseLinkTime("", now); parsed != nil || err != nil {
+		t.Errorf("parseLinkTime of empty value expected nil gotten %v - %v", parsed, err)
+	}
+}
+
+func TestInactiveLinks(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	expired := time.Now().Add(-time.Hour)
+	notBefore := time.Now().Add(time.Hour)
+	stateStore.Save(&storage.StorageItem{Key: "gs",
+		Value: &storage.Link{URL: "https://github.com/kouzant/go-short", ExpiresAt: &expired}})
+	stateStore.Save(&storage.StorageItem{Key: "gh", Value: &storage.Link{URL: "https://github.com", NotBefore: &notBefore}})
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/gs", http.StatusGone, "> Key gs expired at "},
+		{"/gs/issues", http.StatusGone, "> Key gs expired at "},
+		{"/gh", http.StatusNotFound, "> Key gh is not active before "},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("GET %s expected status %d and %q gotten %d - %s", test.path, test.status, test.body,
+				w.Code, w.Body.String())
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://go/gs", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "go/gs has expired") {
+		t.Errorf("Expected expired page for gs gotten %d - %s", w.Code, w.Body.String())
+	}
+	// Only redirects count as hits
+	if link, _ := stateStore.Load("gs"); link.Hits != 0 {
+		t.Errorf("Expected no hits counted on expired gs gotten %v", link)
+	}
+	if events, _ := stateStore.LoadHitEvents("gs", 10); len(events) != 3 || events[0].Status != http.StatusGone {
+		t.Errorf("Expected the requests of expired gs recorded as events gotten %v", events)
+	}
+}
+
+func TestAddExpiringLink(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("POST", "http://go/_admin?key=gs&url=https://github.com/kouzant/go-short&expires=72h", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Adding expiring gs expected status %d gotten %d - %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	link, err := stateStore.Load("gs")
+	if err != nil || link.ExpiresAt == nil || link.ExpiresAt.Before(time.Now().Add(71*time.Hour)) ||
+		link.NotBefore != nil {
+		t.Errorf("Expected gs to expire in 72h gotten %v - %v", link, err)
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kouzant/go-short/context"
 	"github.com/kouzant/go-short/storage"
+	log "github.com/sirupsen/logrus"
 )
 
 /**
@@ -17,67 +20,467 @@ import (
  */
 type RedirectHandler struct {
 	StateStore storage.StateStore
+	Auth       *Authenticator
+	// Used for links without a redirect status, 307 when zero
+	DefaultStatus int
+	Namespaces    *Namespaces
 }
 
 func (h *RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	tokens := strings.SplitAfterN(r.URL.Path, "/", 2)
-	value, error := h.StateStore.Load(storage.StorageKey(tokens[1]))
+	vhost, path := h.Namespaces.selectPath(r.Host, tokens[1])
+	if vhost.handleLanding(w, r, path) {
+		return
+	}
+	resolution, error := h.Namespaces.resolve(h.StateStore, vhost, path)
+	if info, ok := h.isInfoPath(vhost, path, resolution); ok {
+		h.handleInfo(w, r, info)
+		return
+	}
 	if error != nil {
-		fmt.Fprintf(w, "Error: %v", error)
+		if _, ok := error.(storage.KeyNotFound); ok {
+			if !vhost.handleNotFound(w, r, path) {
+				h.handleNotFound(w, r, vhost.key(path), vhost)
+			}
+		} else {
+			http.Error(w, fmt.Sprintf("Error: %v", error), http.StatusInternalServerError)
+		}
+		return
+	}
+	// Only hits of stored links are recorded
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.redirect(recorder, r, resolution)
+	var destination string
+	if resolution.Destination != nil {
+		destination = resolution.Destination.URL
+	}
+	h.recordHit(resolution.Key, destination, r, recorder.status)
+}
+
+func (h *RedirectHandler) redirect(w http.ResponseWriter, r *http.Request, resolution *Resolution) {
+	link := resolution.Link
+	now := time.Now()
+	if !link.IsActive(now) {
+		h.handleInactive(w, resolution.Key, link, now, r.UserAgent())
+		return
+	}
+	if link.PasswordHash != "" {
+		password := r.PostFormValue("password")
+		if !checkLinkPassword(link.PasswordHash, password) {
+			h.handlePasswordRequired(w, r, resolution.Key, password != "")
+			return
+		}
+	}
+	if len(link.Rules) > 0 {
+		w.Header().Set("Vary", ruleVaryHeaders)
+		resolution.Rule = link.MatchRule(newRuleRequest(r, now))
+	}
+	if resolution.Rule == nil && link.IsSplit() {
+		destination, err := selectDestination(w, r, resolution.Key, link)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		resolution.Destination = destination
+	}
+	// Only redirects use up a link
+	if link.MaxUses > 0 {
+		if _, err := h.StateStore.ConsumeUse(resolution.Key); err != nil {
+			if _, ok := err.(storage.UsesExhausted); ok {
+				link.Uses = link.MaxUses
+				h.handleInactive(w, resolution.Key, link, now, r.UserAgent())
+			} else {
+				http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	http.Redirect(w, r, resolution.Target(r.URL.RawQuery), h.redirectStatus(r, link))
+}
+
+func (h *RedirectHandler) redirectStatus(r *http.Request, link *storage.Link) int {
+	// The password form is posted, the target should be fetched with GET
+	if r.Method == "POST" {
+		return http.StatusSeeOther
+	}
+	status := http.StatusTemporaryRedirect
+	if link.RedirectStatus != 0 {
+		status = link.RedirectStatus
+	} else if h.DefaultStatus != 0 {
+		status = h.DefaultStatus
+	}
+	if link.IsDynamic() {
+		return temporaryStatus(status)
+	}
+	return status
+}
+
+// Temporary counterpart of a permanent redirect status, which browsers would cache
+func temporaryStatus(status int) int {
+	switch status {
+	case http.StatusMovedPermanently:
+		return http.StatusFound
+	case http.StatusPermanentRedirect:
+		return http.StatusTemporaryRedirect
+	default:
+		return status
+	}
+}
+
+// One of 301, 302, 307 and 308, or nothing for the default of the server
+func ParseRedirectStatus(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil || status == 0 {
+		return 0, fmt.Errorf("Redirect status %s should be one of 301, 302, 307 and 308", value)
+	}
+	if err = validateRedirectStatus(status); err != nil {
+		return 0, err
+	}
+	return status, nil
+}
+
+func validateRedirectStatus(status int) error {
+	switch status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	default:
+		return fmt.Errorf("Redirect status %d should be one of 301, 302, 307 and 308", status)
+	}
+}
+
+type NotFound struct {
+	Key          storage.StorageKey
+	Suggestions  []*storage.StorageItem
+	AuthRequired bool
+}
+
+func (h *RedirectHandler) handleNotFound(w http.ResponseWriter, r *http.Request, key storage.StorageKey,
+	vhost *VirtualHost) {
+	storedItems, err := h.StateStore.LoadAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	suggestions := suggestKeys(h.Namespaces.chain(storedItems, vhost), key, maxSuggestions)
+	notFound := &NotFound{
+		Key:          key,
+		Suggestions:  visibleItems(h.Auth.reader(r), suggestions),
+		AuthRequired: h.Auth.IsEnabled(),
+	}
+
+	if r.UserAgent() == context.CLI_USER_AGENT {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		var buffer strings.Builder
+		fmt.Fprintf(&buffer, "> Key %s does not exist\n", key)
+		if len(notFound.Suggestions) > 0 {
+			fmt.Fprintf(&buffer, "> Did you mean:\n")
+		}
+		for _, item := range notFound.Suggestions {
+			fmt.Fprintf(&buffer, "> Short: %s\t URL: %s\n", item.Key, shownURL(item.Value))
+		}
+		fmt.Fprint(w, buffer.String())
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		if err := not_found_template.Execute(w, notFound); err != nil {
+			log.Errorf("Could not render not found page %s", err)
+		}
+	}
+}
+
+// Only a key or alias followed by the suffix shows the info page, keys like
+// c++ and arguments like go/search/c++ still redirect. The resolution of the
+// whole path is nil when it does not resolve, the one of the info page is returned
+func (h *RedirectHandler) isInfoPath(vhost *VirtualHost, path string, resolution *Resolution) (*Resolution, bool) {
+	if len(path) <= len(infoSuffix) || !strings.HasSuffix(path, infoSuffix) {
+		return nil, false
+	}
+	if resolution != nil && resolution.Rest == "" {
+		return nil, false
+	}
+	info, err := h.Namespaces.resolve(h.StateStore, vhost, strings.TrimSuffix(path, infoSuffix))
+	if err != nil || info.Rest != "" {
+		return nil, false
+	}
+	return info, true
+}
+
+type LinkInfo struct {
+	Key          storage.StorageKey
+	Link         *storage.Link
+	Aliases      []storage.StorageKey
+	AuthRequired bool
+}
+
+func (h *RedirectHandler) handleInfo(w http.ResponseWriter, r *http.Request, resolution *Resolution) {
+	aliases, err := loadAliasGroups(h.StateStore)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	info := &LinkInfo{
+		Key:          resolution.Key,
+		Link:         visibleLink(h.Auth.reader(r), resolution.Key, resolution.Link),
+		Aliases:      aliases[resolution.Key],
+		AuthRequired: h.Auth.IsEnabled(),
+	}
+
+	if r.UserAgent() == context.CLI_USER_AGENT {
+		link := info.Link
+		var buffer strings.Builder
+		fmt.Fprintf(&buffer, "> Short: %s\n", info.Key)
+		fmt.Fprintf(&buffer, "> URL: %s\n", shownURL(link))
+		fmt.Fprintf(&buffer, "> Owner: %s\n", link.Owner)
+		fmt.Fprintf(&buffer, "> Description: %s\n", link.Description)
+		fmt.Fprintf(&buffer, "> Hits: %d\n", link.Hits)
+		fmt.Fprintf(&buffer, "> Created: %s\n", link.CreatedAt.Format("2006-01-02 15:04"))
+		if len(info.Aliases) > 0 {
+			fmt.Fprintf(&buffer, "> Aliases: %s\n", joinKeys(info.Aliases))
+		}
+		fmt.Fprint(w, buffer.String())
 	} else {
-		http.Redirect(w, r, value.(string), http.StatusTemporaryRedirect)
+		if err := info_template.Execute(w, info); err != nil {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
 	}
 }
 
+func (h *RedirectHandler) recordHit(key storage.StorageKey, destination string, r *http.Request, status int) {
+	if key == "" {
+		return
+	}
+	event := &storage.HitEvent{
+		Key:         key,
+		Time:        time.Now(),
+		Referer:     r.Referer(),
+		UserAgent:   r.UserAgent(),
+		Status:      status,
+		Destination: destination,
+	}
+	if err := h.StateStore.RecordHit(event); err != nil {
+		log.Errorf("Could not record hit for key %s %s", key, err)
+	}
+}
+
+// Keeps the status code written by a handler so that it can be recorded
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
 /**
  * HTTP handler for administrative tasks
  */
 
 var list_all_template = template.Must(template.New("list").Parse(list_all_html))
+var info_template = template.Must(template.New("info").Parse(info_html))
+var stats_template = template.Must(template.New("stats").Parse(stats_html))
+var not_found_template = template.Must(template.New("not_found").Parse(not_found_html))
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	maxRecentHits    = 20
+	maxTrendBarWidth = 50
+	// Appended to a key to see its link instead of being redirected
+	infoSuffix = "+"
+)
 
 type AdminHandler struct {
 	StateStore storage.StateStore
+	Auth       *Authenticator
+	KeyGen     *KeyGenerator
+	Namespaces *Namespaces
 }
 
 func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	command, err := parseAdminOp(r)
+	if err == nil {
+		var namespace string
+		namespace, err = h.Namespaces.selectAdmin(r)
+		command = inNamespace(command, namespace)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		return
+	}
+
+	var principal *Principal
+	if requiresAuthentication(command) {
+		principal, err = h.Auth.Authenticate(r)
+		if err == nil {
+			err = authorize(command, principal)
+		}
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+	} else {
+		// Commands that only read show protected links to those who can modify them
+		principal = h.Auth.reader(r)
 	}
 
 	switch command.(type) {
 	case AddCommand:
 		add, _ := command.(AddCommand)
-		h.handleAddCommand(add, w)
+		h.handleAddCommand(add, principal, w, r)
+	case UpdateCommand:
+		update := command.(UpdateCommand)
+		h.handleUpdateCommand(update, principal, w, r)
+	case UpsertCommand:
+		upsert := command.(UpsertCommand)
+		h.handleUpsertCommand(upsert, principal, w, r)
+	case RenameCommand:
+		rename := command.(RenameCommand)
+		h.handleRenameCommand(rename, principal, w)
 	case DeleteCommand:
 		delete := command.(DeleteCommand)
-		h.handleDeleteCommand(delete, w)
+		h.handleDeleteCommand(delete, principal, w, r)
+	case AliasCommand:
+		alias := command.(AliasCommand)
+		h.handleAliasCommand(alias, principal, w)
 	case ListCommand:
 		list := command.(ListCommand)
-		h.handleListCommand(list, w, r.UserAgent())
+		h.handleListCommand(list, principal, w, r.UserAgent())
+	case SearchCommand:
+		search := command.(SearchCommand)
+		h.handleSearchCommand(search, principal, w, r.UserAgent())
 	case AddBatchCommand:
 		addBatch := command.(AddBatchCommand)
-		h.handleAddBatchCommand(addBatch, w)
+		h.handleAddBatchCommand(addBatch, principal, w)
+	case StatsCommand:
+		stats := command.(StatsCommand)
+		h.handleStatsCommand(stats, principal, w, r.UserAgent())
+	case TrashCommand:
+		trash := command.(TrashCommand)
+		h.handleTrashCommand(trash, principal, w)
+	case RestoreCommand:
+		restore := command.(RestoreCommand)
+		h.handleRestoreCommand(restore, principal, w, r)
+	case HistoryCommand:
+		history := command.(HistoryCommand)
+		h.handleHistoryCommand(history, principal, w, r.UserAgent())
+	case RollbackCommand:
+		rollback := command.(RollbackCommand)
+		h.handleRollbackCommand(rollback, principal, w, r)
+	case IssueTokenCommand:
+		issueToken := command.(IssueTokenCommand)
+		h.handleIssueTokenCommand(issueToken, w)
+	case RevokeTokenCommand:
+		revokeToken := command.(RevokeTokenCommand)
+		h.handleRevokeTokenCommand(revokeToken, w)
+	case ListTokensCommand:
+		listTokens := command.(ListTokensCommand)
+		h.handleListTokensCommand(listTokens, w)
+	}
+}
+
+// Everything that changes the state store, or reveals tokens, needs an API token
+func requiresAuthentication(command AdminCommand) bool {
+	switch command.(type) {
+	case ListCommand, SearchCommand, StatsCommand, HistoryCommand, TrashCommand:
+		return false
+	default:
+		return true
 	}
 }
 
-func (h *AdminHandler) handleAddCommand(command AddCommand, w http.ResponseWriter) {
-	err := h.StateStore.Save(storage.NewStorageItem(command.key, command.url))
+func (h *AdminHandler) handleAddCommand(command AddCommand, principal *Principal, w http.ResponseWriter,
+	r *http.Request) {
+	item := storage.NewStorageItem(command.key, command.url)
+	item.Value.Creator = principal.Name
+	item.Value.Owner = principal.Name
+	item.Value.UpdatedBy = principal.Name
+	item.Value.ExpiresAt = command.expiresAt
+	item.Value.NotBefore = command.notBefore
+	item.Value.MaxUses = command.maxUses
+	item.Value.RedirectStatus = command.redirectStatus
+	item.Value.Description = command.description
+	item.Value.Tags = parseTags(command.tags)
+	// The destinations are validated when parsing the command
+	destinations, _ := parseDestinations(command.split)
+	item.Value.SetDestinations(destinations)
+	item.Value.Sticky = command.sticky
+	item.Value.Rules, _ = parseRules(command.rules)
+	var err error
+	if command.password != "" {
+		if item.Value.PasswordHash, err = hashLinkPassword(command.password); err != nil {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	saved := true
+	if command.key == "" {
+		item.Key, saved, err = keyGeneratorOrDefault(h.KeyGen).Save(h.StateStore, h.Namespaces.set(), command.namespace,
+			item.Value)
+	} else {
+		err = h.StateStore.Save(item)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		writeAdminStorageError(w, err)
+		return
+	}
+	// Links created from the not found page go back to the list
+	if isFormSubmission(r) {
+		http.Redirect(w, r, "/_admin", http.StatusSeeOther)
 		return
 	}
-	fmt.Fprintf(w, "Added <%s, %s> to store", command.key, command.url)
+	if !saved {
+		fmt.Fprintf(w, "Found <%s, %s> in store", item.Key, command.url)
+		return
+	}
+	fmt.Fprintf(w, "Added <%s, %s> to store", item.Key, command.url)
+}
+
+func isFormSubmission(r *http.Request) bool {
+	return r.UserAgent() != context.CLI_USER_AGENT && isFormContent(r)
 }
 
-func (h *AdminHandler) handleAddBatchCommand(command AddBatchCommand, w http.ResponseWriter) {
+func isFormContent(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+func (h *AdminHandler) handleAddBatchCommand(command AddBatchCommand, principal *Principal,
+	w http.ResponseWriter) {
 	if len(command.pairs) == 0 {
 		http.Error(w, "No parameters passed", http.StatusBadRequest)
 		return
 	}
+	// Existing links keep everything but their URL, like with upsert, and
+	// the batch is all or nothing for editors
 	items := make([]*storage.StorageItem, 0, len(command.pairs))
 	for _, p := range command.pairs {
-		items = append(items, storage.NewStorageItem(p.Left.(string), p.Right.(string)))
+		item := storage.NewStorageItem(p.Left.(string), p.Right.(string))
+		existing, err := h.StateStore.Load(item.Key)
+		if err == nil {
+			if !principal.CanModify(item.Key, existing) {
+				writeAuthError(w, forbiddenToModify(principal, item.Key))
+				return
+			}
+			existing.SetDestinations(nil)
+			existing.Sticky = false
+			existing.URL = item.Value.URL
+			item.Value = existing
+		} else if _, ok := err.(storage.KeyNotFound); ok {
+			item.Value.Creator = principal.Name
+			item.Value.Owner = principal.Name
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+			return
+		}
+		item.Value.UpdatedBy = principal.Name
+		items = append(items, item)
 	}
 	if len(items) == 0 {
 		http.Error(w, "No parameters passed", http.StatusBadRequest)
@@ -85,63 +488,576 @@ func (h *AdminHandler) handleAddBatchCommand(command AddBatchCommand, w http.Res
 	}
 	err := h.StateStore.SaveAll(items)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		writeAdminStorageError(w, err)
+		return
 	}
 	fmt.Fprintf(w, "Added pairs to store")
 }
 
-func (h *AdminHandler) handleDeleteCommand(command DeleteCommand, w http.ResponseWriter) {
-	value, err := h.StateStore.Delete(storage.StorageKey(command.key))
+func (h *AdminHandler) handleUpdateCommand(command UpdateCommand, principal *Principal,
+	w http.ResponseWriter, r *http.Request) {
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		return
+	}
+	key := storage.StorageKey(command.key)
+	existing, err := h.StateStore.Load(key)
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	if !principal.CanModify(key, existing) {
+		writeAuthError(w, forbiddenToModify(principal, key))
+		return
+	}
+	// A new URL ends the split of a link, new destinations replace the old ones
+	if command.split != "" {
+		destinations, _ := parseDestinations(command.split)
+		existing.SetDestinations(destinations)
+		existing.Sticky = command.sticky
+	} else if command.url != "" {
+		existing.SetDestinations(nil)
+		existing.Sticky = false
+		existing.URL = command.url
+	}
+	if command.description != "" || command.form {
+		existing.Description = command.description
+	}
+	if command.tags != "" || command.form {
+		existing.Tags = parseTags(command.tags)
+	}
+	if command.rules != "" {
+		existing.Rules, _ = parseRules(command.rules)
+	}
+	existing.UpdatedBy = principal.Name
+	if conditional {
+		err = h.StateStore.CompareAndSwap(key, revision, existing)
+	} else {
+		err = h.StateStore.Update(&storage.StorageItem{Key: key, Value: existing})
+	}
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	// The edit form goes back to the info page it was sent from
+	if command.form {
+		http.Redirect(w, r, "/"+command.key+infoSuffix, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("ETag", linkETag(existing))
+	fmt.Fprintf(w, "Updated <%s, %s> in store", command.key, existing.URL)
+}
+
+func (h *AdminHandler) handleUpsertCommand(command UpsertCommand, principal *Principal,
+	w http.ResponseWriter, r *http.Request) {
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		return
+	}
+	item := storage.NewStorageItem(command.key, command.url)
+	existing, err := h.StateStore.Load(item.Key)
+	if err == nil {
+		if !principal.CanModify(item.Key, existing) {
+			writeAuthError(w, forbiddenToModify(principal, item.Key))
+			return
+		}
+		existing.SetDestinations(nil)
+		existing.Sticky = false
+		existing.URL = command.url
+		item.Value = existing
+	} else if _, ok := err.(storage.KeyNotFound); ok {
+		// There is no revision to match
+		if conditional {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusPreconditionFailed)
+			return
+		}
+		item.Value.Creator = principal.Name
+		item.Value.Owner = principal.Name
+	} else {
+		writeAdminStorageError(w, err)
+		return
+	}
+	item.Value.UpdatedBy = principal.Name
+	created := false
+	if conditional {
+		err = h.StateStore.CompareAndSwap(item.Key, revision, item.Value)
+	} else {
+		created, err = h.StateStore.Upsert(item)
+	}
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	if created {
+		fmt.Fprintf(w, "Added <%s, %s> to store", command.key, command.url)
+		return
+	}
+	fmt.Fprintf(w, "Updated <%s, %s> in store", command.key, command.url)
+}
+
+func (h *AdminHandler) handleRenameCommand(command RenameCommand, principal *Principal,
+	w http.ResponseWriter) {
+	from := storage.StorageKey(command.key)
+	existing, err := h.StateStore.Load(from)
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	if !principal.CanModify(from, existing) {
+		writeAuthError(w, forbiddenToModify(principal, from))
+		return
+	}
+	if err = h.StateStore.Rename(from, storage.StorageKey(command.to), principal.Name); err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Renamed key %s to %s", command.key, command.to)
+}
+
+func writeAdminStorageError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case storage.KeyNotFound:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusNotFound)
+	case storage.KeyAlreadyExists, storage.HasAliases, storage.AliasCycle:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusConflict)
+	case storage.RevisionMismatch:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusPreconditionFailed)
+	case storage.InvalidCursor:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+	}
+}
+
+func (h *AdminHandler) handleDeleteCommand(command DeleteCommand, principal *Principal,
+	w http.ResponseWriter, r *http.Request) {
+	revision, conditional, err := ifMatchRevision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		return
+	}
+	// The aliases have no revision of their own to check against
+	if command.cascade && conditional {
+		http.Error(w, "Deleting a link with its aliases cannot be conditional on its revision", http.StatusBadRequest)
+		return
+	}
+	key := storage.StorageKey(command.key)
+	if alias, err := h.StateStore.LoadAlias(key); err == nil {
+		h.handleDeleteAlias(alias, principal, w)
+		return
+	}
+	existing, err := h.StateStore.Load(key)
+	if err == nil && !principal.CanModify(key, existing) {
+		writeAuthError(w, forbiddenToModify(principal, key))
+		return
+	}
+	if command.cascade {
+		value, aliases, err := h.StateStore.DeleteWithAliases(key, principal.Name)
+		if err != nil {
+			writeAdminStorageError(w, err)
+			return
+		}
+		if redirectDeleteForm(w, r) {
+			return
+		}
+		if len(aliases) > 0 {
+			fmt.Fprintf(w, "Deleted key %s -> %s and its aliases %s", command.key, value.URL, joinKeys(aliases))
+			return
+		}
+		fmt.Fprintf(w, "Deleted key %s -> %s", command.key, value.URL)
+		return
+	}
+	if conditional {
+		if err = h.StateStore.CompareAndDelete(key, revision, principal.Name); err != nil {
+			writeAdminStorageError(w, err)
+			return
+		}
+		if redirectDeleteForm(w, r) {
+			return
+		}
+		fmt.Fprintf(w, "Deleted key %s -> %s", command.key, existing.URL)
+		return
+	}
+	value, err := h.StateStore.Delete(key, principal.Name)
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	if redirectDeleteForm(w, r) {
+		return
+	}
+	if value == nil {
+		fmt.Fprintf(w, "Key %s does not exist", command.key)
+		return
+	}
+	fmt.Fprintf(w, "Deleted key %s -> %s", command.key, value.URL)
+}
+
+// The info page of a deleted link is gone, its delete form goes to the list
+// where the link can be restored from the recently deleted ones
+func redirectDeleteForm(w http.ResponseWriter, r *http.Request) bool {
+	if !isFormSubmission(r) {
+		return false
+	}
+	http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+	return true
+}
+
+type AdminList struct {
+	Items []*storage.StorageItem
+	// Aliases grouped under the keys of the items they lead to
+	Aliases         map[storage.StorageKey][]storage.StorageKey
+	RecentlyDeleted []*storage.TrashItem
+	AuthRequired    bool
+	// Empty for the global namespace
+	Namespace string
+	// Set when the items are search results
+	Searching bool
+	Query     string
+	Tag       string
+	// Set when the items are a page of all links
+	Sort       storage.SortOrder
+	Limit      int
+	Cursor     string
+	NextCursor string
+}
+
+func (h *AdminHandler) handleListCommand(command ListCommand, principal *Principal, w http.ResponseWriter,
+	userAgent string) {
+	options := command.options
+	options.Namespaces = h.Namespaces.set()
+	page, err := h.StateStore.LoadPage(&options)
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+	h.writeList(w, &AdminList{Items: visibleItems(principal, page.Items), Namespace: options.Namespace,
+		Sort: options.Sort, Limit: options.Limit, Cursor: options.Cursor, NextCursor: page.NextCursor},
+		principal, userAgent)
+}
+
+func (h *AdminHandler) handleSearchCommand(command SearchCommand, principal *Principal, w http.ResponseWriter,
+	userAgent string) {
+	storedItems, err := h.StateStore.Search(command.query, command.tag)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "Deleted key %s", value)
+	storedItems = h.Namespaces.set().Filter(storedItems, command.namespace)
+	// Hidden URLs are not searched either, the results would give them away
+	matching := make([]*storage.StorageItem, 0, len(storedItems))
+	for _, item := range visibleItems(principal, storedItems) {
+		if storage.MatchesSearch(item.Key, item.Value, command.query, command.tag) {
+			matching = append(matching, item)
+		}
+	}
+	h.writeList(w, &AdminList{Items: matching, Namespace: command.namespace, Searching: true,
+		Query: command.query, Tag: command.tag}, principal, userAgent)
 }
 
-func (h *AdminHandler) handleListCommand(command ListCommand, w http.ResponseWriter,
+func (h *AdminHandler) writeList(w http.ResponseWriter, list *AdminList, principal *Principal,
 	userAgent string) {
-	storedItems, err := h.StateStore.LoadAll()
+	storedItems := list.Items
+	aliases, err := loadAliasGroups(h.StateStore)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 		return
 	}
+	list.Aliases = aliases
 	// If is's the CLI return simple string
 	// otherwise template an HTML page
 	if userAgent == context.CLI_USER_AGENT {
 		var buffer strings.Builder
-		fmt.Fprintf(&buffer, "> Number of stored items: %d\n", len(storedItems))
+		if list.Searching {
+			fmt.Fprintf(&buffer, "> Number of matching items: %d\n", len(storedItems))
+		} else {
+			fmt.Fprintf(&buffer, "> Number of listed items: %d\n", len(storedItems))
+		}
 
 		for _, item := range storedItems {
-			fmt.Fprintf(&buffer, "> Short: %s\t URL: %s\n", item.Key, item.Value)
+			fmt.Fprintf(&buffer, "> Short: %s\t URL: %s\t Revision: %d", item.Key, shownURL(item.Value),
+				item.Value.Revision)
+			if keys := aliases[item.Key]; len(keys) > 0 {
+				fmt.Fprintf(&buffer, "\t Aliases: %s", joinKeys(keys))
+			}
+			fmt.Fprint(&buffer, "\n")
+		}
+		if list.NextCursor != "" {
+			fmt.Fprintf(&buffer, "> More items with -cursor %s\n", list.NextCursor)
 		}
 		fmt.Fprint(w, buffer.String())
 	} else {
-		err := list_all_template.Execute(w, storedItems)
+		// Recently deleted links are shown under the first page
+		if !list.Searching && list.Cursor == "" {
+			trash, err := h.loadRecentlyDeleted(list.Namespace)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+				return
+			}
+			list.RecentlyDeleted = visibleTrash(principal, trash)
+		}
+		list.AuthRequired = h.Auth.IsEnabled()
+		if err := list_all_template.Execute(w, list); err != nil {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+	}
+}
+
+type LinkStats struct {
+	Key    string
+	Link   *storage.Link
+	Days   int
+	Total  uint64
+	Max    uint64
+	Trend  []*storage.DailyHits
+	Recent []*storage.HitEvent
+}
+
+// Width of a trend bar relative to the busiest day
+func (s *LinkStats) BarWidth(count uint64) int {
+	if s.Max == 0 {
+		return 0
+	}
+	return int(count * maxTrendBarWidth / s.Max)
+}
+
+// Percentage of the traffic a destination of a split link is meant to get
+func (s *LinkStats) WeightShare(weight uint) int {
+	total := s.Link.TotalWeight()
+	if total == 0 {
+		return 0
+	}
+	return int(weight * 100 / total)
+}
+
+func (h *AdminHandler) handleStatsCommand(command StatsCommand, principal *Principal, w http.ResponseWriter,
+	userAgent string) {
+	stats, err := h.loadStats(command)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	if stats.Link != nil {
+		stats.Link = visibleLink(principal, storage.StorageKey(command.key), stats.Link)
+	}
+	if userAgent == context.CLI_USER_AGENT {
+		var buffer strings.Builder
+		fmt.Fprintf(&buffer, "> Hits of %s during the last %d days: %d\n", stats.Key, stats.Days, stats.Total)
+		for _, day := range stats.Trend {
+			fmt.Fprintf(&buffer, "> %s %6d %s\n", day.Day, day.Count,
+				strings.Repeat("#", stats.BarWidth(day.Count)))
+		}
+		if stats.Link != nil && stats.Link.IsSplit() {
+			fmt.Fprintf(&buffer, "> Destinations:\n")
+			for _, destination := range stats.Link.Destinations {
+				fmt.Fprintf(&buffer, "> %s\t%d%%\t%d hits\n", destination.URL,
+					stats.WeightShare(destination.Weight), destination.Hits)
+			}
+		}
+		if stats.Link != nil && len(stats.Link.Rules) > 0 {
+			fmt.Fprintf(&buffer, "> Rules:\n")
+			for _, rule := range stats.Link.Rules {
+				fmt.Fprintf(&buffer, "> %s\n", rule)
+			}
+		}
+		fmt.Fprintf(&buffer, "> Recent hits:\n")
+		for _, event := range stats.Recent {
+			fmt.Fprintf(&buffer, "> %s\t%d\t%s\t%s\n", event.Time.Format(time.RFC3339), event.Status,
+				event.Referer, event.UserAgent)
+		}
+		fmt.Fprint(w, buffer.String())
+	} else {
+		err := stats_template.Execute(w, stats)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 		}
 	}
 }
 
+func (h *AdminHandler) loadStats(command StatsCommand) (*LinkStats, error) {
+	key := storage.StorageKey(command.key)
+	link, err := h.StateStore.Load(key)
+	if err != nil {
+		if _, ok := err.(storage.KeyNotFound); !ok {
+			return nil, err
+		}
+	}
+	since := time.Now().UTC().AddDate(0, 0, 1-command.days)
+	dailyHits, err := h.StateStore.LoadDailyHits(key, since)
+	if err != nil {
+		return nil, err
+	}
+	recent, err := h.StateStore.LoadHitEvents(key, maxRecentHits)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &LinkStats{Key: command.key, Link: link, Days: command.days, Recent: recent}
+	stats.Trend = hitTrend(dailyHits, since, command.days)
+	for _, day := range stats.Trend {
+		stats.Total += day.Count
+		if day.Count > stats.Max {
+			stats.Max = day.Count
+		}
+	}
+	return stats, nil
+}
+
+// Fills in the days without any hits
+func hitTrend(dailyHits []*storage.DailyHits, since time.Time, days int) []*storage.DailyHits {
+	counts := make(map[string]uint64, len(dailyHits))
+	for _, day := range dailyHits {
+		counts[day.Day] = day.Count
+	}
+	trend := make([]*storage.DailyHits, 0, days)
+	for i := 0; i < days; i++ {
+		day := storage.HitDay(since.AddDate(0, 0, i))
+		trend = append(trend, &storage.DailyHits{Day: day, Count: counts[day]})
+	}
+	return trend
+}
+
 type AdminCommand interface{}
 
 type AddCommand struct {
 	key string
 	url string
+	// Optional, both nil when the link is always active
+	expiresAt *time.Time
+	notBefore *time.Time
+	// Optional, asked for before redirecting
+	password string
+	// Optional, zero when the link can be used any number of times
+	maxUses uint64
+	// Optional, zero for the default of the server
+	redirectStatus int
+	description    string
+	// Comma separated
+	tags string
+	// Namespace of the generated key when the key is missing
+	namespace string
+	// Optional comma separated URL=weight pairs, the url is the one of the first pair
+	split  string
+	sticky bool
+	// Optional comma separated CONDITIONS URL pairs
+	rules string
+}
+
+type UpdateCommand struct {
+	key         string
+	url         string
+	description string
+	// Comma separated
+	tags string
+	// Comma separated URL=weight pairs
+	split  string
+	sticky bool
+	// Comma separated CONDITIONS URL pairs, none removes the rules
+	rules string
+	// Sent by the edit form of the info page, whose empty fields clear the
+	// description and tags
+	form bool
+}
+
+type UpsertCommand struct {
+	key string
+	url string
+}
+
+type RenameCommand struct {
+	key string
+	to  string
+}
+
+type HistoryCommand struct {
+	key string
+}
+
+type RollbackCommand struct {
+	key      string
+	revision uint64
 }
 
 type DeleteCommand struct {
 	key string
+	// Deletes the aliases of the link too, otherwise links with aliases are not deleted
+	cascade bool
+}
+
+type TrashCommand struct {
+	namespace string
+}
+
+type RestoreCommand struct {
+	key string
 }
 
 type ListCommand struct {
+	options storage.ListOptions
+}
+
+type SearchCommand struct {
+	query     string
+	tag       string
+	namespace string
+}
+
+// Listing is paginated, the first page is sorted by key unless sort is given
+func parseListOptions(values url.Values) (*storage.ListOptions, error) {
+	sort, err := storage.ParseSortOrder(values.Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultListLimit
+	if l := values.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, fmt.Errorf("List limit should be between 1 and %d", maxListLimit)
+		}
+	}
+	return &storage.ListOptions{Cursor: values.Get("cursor"), Limit: limit, Sort: sort}, nil
+}
+
+// Tags are given comma separated
+func parseTags(value string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
 }
 
 type AddBatchCommand struct {
 	pairs []*storage.Pair
 }
 
+type StatsCommand struct {
+	key  string
+	days int
+}
+
+type IssueTokenCommand struct {
+	name      string
+	role      storage.Role
+	namespace string
+}
+
+type RevokeTokenCommand struct {
+	name      string
+	namespace string
+}
+
+type ListTokensCommand struct {
+	namespace string
+}
+
 func parseAdminOp(r *http.Request) (AdminCommand, error) {
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
@@ -149,26 +1065,203 @@ func parseAdminOp(r *http.Request) (AdminCommand, error) {
 	}
 	switch r.Method {
 	case "POST":
-		// Add
-		key := values.Get("key")
-		if key == "" {
-			return nil, fmt.Errorf("Add command is missing key parameter")
+		// Add, either from the CLI query or from an HTML form
+		if isFormContent(r) {
+			if err := r.ParseForm(); err != nil {
+				return nil, err
+			}
+			values = r.Form
+		}
+		if values.Get("op") == "issue-token" {
+			name := values.Get("name")
+			if name == "" {
+				return nil, fmt.Errorf("Issue token command is missing name parameter")
+			}
+			if name == RootTokenName {
+				return nil, fmt.Errorf("Token name %s is reserved", RootTokenName)
+			}
+			role := storage.RoleEditor
+			if values.Get("role") != "" {
+				role, err = storage.ParseRole(values.Get("role"))
+				if err != nil {
+					return nil, err
+				}
+			}
+			return IssueTokenCommand{name: name, role: role}, nil
 		}
+		switch values.Get("op") {
+		case "update", "upsert":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Update command is missing key parameter")
+			}
+			url := values.Get("url")
+			if values.Get("op") == "upsert" {
+				if url == "" {
+					return nil, fmt.Errorf("Upsert command is missing url parameter")
+				}
+				return UpsertCommand{key, url}, nil
+			}
+			// Only the given parameters change
+			description := values.Get("description")
+			tags := values.Get("tags")
+			split := values.Get("split")
+			if _, err := parseDestinations(split); err != nil {
+				return nil, err
+			}
+			rules := values.Get("rules")
+			if _, err := parseRules(rules); err != nil {
+				return nil, err
+			}
+			form := isFormSubmission(r)
+			if url == "" && description == "" && tags == "" && split == "" && rules == "" && !form {
+				return nil, fmt.Errorf("Update command is missing url, split, rules, description or tags parameter")
+			}
+			return UpdateCommand{key: key, url: url, description: description, tags: tags, split: split,
+				sticky: values.Get("sticky") == "true", rules: rules, form: form}, nil
+		case "rename":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Rename command is missing key parameter")
+			}
+			to := values.Get("to")
+			if to == "" {
+				return nil, fmt.Errorf("Rename command is missing to parameter")
+			}
+			return RenameCommand{key, to}, nil
+		case "rollback":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Rollback command is missing key parameter")
+			}
+			revision, err := strconv.ParseUint(values.Get("revision"), 10, 64)
+			if err != nil || revision == 0 {
+				return nil, fmt.Errorf("Rollback command revision should be a positive number")
+			}
+			return RollbackCommand{key, revision}, nil
+		case "restore":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Restore command is missing key parameter")
+			}
+			return RestoreCommand{key}, nil
+		case "delete":
+			// HTML forms cannot send DELETE
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Delete command is missing key parameter")
+			}
+			return DeleteCommand{key: key, cascade: values.Get("cascade") == "true"}, nil
+		case "alias":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Alias command is missing key parameter")
+			}
+			to := values.Get("to")
+			if to == "" {
+				return nil, fmt.Errorf("Alias command is missing to parameter")
+			}
+			return AliasCommand{key: key, to: to}, nil
+		}
+		// The key is generated when it is missing
+		key := values.Get("key")
 		url := values.Get("url")
+		split := values.Get("split")
+		destinations, err := parseDestinations(split)
+		if err != nil {
+			return nil, err
+		}
+		if len(destinations) > 0 {
+			url = destinations[0].URL
+		}
 		if url == "" {
-			return nil, fmt.Errorf("Add command is missing url parameter")
+			return nil, fmt.Errorf("Add command is missing url or split parameter")
+		}
+		rules := values.Get("rules")
+		if _, err = parseRules(rules); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		expiresAt, err := parseLinkTime(values.Get("expires"), now)
+		if err != nil {
+			return nil, err
+		}
+		notBefore, err := parseLinkTime(values.Get("not-before"), now)
+		if err != nil {
+			return nil, err
+		}
+		if err = validateLinkSchedule(&storage.Link{ExpiresAt: expiresAt, NotBefore: notBefore}, now); err != nil {
+			return nil, err
+		}
+		maxUses := uint64(0)
+		if values.Get("max-uses") != "" {
+			maxUses, err = strconv.ParseUint(values.Get("max-uses"), 10, 64)
+			if err != nil || maxUses == 0 {
+				return nil, fmt.Errorf("Add command max-uses should be a positive number")
+			}
 		}
-		return AddCommand{key, url}, nil
+		redirectStatus, err := ParseRedirectStatus(values.Get("redirect-status"))
+		if err != nil {
+			return nil, err
+		}
+		return AddCommand{key: key, url: url, expiresAt: expiresAt, notBefore: notBefore,
+			password: values.Get("password"), maxUses: maxUses, redirectStatus: redirectStatus,
+			description: values.Get("description"), tags: values.Get("tags"), split: split,
+			sticky: values.Get("sticky") == "true", rules: rules}, nil
 	case "DELETE":
+		if values.Get("op") == "revoke-token" {
+			name := values.Get("name")
+			if name == "" {
+				return nil, fmt.Errorf("Revoke token command is missing name parameter")
+			}
+			return RevokeTokenCommand{name: name}, nil
+		}
 		// Delete
 		key := values.Get("key")
 		if key == "" {
 			return nil, fmt.Errorf("Delete command is missing key parameter")
 		}
-		return DeleteCommand{key}, nil
+		return DeleteCommand{key: key, cascade: values.Get("cascade") == "true"}, nil
 	case "GET":
-		// List all
-		return ListCommand{}, nil
+		switch values.Get("op") {
+		case "stats":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("Stats command is missing key parameter")
+			}
+			days := defaultStatsDays
+			if d := values.Get("days"); d != "" {
+				days, err = strconv.Atoi(d)
+				if err != nil || days < 1 || days > maxStatsDays {
+					return nil, fmt.Errorf("Stats command days should be between 1 and %d", maxStatsDays)
+				}
+			}
+			return StatsCommand{key, days}, nil
+		case "trash":
+			return TrashCommand{}, nil
+		case "history":
+			key := values.Get("key")
+			if key == "" {
+				return nil, fmt.Errorf("History command is missing key parameter")
+			}
+			return HistoryCommand{key}, nil
+		case "tokens":
+			return ListTokensCommand{}, nil
+		case "", "search":
+			if values.Get("q") != "" || values.Get("tag") != "" {
+				return SearchCommand{query: values.Get("q"), tag: values.Get("tag")}, nil
+			}
+			if values.Get("op") == "search" {
+				return nil, fmt.Errorf("Search command is missing q or tag parameter")
+			}
+			options, err := parseListOptions(values)
+			if err != nil {
+				return nil, err
+			}
+			return ListCommand{*options}, nil
+		default:
+			return nil, fmt.Errorf("Unknown operation %s", values.Get("op"))
+		}
 	case "PUT":
 		// Add batch
 		body, err := ioutil.ReadAll(r.Body)
@@ -226,21 +1319,311 @@ const list_all_html = `
  </head>
  <body>
     <div align="center">
-    <h1>go-shortened URLs: {{len .}}</h1>
+{{if .Searching}}
+    <h1>Matching go-shortened URLs{{if .Namespace}} of {{.Namespace}}{{end}}: {{len .Items}}</h1>
+    <h3><a href="/_admin{{if .Namespace}}?ns={{.Namespace}}{{end}}">Back to all links</a></h3>
+{{else}}
+    <h1>go-shortened URLs{{if .Namespace}} of {{.Namespace}}{{end}}: {{len .Items}}{{if .NextCursor}}+{{end}}</h1>
     <h3>If you have no idea what's this, go check project's <a href="https://github.com/kouzant/go-short" target="_blank">GitHub page</a></h3>
+    <h3>Sort by <a href="/_admin?sort=key&limit={{.Limit}}{{if .Namespace}}&ns={{.Namespace}}{{end}}">key</a> - <a href="/_admin?sort=created&limit={{.Limit}}{{if .Namespace}}&ns={{.Namespace}}{{end}}">newest</a> - <a href="/_admin?sort=hits&limit={{.Limit}}{{if .Namespace}}&ns={{.Namespace}}{{end}}">hits</a></h3>
+{{end}}
+    <form method="GET" action="/_admin">
+{{if .Namespace}}
+      <input type="hidden" name="ns" value="{{.Namespace}}">
+{{end}}
+      <input type="search" name="q" value="{{.Query}}" placeholder="Search" size="40">
+      <input type="text" name="tag" value="{{.Tag}}" placeholder="Tag">
+      <input type="submit" value="Search">
+    </form>
     <table>
       <tr>
 	<th>Shortened</th>
+	<th>Aliases</th>
 	<th>URL</th>
+	<th>Description</th>
+	<th>Tags</th>
+	<th>Created</th>
+	<th>Hits</th>
       </tr>
 
-{{range .}}
+{{range .Items}}
       <tr>
-	<td class="short">{{.Key}}</td>
-	<td class="long"><a href="{{.Value}}">{{.Value}}</a></td>
+	<td class="short"><a href="/_admin?op=stats&key={{.Key}}">{{.Key}}</a></td>
+	<td class="short">{{range index $.Aliases .Key}}{{.}} {{end}}</td>
+	<td class="long">{{if .Value.URL}}<a href="{{.Value.URL}}">{{.Value.URL}}</a>{{else}}protected by a password{{end}}</td>
+	<td class="long">{{.Value.Description}}</td>
+	<td class="short">{{range .Value.Tags}}<a href="/_admin?tag={{.}}{{if $.Namespace}}&ns={{$.Namespace}}{{end}}">{{.}}</a> {{end}}</td>
+	<td class="short">{{.Value.CreatedAt.Format "2006-01-02"}}</td>
+	<td class="short">{{.Value.Hits}}</td>
       </tr>
 {{end}}
     </table>
+{{if .NextCursor}}
+    <h3><a href="/_admin?sort={{.Sort}}&limit={{.Limit}}&cursor={{.NextCursor}}{{if .Namespace}}&ns={{.Namespace}}{{end}}">Next page</a></h3>
+{{end}}
+{{if .RecentlyDeleted}}
+    <h2>Recently deleted</h2>
+    <table>
+      <tr>
+	<th>Shortened</th>
+	<th>URL</th>
+	<th>Deleted</th>
+	<th>By</th>
+	<th></th>
+      </tr>
+{{range .RecentlyDeleted}}
+      <tr>
+	<td class="short"><a href="/_admin?op=history&key={{.Key}}">{{.Key}}</a></td>
+	<td class="long">{{if .Link.URL}}{{.Link.URL}}{{else}}protected by a password{{end}}</td>
+	<td class="short">{{.DeletedAt.Format "2006-01-02 15:04"}}</td>
+	<td class="short">{{if .DeletedBy}}{{.DeletedBy}}{{else}}anonymous{{end}}</td>
+	<td class="short">
+	  <form method="POST" action="/_admin">
+	    <input type="hidden" name="op" value="restore">
+	    <input type="hidden" name="key" value="{{.Key}}">
+{{if $.AuthRequired}}
+	    <input type="password" name="token" placeholder="API token" required>
+{{end}}
+	    <input type="submit" value="Restore">
+	  </form>
+	</td>
+      </tr>
+{{end}}
+    </table>
+{{end}}
+    </div>
+  </body>
+</html>
+`
+
+const info_html = `
+<html>
+ <head>
+   <style>
+     body {
+     font-family: arial, sans-serif;
+     }
+
+     table {
+     border-collapse: collapse;
+     width: 60%;
+     }
+
+     td, th {
+     border: 1px solid #dddddd;
+     text-align: left;
+     padding: 8px;
+     }
+
+     input {
+     padding: 6px;
+     margin: 4px;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+    <h1>go/{{.Key}}</h1>
+    <table>
+      <tr>
+	<th>URL</th>
+	<td>{{if .Link.IsSplit}}{{range .Link.Destinations}}<a href="{{.URL}}">{{.URL}}</a> ({{.Weight}}) {{end}}{{else if .Link.URL}}<a href="{{.Link.URL}}">{{.Link.URL}}</a>{{else}}protected by a password{{end}}</td>
+      </tr>
+      <tr>
+	<th>Owner</th>
+	<td>{{if .Link.Owner}}{{.Link.Owner}}{{else}}anonymous{{end}}</td>
+      </tr>
+      <tr>
+	<th>Description</th>
+	<td>{{.Link.Description}}</td>
+      </tr>
+      <tr>
+	<th>Tags</th>
+	<td>{{range .Link.Tags}}<a href="/_admin?tag={{.}}">{{.}}</a> {{end}}</td>
+      </tr>
+      <tr>
+	<th>Hits</th>
+	<td>{{.Link.Hits}}</td>
+      </tr>
+      <tr>
+	<th>Created</th>
+	<td>{{.Link.CreatedAt.Format "2006-01-02 15:04"}}</td>
+      </tr>
+      <tr>
+	<th>Aliases</th>
+	<td>{{range .Aliases}}<a href="/{{.}}+">{{.}}</a> {{end}}</td>
+      </tr>
+    </table>
+    <h3>Edit</h3>
+    <form method="POST" action="/_admin">
+      <input type="hidden" name="op" value="update">
+      <input type="hidden" name="key" value="{{.Key}}">
+{{if and .Link.URL (not .Link.IsSplit)}}
+      <input type="url" name="url" value="{{.Link.URL}}" size="60" required>
+{{end}}
+      <input type="text" name="description" value="{{.Link.Description}}" placeholder="Description" size="40">
+      <input type="text" name="tags" value="{{range $i, $tag := .Link.Tags}}{{if $i}},{{end}}{{$tag}}{{end}}" placeholder="Tags">
+{{if .AuthRequired}}
+      <input type="password" name="token" placeholder="API token" required>
+{{end}}
+      <input type="submit" value="Save">
+    </form>
+    <form method="POST" action="/_admin">
+      <input type="hidden" name="op" value="delete">
+      <input type="hidden" name="key" value="{{.Key}}">
+{{if .Aliases}}
+      <label><input type="checkbox" name="cascade" value="true">Delete its aliases too</label>
+{{end}}
+{{if .AuthRequired}}
+      <input type="password" name="token" placeholder="API token" required>
+{{end}}
+      <input type="submit" value="Delete">
+    </form>
+    <h3><a href="/_admin?op=stats&key={{.Key}}">Stats</a> - <a href="/_admin?op=history&key={{.Key}}">History</a> - <a href="/_admin">All links</a></h3>
+    </div>
+  </body>
+</html>
+`
+
+const stats_html = `
+<html>
+ <head>
+   <style>
+     table {
+     font-family: arial, sans-serif;
+     border-collapse: collapse;
+     width: 80%;
+     }
+
+     td, th {
+     border: 1px solid #dddddd;
+     text-align: left;
+     padding: 8px;
+     }
+
+     .bar {
+     background-color: #4a90d9;
+     height: 12px;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+    <h1>{{.Key}}: {{.Total}} hits during the last {{.Days}} days</h1>
+    {{if .Link}}<h3>{{if .Link.URL}}<a href="{{.Link.URL}}">{{.Link.URL}}</a>{{else}}Protected by a password{{end}} - {{.Link.Hits}} hits in total</h3>{{else}}<h3>{{.Key}} is not stored</h3>{{end}}
+    <table>
+      <tr>
+	<th>Day</th>
+	<th>Hits</th>
+	<th width="60%"></th>
+      </tr>
+{{range .Trend}}
+      <tr>
+	<td>{{.Day}}</td>
+	<td>{{.Count}}</td>
+	<td><div class="bar" style="width: {{$.BarWidth .Count}}%"></div></td>
+      </tr>
+{{end}}
+    </table>
+    {{if .Link}}{{if .Link.IsSplit}}
+    <h2>Destinations{{if .Link.Sticky}} (sticky){{end}}</h2>
+    <table>
+      <tr>
+	<th>URL</th>
+	<th>Weight</th>
+	<th>Hits</th>
+      </tr>
+{{range .Link.Destinations}}
+      <tr>
+	<td><a href="{{.URL}}">{{.URL}}</a></td>
+	<td>{{$.WeightShare .Weight}}%</td>
+	<td>{{.Hits}}</td>
+      </tr>
+{{end}}
+    </table>
+    {{end}}{{end}}
+    {{if .Link}}{{if .Link.Rules}}
+    <h2>Rules</h2>
+    <table>
+      <tr>
+	<th>Conditions</th>
+	<th>URL</th>
+      </tr>
+{{range .Link.Rules}}
+      <tr>
+	<td>{{range $i, $c := .Conditions}}{{if $i}} and {{end}}{{$c}}{{end}}</td>
+	<td><a href="{{.URL}}">{{.URL}}</a></td>
+      </tr>
+{{end}}
+    </table>
+    {{end}}{{end}}
+    <h2>Recent hits</h2>
+    <table>
+      <tr>
+	<th>Time</th>
+	<th>Status</th>
+	<th>Referer</th>
+	<th>User agent</th>
+      </tr>
+{{range .Recent}}
+      <tr>
+	<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+	<td>{{.Status}}</td>
+	<td>{{.Referer}}</td>
+	<td>{{.UserAgent}}</td>
+      </tr>
+{{end}}
+    </table>
+    <h3><a href="/_admin?op=history&key={{.Key}}">History</a> - <a href="/_admin">Back to all links</a></h3>
+    </div>
+  </body>
+</html>
+`
+
+const not_found_html = `
+<html>
+ <head>
+   <style>
+     body {
+     font-family: arial, sans-serif;
+     }
+
+     ul {
+     list-style: none;
+     padding: 0;
+     }
+
+     li {
+     padding: 4px;
+     }
+
+     input {
+     padding: 6px;
+     margin: 4px;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+    <h1>go/{{.Key}} does not exist</h1>
+{{if .Suggestions}}
+    <h3>Did you mean:</h3>
+    <ul>
+{{range .Suggestions}}
+      <li><a href="/{{.Key}}">go/{{.Key}}</a> - {{if .Value.URL}}{{.Value.URL}}{{else}}protected by a password{{end}}</li>
+{{end}}
+    </ul>
+{{end}}
+    <h3>Create it now</h3>
+    <form method="POST" action="/_admin">
+      go/<input type="text" name="key" value="{{.Key}}" required>
+      <input type="url" name="url" placeholder="https://" size="60" required>
+{{if .AuthRequired}}
+      <input type="password" name="token" placeholder="API token" required>
+{{end}}
+      <input type="submit" value="Create">
+    </form>
+    <h3><a href="/_admin">All links</a></h3>
     </div>
   </body>
 </html>
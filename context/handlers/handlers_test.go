@@ -3,9 +3,14 @@ package handlers
 import (
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/kouzant/go-short/context"
 	"github.com/kouzant/go-short/storage"
 )
 
@@ -18,15 +23,53 @@ func TestCommandParsing(t *testing.T) {
 		method string
 		want   AdminCommand
 	}{
-		{"key=gs&url=" + shortenUrl, "", "POST", AddCommand{"gs", shortenUrl}},
-		{"url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&url=" + shortenUrl, "", "POST", AddCommand{key: "gs", url: shortenUrl}},
+		{"url=" + shortenUrl, "", "POST", AddCommand{url: shortenUrl}},
 		{"key=gs", "", "POST", nil},
 		{"", "", "POST", nil},
+		{"key=gs&expires=-1h&url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&expires=soon&url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&expires=1h&not-before=2h&url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&password=secret&max-uses=1&url=" + shortenUrl, "", "POST", AddCommand{key: "gs", url: shortenUrl, password: "secret", maxUses: 1}},
+		{"key=gs&max-uses=0&url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&redirect-status=308&url=" + shortenUrl, "", "POST", AddCommand{key: "gs", url: shortenUrl, redirectStatus: 308}},
+		{"key=gs&redirect-status=303&url=" + shortenUrl, "", "POST", nil},
+		{"key=gs&description=Shortener&tags=go,code&url=" + shortenUrl, "", "POST", AddCommand{key: "gs", url: shortenUrl, description: "Shortener", tags: "go,code"}},
 
-		{"key=gs", "", "DELETE", DeleteCommand{"gs"}},
+		{"op=update&key=gs&url=" + shortenUrl, "", "POST", UpdateCommand{key: "gs", url: shortenUrl}},
+		{"op=update&key=gs&description=Shortener&tags=go,code", "", "POST", UpdateCommand{key: "gs", description: "Shortener", tags: "go,code"}},
+		{"op=update&key=gs", "", "POST", nil},
+		{"op=update&url=" + shortenUrl, "", "POST", nil},
+		{"op=upsert&key=gs&url=" + shortenUrl, "", "POST", UpsertCommand{"gs", shortenUrl}},
+		{"op=upsert&key=gs", "", "POST", nil},
+		{"op=rename&key=gs&to=go-short", "", "POST", RenameCommand{"gs", "go-short"}},
+		{"op=rename&key=gs", "", "POST", nil},
+		{"op=rollback&key=gs&revision=2", "", "POST", RollbackCommand{"gs", 2}},
+		{"op=rollback&key=gs&revision=0", "", "POST", nil},
+		{"op=rollback&key=gs", "", "POST", nil},
+		{"op=restore&key=gs", "", "POST", RestoreCommand{"gs"}},
+		{"op=restore", "", "POST", nil},
+		{"op=delete&key=gs&cascade=true", "", "POST", DeleteCommand{key: "gs", cascade: true}},
+		{"op=delete", "", "POST", nil},
+
+		{"key=gs", "", "DELETE", DeleteCommand{key: "gs"}},
 		{"", "", "DELETE", nil},
 
-		{"", "", "GET", ListCommand{}},
+		{"", "", "GET", ListCommand{storage.ListOptions{Limit: defaultListLimit, Sort: storage.SortByKey}}},
+		{"sort=hits&limit=10&cursor=abc", "", "GET", ListCommand{storage.ListOptions{Cursor: "abc", Limit: 10, Sort: storage.SortByHits}}},
+		{"sort=url", "", "GET", nil},
+		{"limit=0", "", "GET", nil},
+		{"op=stats&key=gs", "", "GET", StatsCommand{"gs", defaultStatsDays}},
+		{"op=stats&key=gs&days=7", "", "GET", StatsCommand{"gs", 7}},
+		{"op=stats&key=gs&days=0", "", "GET", nil},
+		{"op=stats", "", "GET", nil},
+		{"op=history&key=gs", "", "GET", HistoryCommand{"gs"}},
+		{"op=history", "", "GET", nil},
+		{"op=trash", "", "GET", TrashCommand{}},
+		{"q=go+short", "", "GET", SearchCommand{query: "go short"}},
+		{"op=search&tag=code", "", "GET", SearchCommand{tag: "code"}},
+		{"op=search", "", "GET", nil},
+		{"op=unknown", "", "GET", nil},
 
 		{"", "key0,val0\nkey1,val1", "PUT", AddBatchCommand{[]*storage.Pair{&storage.Pair{Left: "key0", Right: "val0"}, &storage.Pair{Left: "key1", Right: "val1"}}}},
 	}
@@ -56,6 +99,320 @@ func TestCommandParsing(t *testing.T) {
 	}
 }
 
+func TestLinkEditing(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		params string
+		status int
+	}{
+		{"op=update&key=gs&url=https://github.com", http.StatusNotFound},
+		{"op=upsert&key=gs&url=https://github.com", http.StatusOK},
+		{"op=update&key=gs&url=https://github.com/kouzant/go-short", http.StatusOK},
+		{"key=go&url=https://golang.org", http.StatusOK},
+		{"key=go&url=https://go.dev", http.StatusConflict},
+		{"op=rename&key=gs&to=go", http.StatusConflict},
+		{"op=rename&key=missing&to=other", http.StatusNotFound},
+		{"op=rename&key=gs&to=go-short", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "http://go/_admin?"+test.params, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("POST %s expected status %d gotten %d - %s", test.params, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	link, err := stateStore.Load("go-short")
+	if err != nil || link.URL != "https://github.com/kouzant/go-short" {
+		t.Errorf("Expected go-short -> https://github.com/kouzant/go-short gotten %v - %v", link, err)
+	}
+	if _, err = stateStore.Load("gs"); err == nil {
+		t.Errorf("Expected gs to be renamed")
+	}
+
+	var conditional = []struct {
+		method  string
+		params  string
+		ifMatch string
+		status  int
+	}{
+		{"POST", "op=update&key=go-short&url=https://github.com", `"2"`, http.StatusPreconditionFailed},
+		{"POST", "op=update&key=go-short&url=https://github.com", `"3"`, http.StatusOK},
+		{"POST", "op=upsert&key=go-short&url=https://golang.org", `"99"`, http.StatusPreconditionFailed},
+		{"POST", "op=upsert&key=missing&url=https://golang.org", `"1"`, http.StatusPreconditionFailed},
+		{"POST", "op=upsert&key=go-short&url=https://github.com", `"4"`, http.StatusOK},
+		{"DELETE", "key=go-short", `"4"`, http.StatusPreconditionFailed},
+		{"DELETE", "key=go-short", "5", http.StatusBadRequest},
+		{"DELETE", "key=go-short", `"5"`, http.StatusOK},
+	}
+	for _, test := range conditional {
+		r, _ := http.NewRequest(test.method, "http://go/_admin?"+test.params, nil)
+		r.Header.Set("If-Match", test.ifMatch)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s If-Match %s expected status %d gotten %d - %s", test.method, test.params,
+				test.ifMatch, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRedirectRecordsHits(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		path   string
+		status int
+		events int
+	}{
+		{"/gs", http.StatusTemporaryRedirect, 1},
+		{"/missing", http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		r.Header.Set("Referer", "http://example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("GET %s expected status %d gotten %d", test.path, test.status, w.Code)
+		}
+
+		key := storage.StorageKey(strings.TrimPrefix(test.path, "/"))
+		events, err := stateStore.LoadHitEvents(key, 10)
+		if err != nil || len(events) != test.events {
+			t.Fatalf("Expected %d hit events for %s gotten %v - %v", test.events, key, events, err)
+		}
+		if test.events == 0 {
+			continue
+		}
+		if events[0].Status != test.status || events[0].Referer != "http://example.com" {
+			t.Errorf("Recorded hit event %v does not match the request", events[0])
+		}
+	}
+
+	link, _ := stateStore.Load("gs")
+	if link.Hits != 1 {
+		t.Errorf("Expected gs to have 1 hit gotten %d", link.Hits)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	for _, key := range []string{"c", "a", "b"} {
+		stateStore.Save(storage.NewStorageItem(key, "https://example.com/"+key))
+	}
+	stateStore.RecordHit(&storage.HitEvent{Key: "c", Time: time.Now(), Status: 307})
+	handler := &AdminHandler{StateStore: stateStore}
+
+	list := func(params string) (int, string) {
+		r, _ := http.NewRequest("GET", "http://go/_admin?"+params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+	status, body := list("limit=2")
+	if status != http.StatusOK || !strings.Contains(body, "> Number of listed items: 2\n> Short: a\t") ||
+		!strings.Contains(body, "> More items with -cursor ") {
+		t.Fatalf("Expected first page with a and b gotten %d - %s", status, body)
+	}
+	cursor := strings.TrimSpace(body[strings.Index(body, "-cursor ")+len("-cursor "):])
+	status, body = list("limit=2&cursor=" + cursor)
+	if status != http.StatusOK || !strings.Contains(body, "> Number of listed items: 1\n> Short: c\t") ||
+		strings.Contains(body, "More items") {
+		t.Errorf("Expected last page with c gotten %d - %s", status, body)
+	}
+	if status, body = list("limit=1&sort=hits"); !strings.Contains(body, "> Short: c\t") {
+		t.Errorf("Expected c first by hits gotten %d - %s", status, body)
+	}
+	if status, body = list("cursor=invalid!"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid cursor gotten %d - %s", http.StatusBadRequest, status, body)
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect} {
+		stateStore.Save(&storage.StorageItem{Key: storage.StorageKey(strconv.Itoa(status)),
+			Value: &storage.Link{URL: "https://github.com/kouzant/go-short", RedirectStatus: status}})
+	}
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	// Dynamic links are never redirected permanently
+	expiresAt := time.Now().Add(time.Hour)
+	split := &storage.Link{RedirectStatus: http.StatusPermanentRedirect}
+	split.SetDestinations([]*storage.Destination{{URL: "https://github.com/kouzant/go-short", Weight: 1},
+		{URL: "https://github.com/kouzant/go-short/", Weight: 1}})
+	dynamic := map[storage.StorageKey]*storage.Link{
+		"expiring": {URL: "https://github.com/kouzant/go-short", ExpiresAt: &expiresAt,
+			RedirectStatus: http.StatusMovedPermanently},
+		"limited": {URL: "https://github.com/kouzant/go-short", MaxUses: 10},
+		"routed": {URL: "https://github.com/kouzant/go-short", Rules: []*storage.Rule{{URL: "https://example.com",
+			Conditions: []*storage.Condition{{Kind: storage.ConditionQuery, Value: "never"}}}}},
+	}
+	for key, link := range dynamic {
+		stateStore.Save(&storage.StorageItem{Key: key, Value: link})
+	}
+	stateStore.Save(&storage.StorageItem{Key: "split", Value: split})
+
+	var tests = []struct {
+		defaultStatus int
+		path          string
+		status        int
+	}{
+		{0, "/expiring", http.StatusFound},
+		{http.StatusPermanentRedirect, "/limited", http.StatusTemporaryRedirect},
+		{http.StatusMovedPermanently, "/routed", http.StatusFound},
+		{0, "/301", http.StatusMovedPermanently},
+		{0, "/302", http.StatusFound},
+		{0, "/307", http.StatusTemporaryRedirect},
+		{0, "/308", http.StatusPermanentRedirect},
+		{0, "/gs", http.StatusTemporaryRedirect},
+		{http.StatusMovedPermanently, "/gs", http.StatusMovedPermanently},
+		{http.StatusFound, "/gs", http.StatusFound},
+		{http.StatusPermanentRedirect, "/gs", http.StatusPermanentRedirect},
+		{http.StatusPermanentRedirect, "/302", http.StatusFound},
+	}
+	for _, test := range tests {
+		handler := &RedirectHandler{StateStore: stateStore, DefaultStatus: test.defaultStatus}
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != "https://github.com/kouzant/go-short" {
+			t.Errorf("GET %s with default %d expected status %d gotten %d - %s", test.path, test.defaultStatus,
+				test.status, w.Code, w.Header().Get("Location"))
+		}
+	}
+	r, _ := http.NewRequest("GET", "http://go/split", nil)
+	w := httptest.NewRecorder()
+	(&RedirectHandler{StateStore: stateStore}).ServeHTTP(w, r)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("GET /split with status 308 expected status 307 gotten %d", w.Code)
+	}
+
+	for value, want := range map[string]int{"": 0, "301": 301, "308": 308, "0": -1, "303": -1, "permanent": -1} {
+		status, err := ParseRedirectStatus(value)
+		if want < 0 && err == nil || want >= 0 && (err != nil || status != want) {
+			t.Errorf("ParseRedirectStatus(%s) expected %d gotten %d - %v", value, want, status, err)
+		}
+	}
+}
+
+func TestAddBatchKeepsLinks(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	item := storage.NewStorageItem("gs", "https://github.com")
+	item.Value.Creator = "antonis"
+	item.Value.Owner = "antonis"
+	item.Value.Description = "Shortener"
+	item.Value.Tags = []string{"go"}
+	item.Value.PasswordHash = "hash"
+	item.Value.ExpiresAt = &expiresAt
+	stateStore.Save(item)
+	stateStore.RecordHit(&storage.HitEvent{Key: "gs", Time: time.Now(), Status: http.StatusTemporaryRedirect})
+	handler := &AdminHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("PUT", "http://go/_admin", strings.NewReader("gs,https://github.com/kouzant/go-short"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	link, _ := stateStore.Load("gs")
+	if w.Code != http.StatusOK || link.URL != "https://github.com/kouzant/go-short" || link.Creator != "antonis" ||
+		link.Owner != "antonis" || link.Description != "Shortener" || len(link.Tags) != 1 ||
+		link.PasswordHash != "hash" || link.ExpiresAt == nil || !link.ExpiresAt.Equal(expiresAt) || link.Hits != 1 {
+		t.Errorf("Expected the batch to only replace the URL of gs gotten %d %v", w.Code, link)
+	}
+}
+
+func TestLinkInfo(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	item := storage.NewStorageItem("docs", "https://docs.example.com")
+	item.Value.Owner = "antonis"
+	item.Value.Description = "Team docs"
+	stateStore.Save(item)
+	stateStore.Save(storage.NewStorageItem("c++", "https://isocpp.org"))
+	stateStore.Save(storage.NewStorageItem("search", "https://search.example.com/?q={*}"))
+	stateStore.SaveAlias(&storage.Alias{Key: "wiki", Target: "docs", CreatedAt: time.Now()})
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		path     string
+		status   int
+		body     string
+		location string
+	}{
+		{"/docs+", http.StatusOK, "> Short: docs\n> URL: https://docs.example.com\n> Owner: antonis\n> Description: Team docs\n> Hits: 0\n", ""},
+		{"/wiki+", http.StatusOK, "> Aliases: wiki\n", ""},
+		{"/missing+", http.StatusNotFound, "> Key missing+ does not exist", ""},
+		{"/c++", http.StatusTemporaryRedirect, "", "https://isocpp.org"},
+		{"/c+++", http.StatusOK, "> URL: https://isocpp.org\n", ""},
+		{"/docs/setup+", http.StatusTemporaryRedirect, "", "https://docs.example.com/setup+"},
+		{"/docs/c++", http.StatusTemporaryRedirect, "", "https://docs.example.com/c++"},
+		{"/search/c++", http.StatusTemporaryRedirect, "", "https://search.example.com/?q=c++"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) ||
+			w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s expected status %d, %q and location %s gotten %d %s - %s", test.path, test.status,
+				test.body, test.location, w.Code, w.Header().Get("Location"), w.Body.String())
+		}
+	}
+	if link, _ := stateStore.Load("docs"); link.Hits != 2 {
+		t.Errorf("Expected only the redirects of docs to count as hits gotten %d", link.Hits)
+	}
+
+	r, _ := http.NewRequest("GET", "http://go/docs+", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	for _, want := range []string{"<h1>go/docs</h1>", `value="update"`, `value="delete"`, `name="cascade"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected the info page of docs to contain %s gotten %s", want, w.Body.String())
+		}
+	}
+
+	// Forms of the info page
+	admin := &AdminHandler{StateStore: stateStore}
+	form := url.Values{"op": {"update"}, "key": {"docs"}, "url": {"https://docs.example.org"},
+		"description": {""}, "tags": {""}}
+	r, _ = http.NewRequest("POST", "http://go/_admin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/docs+" {
+		t.Errorf("Editing docs expected a redirect to its info page gotten %d %s - %s", w.Code,
+			w.Header().Get("Location"), w.Body.String())
+	}
+	if link, _ := stateStore.Load("docs"); link.URL != "https://docs.example.org" || link.Description != "" {
+		t.Errorf("Expected the edit form to change the url and clear the description gotten %v", link)
+	}
+	form = url.Values{"op": {"delete"}, "key": {"docs"}, "cascade": {"true"}}
+	r, _ = http.NewRequest("POST", "http://go/_admin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/_admin" {
+		t.Errorf("Deleting docs expected a redirect to the list gotten %d %s - %s", w.Code,
+			w.Header().Get("Location"), w.Body.String())
+	}
+	if _, err := stateStore.Load("docs"); err == nil {
+		t.Errorf("Expected docs deleted")
+	}
+}
+
 func compareAddBatchCommand(command, want AddBatchCommand) bool {
 	for _, wantPair := range want.pairs {
 		pairFound := false
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Revision history of a link. Rolling back writes the URL, description
+ * and tags of an old revision as a new revision, so it is recorded as well
+ */
+
+const (
+	// Also the oldest revision that can be rolled back to
+	maxHistoryRevisions = 100
+)
+
+var history_template = template.Must(template.New("history").Parse(history_html))
+
+type LinkHistory struct {
+	Key string
+	// Nil when the link is deleted
+	Link         *storage.Link
+	Revisions    []*storage.LinkRevision
+	AuthRequired bool
+}
+
+type RevisionNotFound struct {
+	Key      string
+	Revision uint64
+}
+
+func (e RevisionNotFound) Error() string {
+	return fmt.Sprintf("Revision %d of key %s does not exist", e.Revision, e.Key)
+}
+
+func (h *AdminHandler) handleHistoryCommand(command HistoryCommand, principal *Principal, w http.ResponseWriter,
+	userAgent string) {
+	key := storage.StorageKey(command.key)
+	revisions, err := h.StateStore.LoadHistory(key, maxHistoryRevisions)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	link, err := h.StateStore.Load(key)
+	if _, ok := err.(storage.KeyNotFound); err != nil && !ok {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	// Old revisions of a protected link may still point where it does
+	hidden := hidesDestination(principal, key, link)
+	if hidden {
+		link = withoutDestination(link)
+	}
+	visible := make([]*storage.LinkRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		if hidden || hidesDestination(principal, key, revision.Old) || hidesDestination(principal, key, revision.New) {
+			revision = hideRevision(revision)
+		}
+		visible = append(visible, revision)
+	}
+	revisions = visible
+	history := &LinkHistory{Key: command.key, Link: link, Revisions: revisions, AuthRequired: h.Auth.IsEnabled()}
+
+	if userAgent == context.CLI_USER_AGENT {
+		var buffer strings.Builder
+		fmt.Fprintf(&buffer, "> Number of revisions of %s: %d\n", command.key, len(revisions))
+		for _, revision := range revisions {
+			fmt.Fprintf(&buffer, "> Revision: %d\t %s\t %s\t by %s\t %s -> %s\n", revision.Revision(),
+				revision.Time.Format(time.RFC3339), revision.Action, actorName(revision.Actor),
+				revisionURL(revision.Old), revisionURL(revision.New))
+		}
+		fmt.Fprint(w, buffer.String())
+	} else {
+		if err := history_template.Execute(w, history); err != nil {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+	}
+}
+
+func (h *AdminHandler) handleRollbackCommand(command RollbackCommand, principal *Principal,
+	w http.ResponseWriter, r *http.Request) {
+	key := storage.StorageKey(command.key)
+	revisions, err := h.StateStore.LoadHistory(key, maxHistoryRevisions)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	var target *storage.Link
+	for _, revision := range revisions {
+		if revision.New != nil && revision.Revision() == command.revision {
+			target = revision.New
+			break
+		}
+	}
+	if target == nil {
+		http.Error(w, RevisionNotFound{command.key, command.revision}.Error(), http.StatusNotFound)
+		return
+	}
+
+	current, err := h.StateStore.Load(key)
+	if err == nil {
+		if !principal.CanModify(key, current) {
+			writeAuthError(w, forbiddenToModify(principal, key))
+			return
+		}
+		// Ownership and hits are not part of the history of the content, the
+		// target is copied so the restored link shares nothing with the history
+		content := target.Copy()
+		restored := current.Copy()
+		restored.URL = content.URL
+		restored.Description = content.Description
+		restored.Tags = content.Tags
+		restored.Destinations = content.Destinations
+		restored.Sticky = content.Sticky
+		restored.Rules = content.Rules
+		restored.UpdatedBy = principal.Name
+		err = h.StateStore.CompareAndSwap(key, current.Revision, restored)
+		current = restored
+	} else if _, ok := err.(storage.KeyNotFound); ok {
+		current = target.Copy()
+		current.Hits = 0
+		current.UpdatedBy = principal.Name
+		err = h.StateStore.Save(&storage.StorageItem{Key: key, Value: current})
+	}
+	if err != nil {
+		writeAdminStorageError(w, err)
+		return
+	}
+
+	if isFormSubmission(r) {
+		http.Redirect(w, r, "/_admin?op=history&key="+url.QueryEscape(command.key), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("ETag", linkETag(current))
+	fmt.Fprintf(w, "Rolled back %s to revision %d, it is now at revision %d -> %s", command.key,
+		command.revision, current.Revision, current.URL)
+}
+
+func actorName(actor string) string {
+	if actor == "" {
+		return "anonymous"
+	}
+	return actor
+}
+
+func revisionURL(link *storage.Link) string {
+	if link == nil {
+		return "-"
+	}
+	return shownURL(link)
+}
+
+func hideRevision(revision *storage.LinkRevision) *storage.LinkRevision {
+	hidden := *revision
+	if revision.Old != nil {
+		hidden.Old = withoutDestination(revision.Old)
+	}
+	if revision.New != nil {
+		hidden.New = withoutDestination(revision.New)
+	}
+	return &hidden
+}
+
+const history_html = `
+<html>
+ <head>
+   <style>
+     table {
+     font-family: arial, sans-serif;
+     border-collapse: collapse;
+     width: 90%;
+     }
+
+     td, th {
+     border: 1px solid #dddddd;
+     text-align: left;
+     padding: 8px;
+     }
+
+     tr:nth-child(even) {
+     background-color: #dddddd;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+    <h1>History of {{.Key}}</h1>
+    {{if .Link}}<h3>{{if .Link.URL}}<a href="{{.Link.URL}}">{{.Link.URL}}</a>{{else}}Protected by a password{{end}} - revision {{.Link.Revision}}</h3>{{else}}<h3>{{.Key}} is not stored</h3>{{end}}
+    <table>
+      <tr>
+	<th>Revision</th>
+	<th>Time</th>
+	<th>Change</th>
+	<th>By</th>
+	<th>Old URL</th>
+	<th>New URL</th>
+	<th></th>
+      </tr>
+{{range .Revisions}}
+      <tr>
+	<td>{{.Revision}}</td>
+	<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+	<td>{{.Action}}{{if .From}} from {{.From}}{{end}}</td>
+	<td>{{if .Actor}}{{.Actor}}{{else}}anonymous{{end}}</td>
+	<td>{{if .Old}}{{if .Old.URL}}{{.Old.URL}}{{else}}protected by a password{{end}}{{end}}</td>
+	<td>{{if .New}}{{if .New.URL}}{{.New.URL}}{{else}}protected by a password{{end}}{{end}}</td>
+	<td>
+{{if .New}}
+	  <form method="POST" action="/_admin">
+	    <input type="hidden" name="op" value="rollback">
+	    <input type="hidden" name="key" value="{{$.Key}}">
+	    <input type="hidden" name="revision" value="{{.Revision}}">
+{{if $.AuthRequired}}
+	    <input type="password" name="token" placeholder="API token" required>
+{{end}}
+	    <input type="submit" value="Roll back">
+	  </form>
+{{end}}
+	</td>
+      </tr>
+{{end}}
+    </table>
+    <h3><a href="/_admin?op=stats&key={{.Key}}">Stats</a> - <a href="/_admin">Back to all links</a></h3>
+    </div>
+  </body>
+</html>
+`
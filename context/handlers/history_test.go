@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestHistoryAndRollback(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	editor, _ := IssueToken(stateStore, "editor", storage.RoleEditor)
+	other, _ := IssueToken(stateStore, "other", storage.RoleEditor)
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+
+	var tests = []struct {
+		method string
+		params string
+		token  string
+		status int
+	}{
+		{"POST", "key=gs&url=https://github.com", editor, http.StatusOK},
+		{"POST", "op=update&key=gs&url=https://example.com", editor, http.StatusOK},
+		{"POST", "op=rollback&key=gs&revision=1", "", http.StatusUnauthorized},
+		{"POST", "op=rollback&key=gs&revision=1", other, http.StatusForbidden},
+		{"POST", "op=rollback&key=gs&revision=42", editor, http.StatusNotFound},
+		{"POST", "op=rollback&key=gs&revision=1", editor, http.StatusOK},
+		{"DELETE", "key=gs", editor, http.StatusOK},
+		{"POST", "op=rollback&key=gs&revision=2", other, http.StatusOK},
+		{"GET", "op=history&key=gs", "", http.StatusOK},
+	}
+	var w *httptest.ResponseRecorder
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://go/_admin?"+test.params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s expected status %d gotten %d - %s", test.method, test.params, test.status,
+				w.Code, w.Body.String())
+		}
+	}
+
+	// The last request lists the history
+	for _, line := range []string{
+		"> Number of revisions of gs: 5",
+		"> Revision: 1\t", "create\t by editor\t - -> https://github.com",
+		"> Revision: 3\t", "update\t by editor\t https://example.com -> https://github.com",
+		"delete\t by editor\t https://github.com -> -",
+		"create\t by other\t - -> https://example.com",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Expected history to contain %q gotten %s", line, w.Body.String())
+		}
+	}
+	link, err := stateStore.Load("gs")
+	if err != nil || link.URL != "https://example.com" || link.UpdatedBy != "other" {
+		t.Errorf("Expected gs rolled back to https://example.com by other gotten %v - %v", link, err)
+	}
+}
+
+func TestRollbackFromHistoryPage(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com"))
+	stateStore.Update(storage.NewStorageItem("gs", "https://example.com"))
+	handler := &AdminHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("GET", "http://go/_admin?op=history&key=gs", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="Roll back"`) {
+		t.Errorf("Expected history page with rollback forms gotten %d - %s", w.Code, w.Body.String())
+	}
+
+	form := url.Values{"op": {"rollback"}, "key": {"gs"}, "revision": {"1"}}
+	r, _ = http.NewRequest("POST", "http://go/_admin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/_admin?op=history&key=gs" {
+		t.Errorf("Expected redirect back to the history gotten %d - %s", w.Code, w.Header().Get("Location"))
+	}
+	if link, _ := stateStore.Load("gs"); link.URL != "https://github.com" || link.Revision != 3 {
+		t.Errorf("Expected gs at revision 3 -> https://github.com gotten %v", link)
+	}
+}
+
+func TestRollbackSplitLink(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+
+	for _, params := range []string{
+		"key=ab&split=https://a.example.com=1,https://b.example.com=1&sticky=true",
+		"op=update&key=ab&url=https://a.example.com",
+		"op=rollback&key=ab&revision=1",
+	} {
+		r, _ := http.NewRequest("POST", "http://go/_admin?"+params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("POST %s expected status %d gotten %d - %s", params, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	link, err := stateStore.Load("ab")
+	if err != nil || len(link.Destinations) != 2 || !link.Sticky || link.Revision != 3 {
+		t.Errorf("Expected ab rolled back to its sticky split gotten %v - %v", link, err)
+	}
+
+	r, _ := http.NewRequest("POST", "http://go/_admin?op=rollback&key=ab&revision=2", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	link, err = stateStore.Load("ab")
+	if w.Code != http.StatusOK || err != nil || link.Destinations != nil || link.Sticky ||
+		link.URL != "https://a.example.com" {
+		t.Errorf("Expected ab rolled back to a plain link gotten %d %v - %v", w.Code, link, err)
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+/**
+ * Generation of short keys for links added without one. Keys are either
+ * base62 strings or dash separated words, which are easier to read out
+ */
+
+const (
+	AlphabetBase62 = "base62"
+	AlphabetWords  = "words"
+
+	base62Characters         = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	maxKeyGenerationAttempts = 10
+)
+
+var keyWords = strings.Fields(`
+	able acid aged also area army away baby back ball band bank base bath bear beat
+	bell best bird blue boat body bone book boss bowl busy cake calm camp card care
+	cash cell chat city clay club coal coat code cold cook cool copy corn cost crew
+	dark data date dawn deal deep desk dial diet disk dock door down draw drum duck
+	east easy edge epic even exit face fact fair farm fast fern file film fire fish
+	flag flat flow foam fold folk food foot fork form fort free frog fuel full game
+	gate gear gift glad glow goal gold golf good gray grid grow gulf hair half hall
+	hand harp hawk head heat herb hero high hill home hook horn host huge idea iron
+`)
+
+type KeyGenerator struct {
+	Length        int
+	Alphabet      string
+	ReuseExisting bool
+}
+
+func NewKeyGenerator(config *viper.Viper) (*KeyGenerator, error) {
+	generator := &KeyGenerator{
+		Length:        config.GetInt(context.KeyGenLengthKey),
+		Alphabet:      config.GetString(context.KeyGenAlphabetKey),
+		ReuseExisting: config.GetBool(context.KeyGenReuseExistingKey),
+	}
+	if generator.Length < 1 {
+		return nil, fmt.Errorf("Generated key length should be positive, it is %d", generator.Length)
+	}
+	if generator.Alphabet != AlphabetBase62 && generator.Alphabet != AlphabetWords {
+		return nil, fmt.Errorf("Unknown key alphabet %s, it should be %s or %s", generator.Alphabet,
+			AlphabetBase62, AlphabetWords)
+	}
+	return generator, nil
+}
+
+var defaultKeyGenerator = &KeyGenerator{Length: 6, Alphabet: AlphabetBase62}
+
+// Length is the number of characters for base62 keys and the number of words for word keys
+func (g *KeyGenerator) Generate() (string, error) {
+	if g.Alphabet == AlphabetWords {
+		words := make([]string, 0, g.Length)
+		for i := 0; i < g.Length; i++ {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(keyWords))))
+			if err != nil {
+				return "", err
+			}
+			words = append(words, keyWords[n.Int64()])
+		}
+		return strings.Join(words, "-"), nil
+	}
+
+	var key strings.Builder
+	for i := 0; i < g.Length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(base62Characters))))
+		if err != nil {
+			return "", err
+		}
+		key.WriteByte(base62Characters[n.Int64()])
+	}
+	return key.String(), nil
+}
+
+// Saves a link under a newly generated key of the namespace, or returns the key of a link of the
+// namespace with the same URL when reusing existing keys is enabled. The boolean is true when the
+// link was saved
+func (g *KeyGenerator) Save(stateStore storage.StateStore, namespaces *storage.NamespaceSet, namespace string,
+	link *storage.Link) (storage.StorageKey, bool, error) {
+	// Restricted links are never shared with other links of the same URL
+	if g.ReuseExisting && !isRestricted(link) {
+		storedItems, err := stateStore.LoadAll()
+		if err != nil {
+			return "", false, err
+		}
+		for _, item := range namespaces.Filter(storedItems, namespace) {
+			if item.Value.URL == link.URL && !isRestricted(item.Value) {
+				return item.Key, false, nil
+			}
+		}
+	}
+
+	for i := 0; i < maxKeyGenerationAttempts; i++ {
+		generated, err := g.Generate()
+		if err != nil {
+			return "", false, err
+		}
+		key := storage.NamespacedKey(namespace, storage.StorageKey(generated))
+		err = stateStore.Save(&storage.StorageItem{Key: key, Value: link})
+		if err == nil {
+			return key, true, nil
+		}
+		if _, ok := err.(storage.KeyAlreadyExists); !ok {
+			return "", false, err
+		}
+	}
+	return "", false, fmt.Errorf("Could not generate a unique key after %d attempts", maxKeyGenerationAttempts)
+}
+
+func keyGeneratorOrDefault(generator *KeyGenerator) *KeyGenerator {
+	if generator == nil {
+		return defaultKeyGenerator
+	}
+	return generator
+}
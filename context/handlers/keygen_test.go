@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+func TestGenerateKey(t *testing.T) {
+	var tests = []struct {
+		generator *KeyGenerator
+		pattern   string
+	}{
+		{&KeyGenerator{Length: 6, Alphabet: AlphabetBase62}, "^[0-9A-Za-z]{6}$"},
+		{&KeyGenerator{Length: 10, Alphabet: AlphabetBase62}, "^[0-9A-Za-z]{10}$"},
+		{&KeyGenerator{Length: 3, Alphabet: AlphabetWords}, "^[a-z]+-[a-z]+-[a-z]+$"},
+	}
+	for _, test := range tests {
+		key, err := test.generator.Generate()
+		if err != nil {
+			t.Fatalf("Generate() returned error %v", err)
+		}
+		if !regexp.MustCompile(test.pattern).MatchString(key) {
+			t.Errorf("Generated key %s does not match %s", key, test.pattern)
+		}
+	}
+}
+
+func TestNewKeyGenerator(t *testing.T) {
+	config := viper.New()
+	config.Set(context.KeyGenLengthKey, 0)
+	config.Set(context.KeyGenAlphabetKey, AlphabetBase62)
+	if _, err := NewKeyGenerator(config); err == nil {
+		t.Errorf("Expected error for zero key length")
+	}
+	config.Set(context.KeyGenLengthKey, 4)
+	config.Set(context.KeyGenAlphabetKey, "emoji")
+	if _, err := NewKeyGenerator(config); err == nil {
+		t.Errorf("Expected error for unknown alphabet")
+	}
+	config.Set(context.KeyGenAlphabetKey, AlphabetWords)
+	generator, err := NewKeyGenerator(config)
+	if err != nil || generator.Length != 4 || generator.Alphabet != AlphabetWords {
+		t.Errorf("Expected words generator of length 4 gotten %v - %v", generator, err)
+	}
+}
+
+func TestGeneratedKeyCollisions(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	// A single character key space fills up and must fail instead of overwriting
+	generator := &KeyGenerator{Length: 1, Alphabet: AlphabetBase62}
+	keys := make(map[storage.StorageKey]bool)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		var key storage.StorageKey
+		key, _, err = generator.Save(stateStore, nil, "", storage.NewLink("https://github.com"))
+		if err == nil && keys[key] {
+			t.Fatalf("Key %s was generated twice", key)
+		}
+		keys[key] = true
+	}
+	if err == nil {
+		t.Errorf("Expected key generation to give up when keys collide")
+	}
+}
+
+func TestReuseExistingKey(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	generator := &KeyGenerator{Length: 6, Alphabet: AlphabetBase62, ReuseExisting: true}
+
+	key, saved, err := generator.Save(stateStore, nil, "", storage.NewLink("https://github.com/kouzant/go-short"))
+	if err != nil || saved || key != "gs" {
+		t.Errorf("Expected existing key gs gotten %s saved %t - %v", key, saved, err)
+	}
+	key, saved, err = generator.Save(stateStore, nil, "", storage.NewLink("https://golang.org"))
+	if err != nil || !saved || key == "gs" {
+		t.Errorf("Expected a new key gotten %s saved %t - %v", key, saved, err)
+	}
+}
+
+func TestAddWithoutKey(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	generator := &KeyGenerator{Length: 8, Alphabet: AlphabetBase62, ReuseExisting: true}
+	admin := &AdminHandler{StateStore: stateStore, KeyGen: generator}
+	api := &LinksAPIHandler{StateStore: stateStore, KeyGen: generator}
+
+	r, _ := http.NewRequest("POST", "http://go/_admin?url=https://github.com/kouzant/go-short", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	matches := regexp.MustCompile(`^Added <([0-9A-Za-z]{8}), `).FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || matches == nil {
+		t.Fatalf("Expected generated key gotten %d - %s", w.Code, w.Body.String())
+	}
+
+	var tests = []struct {
+		body   string
+		status int
+		key    string
+	}{
+		{`{"url":"https://github.com/kouzant/go-short"}`, http.StatusOK, matches[1]},
+		{`{"url":"https://golang.org"}`, http.StatusCreated, ""},
+	}
+	for _, test := range tests {
+		r, _ = http.NewRequest("POST", APILinksPath, strings.NewReader(test.body))
+		w = httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		var link LinkResource
+		json.Unmarshal(w.Body.Bytes(), &link)
+		if w.Code != test.status || link.Key == "" || (test.key != "" && link.Key != test.key) {
+			t.Errorf("POST %s expected status %d and key %s gotten %d - %s", test.body, test.status,
+				test.key, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Location") != APILinksPath+"/"+link.Key {
+			t.Errorf("POST %s returned Location %s", test.body, w.Header().Get("Location"))
+		}
+	}
+}
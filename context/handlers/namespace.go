@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+/**
+ * Selection of the namespace of a request. A host of a namespace selects
+ * it for every request, otherwise redirects select it with the first
+ * path segment, like go/team/docs, and admin requests with the ns
+ * parameter. Redirects fall back to the global namespace for the keys a
+ * namespace does not have, unless their virtual host says otherwise
+ */
+
+type NamespaceConfig struct {
+	Name  string   `mapstructure:"name"`
+	Hosts []string `mapstructure:"hosts"`
+}
+
+type Namespaces struct {
+	names *storage.NamespaceSet
+	hosts map[string]*VirtualHost
+}
+
+func NewNamespaces(config *viper.Viper) (*Namespaces, error) {
+	var configs []NamespaceConfig
+	if err := config.UnmarshalKey(context.NamespacesKey, &configs); err != nil {
+		return nil, fmt.Errorf("Could not read namespaces %s", err)
+	}
+	var vhosts []*VirtualHost
+	if err := config.UnmarshalKey(context.VirtualHostsKey, &vhosts); err != nil {
+		return nil, fmt.Errorf("Could not read virtual hosts %s", err)
+	}
+	return newNamespaces(configs, vhosts)
+}
+
+func newNamespaces(configs []NamespaceConfig, vhosts []*VirtualHost) (*Namespaces, error) {
+	namespaces := &Namespaces{names: storage.NewNamespaceSet(), hosts: make(map[string]*VirtualHost)}
+	for _, config := range configs {
+		if err := storage.ValidateNamespace(config.Name); err != nil {
+			return nil, err
+		}
+		if namespaces.names.Has(config.Name) {
+			return nil, fmt.Errorf("Namespace %s is defined more than once", config.Name)
+		}
+		namespaces.names.Add(config.Name)
+		for _, host := range config.Hosts {
+			vhosts = append(vhosts, &VirtualHost{Host: host, Namespace: config.Name})
+		}
+	}
+	for _, vhost := range vhosts {
+		if err := vhost.validate(namespaces); err != nil {
+			return nil, err
+		}
+		host := strings.ToLower(vhost.Host)
+		if _, ok := namespaces.hosts[host]; ok {
+			return nil, fmt.Errorf("Host %s is defined more than once", host)
+		}
+		namespaces.hosts[host] = vhost
+	}
+	return namespaces, nil
+}
+
+func (n *Namespaces) Has(namespace string) bool {
+	return n.set().Has(namespace)
+}
+
+// Names of the namespaces, nil when there are none
+func (n *Namespaces) set() *storage.NamespaceSet {
+	if n == nil {
+		return nil
+	}
+	return n.names
+}
+
+// Empty for keys of the global namespace, which has the keys of every prefix that is not a namespace
+func (n *Namespaces) keyNamespace(key storage.StorageKey) string {
+	return n.set().KeyNamespace(key)
+}
+
+// Nil for hosts without a configuration
+func (n *Namespaces) fromHost(host string) *VirtualHost {
+	if n == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return n.hosts[strings.ToLower(host)]
+}
+
+// Virtual host of a redirect and the path of the key in its namespace. Hosts of the global
+// namespace select namespaces with the first path segment too
+func (n *Namespaces) selectPath(host, path string) (*VirtualHost, string) {
+	vhost := n.fromHost(host)
+	if vhost == nil {
+		vhost = defaultVirtualHost
+	}
+	if vhost.Namespace != "" {
+		return vhost, path
+	}
+	segments := strings.SplitN(path, "/", 2)
+	if len(segments) == 2 && segments[1] != "" && n.Has(segments[0]) {
+		selected := *vhost
+		selected.Namespace = segments[0]
+		return &selected, segments[1]
+	}
+	return vhost, path
+}
+
+func (n *Namespaces) selectAdmin(r *http.Request) (string, error) {
+	namespace := r.URL.Query().Get("ns")
+	if namespace == "" && isFormContent(r) {
+		namespace = r.PostFormValue("ns")
+	}
+	if namespace == "" {
+		if vhost := n.fromHost(r.Host); vhost != nil {
+			return vhost.Namespace, nil
+		}
+		return "", nil
+	}
+	if !n.Has(namespace) {
+		return "", fmt.Errorf("Unknown namespace %s", namespace)
+	}
+	return namespace, nil
+}
+
+func namespaceName(namespace string) string {
+	if namespace == "" {
+		return "global"
+	}
+	return namespace
+}
+
+// The key in the namespace first and then the global key, keys of other namespaces
+// are not found
+func (n *Namespaces) resolve(stateStore storage.StateStore, vhost *VirtualHost, path string) (*Resolution, error) {
+	if vhost.Namespace != "" && path != "" {
+		resolution, err := resolve(stateStore, string(vhost.key(path)))
+		if _, ok := err.(storage.KeyNotFound); !ok || !vhost.fallsBack() {
+			return resolution, err
+		}
+		if n.keyNamespace(storage.StorageKey(path)) != "" {
+			return nil, err
+		}
+	}
+	return resolve(stateStore, path)
+}
+
+// Links of the namespace and the global links that redirects fall back to
+func (n *Namespaces) chain(items []*storage.StorageItem, vhost *VirtualHost) []*storage.StorageItem {
+	chain := make([]*storage.StorageItem, 0, len(items))
+	for _, item := range items {
+		namespace := n.keyNamespace(item.Key)
+		if namespace == vhost.Namespace || (namespace == "" && vhost.fallsBack()) {
+			chain = append(chain, item)
+		}
+	}
+	return chain
+}
+
+// Keys of the command are taken to be in the namespace
+func inNamespace(command AdminCommand, namespace string) AdminCommand {
+	if namespace == "" {
+		return command
+	}
+	key := func(key string) string {
+		if key == "" {
+			return key
+		}
+		return string(storage.NamespacedKey(namespace, storage.StorageKey(key)))
+	}
+	switch c := command.(type) {
+	case AddCommand:
+		c.key = key(c.key)
+		c.namespace = namespace
+		return c
+	case AddBatchCommand:
+		pairs := make([]*storage.Pair, 0, len(c.pairs))
+		for _, p := range c.pairs {
+			pairs = append(pairs, &storage.Pair{Left: key(p.Left.(string)), Right: p.Right})
+		}
+		c.pairs = pairs
+		return c
+	case UpdateCommand:
+		c.key = key(c.key)
+		return c
+	case UpsertCommand:
+		c.key = key(c.key)
+		return c
+	case RenameCommand:
+		c.key = key(c.key)
+		c.to = key(c.to)
+		return c
+	case DeleteCommand:
+		c.key = key(c.key)
+		return c
+	case AliasCommand:
+		c.key = key(c.key)
+		c.to = key(c.to)
+		return c
+	case RestoreCommand:
+		c.key = key(c.key)
+		return c
+	case HistoryCommand:
+		c.key = key(c.key)
+		return c
+	case RollbackCommand:
+		c.key = key(c.key)
+		return c
+	case StatsCommand:
+		c.key = key(c.key)
+		return c
+	case ListCommand:
+		c.options.Namespace = namespace
+		return c
+	case SearchCommand:
+		c.namespace = namespace
+		return c
+	case TrashCommand:
+		c.namespace = namespace
+		return c
+	case IssueTokenCommand:
+		c.namespace = namespace
+		return c
+	case RevokeTokenCommand:
+		c.namespace = namespace
+		return c
+	case ListTokensCommand:
+		c.namespace = namespace
+		return c
+	default:
+		return command
+	}
+}
+
+// Keys of the links a command creates or changes
+func commandKeys(command AdminCommand) []storage.StorageKey {
+	switch c := command.(type) {
+	case AddCommand:
+		return []storage.StorageKey{storage.NamespacedKey(c.namespace, storage.StorageKey(c.key))}
+	case AddBatchCommand:
+		keys := make([]storage.StorageKey, 0, len(c.pairs))
+		for _, p := range c.pairs {
+			keys = append(keys, storage.StorageKey(p.Left.(string)))
+		}
+		return keys
+	case UpdateCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	case UpsertCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	case RenameCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key), storage.StorageKey(c.to)}
+	case DeleteCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	case AliasCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	case RestoreCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	case RollbackCommand:
+		return []storage.StorageKey{storage.StorageKey(c.key)}
+	default:
+		return nil
+	}
+}
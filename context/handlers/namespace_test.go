@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+func TestNewNamespaces(t *testing.T) {
+	config := viper.New()
+	config.Set(context.NamespacesKey, []map[string]interface{}{
+		{"name": "team", "hosts": []string{"team.go", "go.team.example.com"}},
+		{"name": "ops"},
+	})
+	namespaces, err := NewNamespaces(config)
+	if err != nil {
+		t.Fatalf("NewNamespaces returned error %v", err)
+	}
+	if !namespaces.Has("team") || !namespaces.Has("ops") || namespaces.Has("infra") {
+		t.Errorf("Expected namespaces team and ops gotten %v", namespaces.names)
+	}
+	if vhost := namespaces.fromHost("Team.go:8080"); vhost == nil || vhost.Namespace != "team" {
+		t.Errorf("Expected host team.go to select team gotten %v", vhost)
+	}
+
+	var invalid = [][]NamespaceConfig{
+		{{Name: "Team"}},
+		{{Name: "team"}, {Name: "team"}},
+		{{Name: "team", Hosts: []string{"go"}}, {Name: "ops", Hosts: []string{"go"}}},
+	}
+	for _, configs := range invalid {
+		if _, err := newNamespaces(configs, nil); err == nil {
+			t.Errorf("newNamespaces(%v) expected error", configs)
+		}
+	}
+}
+
+func TestNamespaceRedirects(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("docs", "https://docs.example.com"))
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	stateStore.Save(storage.NewStorageItem("team:docs", "https://team.example.com/docs"))
+	stateStore.Save(storage.NewStorageItem("infra:runbook", "https://infra.example.com/runbook"))
+	stateStore.Save(storage.NewStorageItem("jira:123", "https://jira.example.com/123"))
+	namespaces, _ := newNamespaces([]NamespaceConfig{{Name: "team", Hosts: []string{"team.go"}}, {Name: "infra"}}, nil)
+	handler := &RedirectHandler{StateStore: stateStore, Namespaces: namespaces}
+
+	var tests = []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{"http://go/docs", http.StatusTemporaryRedirect, "https://docs.example.com"},
+		{"http://go/team/docs", http.StatusTemporaryRedirect, "https://team.example.com/docs"},
+		{"http://go/team/docs/api", http.StatusTemporaryRedirect, "https://team.example.com/docs/api"},
+		{"http://go/team/gs", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short"},
+		{"http://go/team:docs", http.StatusTemporaryRedirect, "https://team.example.com/docs"},
+		{"http://team.go/docs", http.StatusTemporaryRedirect, "https://team.example.com/docs"},
+		{"http://team.go/gs", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short"},
+		{"http://go/ops/docs", http.StatusNotFound, ""},
+		{"http://team.go/wiki", http.StatusNotFound, ""},
+		// Keys of other namespaces are not reachable from a namespace, global keys with a colon are
+		{"http://team.go/infra:runbook", http.StatusNotFound, ""},
+		{"http://go/team/infra:runbook", http.StatusNotFound, ""},
+		{"http://go/infra:runbook", http.StatusTemporaryRedirect, "https://infra.example.com/runbook"},
+		{"http://team.go/jira:123", http.StatusTemporaryRedirect, "https://jira.example.com/123"},
+		{"http://go/jira:123", http.StatusTemporaryRedirect, "https://jira.example.com/123"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s expected %d %s gotten %d %s", test.url, test.status, test.location, w.Code,
+				w.Header().Get("Location"))
+		}
+	}
+
+	if link, _ := stateStore.Load("team:docs"); link.Hits != 4 {
+		t.Errorf("Expected 4 hits on team:docs gotten %v", link)
+	}
+	r, _ := http.NewRequest("GET", "http://team.go/dosc", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "> Key team:dosc does not exist") ||
+		!strings.Contains(w.Body.String(), "Short: team:docs") {
+		t.Errorf("Expected team:docs to be suggested for team:dosc gotten %s", w.Body.String())
+	}
+}
+
+func TestNamespaceAdmin(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	namespaces, _ := newNamespaces([]NamespaceConfig{{Name: "team", Hosts: []string{"team.go"}}, {Name: "ops"}}, nil)
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator, Namespaces: namespaces}
+	editor, _ := IssueNamespaceToken(stateStore, "editor", storage.RoleEditor, "team")
+	admin, _ := IssueNamespaceToken(stateStore, "admin", storage.RoleAdmin, "team")
+
+	var tests = []struct {
+		method string
+		url    string
+		token  string
+		status int
+	}{
+		{"POST", "http://go/_admin?key=docs&url=https://docs.example.com", testRootToken, http.StatusOK},
+		{"POST", "http://go/_admin?ns=team&key=docs&url=https://team.example.com/docs", editor, http.StatusOK},
+		{"POST", "http://team.go/_admin?key=wiki&url=https://team.example.com/wiki", editor, http.StatusOK},
+		{"POST", "http://go/_admin?key=team:faq&url=https://team.example.com/faq", editor, http.StatusOK},
+		{"POST", "http://go/_admin?ns=infra&key=docs&url=https://infra.example.com", editor, http.StatusBadRequest},
+		{"POST", "http://go/_admin?key=wiki&url=https://wiki.example.com", editor, http.StatusForbidden},
+		{"POST", "http://go/_admin?ns=ops&key=docs&url=https://ops.example.com", admin, http.StatusForbidden},
+		{"POST", "http://go/_admin?op=rename&key=team:wiki&to=ops:wiki", editor, http.StatusForbidden},
+		{"POST", "http://go/_admin?key=jira:123&url=https://jira.example.com/123", editor, http.StatusForbidden},
+		{"POST", "http://go/_admin?key=jira:123&url=https://jira.example.com/123", testRootToken, http.StatusOK},
+		{"DELETE", "http://go/_admin?key=docs", admin, http.StatusForbidden},
+		{"DELETE", "http://go/_admin?ns=team&key=faq", admin, http.StatusOK},
+		{"POST", "http://go/_admin?op=issue-token&ns=team&name=other", admin, http.StatusOK},
+		{"POST", "http://go/_admin?op=issue-token&ns=ops&name=ops", admin, http.StatusForbidden},
+		{"POST", "http://go/_admin?op=issue-token&name=global", admin, http.StatusForbidden},
+		{"POST", "http://go/_admin?op=issue-token&ns=ops&name=ops", testRootToken, http.StatusOK},
+		{"DELETE", "http://go/_admin?op=revoke-token&ns=team&name=ops", admin, http.StatusNotFound},
+		{"POST", "http://go/_admin?op=issue-token&ns=ops&name=other", testRootToken, http.StatusOK},
+		{"POST", "http://go/_admin?op=issue-token&ns=team&name=other", admin, http.StatusConflict},
+		{"DELETE", "http://go/_admin?op=revoke-token&ns=ops&name=other", testRootToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, test.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s expected status %d gotten %d - %s", test.method, test.url, test.status, w.Code,
+				w.Body.String())
+		}
+	}
+
+	var lists = []struct {
+		url   string
+		items []string
+	}{
+		{"http://go/_admin", []string{"Short: docs", "Short: jira:123"}},
+		{"http://go/_admin?q=jira", []string{"Short: jira:123"}},
+		{"http://go/_admin?ns=team", []string{"Short: team:docs", "Short: team:wiki"}},
+		{"http://team.go/_admin?op=search&q=wiki", []string{"Short: team:wiki"}},
+		{"http://go/_admin?op=tokens&ns=team", []string{"Name: admin", "Name: editor", "Name: other"}},
+	}
+	for _, list := range lists {
+		r, _ := http.NewRequest("GET", list.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		r.Header.Set("Authorization", "Bearer "+admin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if strings.Count(w.Body.String(), "Short: ")+strings.Count(w.Body.String(), "Name: ") != len(list.items) {
+			t.Errorf("GET %s expected %v gotten %s", list.url, list.items, w.Body.String())
+		}
+		for _, item := range list.items {
+			if !strings.Contains(w.Body.String(), item) {
+				t.Errorf("GET %s expected %s gotten %s", list.url, item, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/**
+ * Links protected by a password show an interstitial page that posts
+ * the password back to the link before redirecting. Where they point to
+ * is hidden from everybody but the principals that can modify them. Passwords are
+ * stored as bcrypt hashes
+ */
+
+// Shown instead of the URL of a protected link
+const protectedURL = "protected by a password"
+
+var password_template = template.Must(template.New("password").Parse(password_html))
+
+type PasswordRequired struct {
+	Key storage.StorageKey
+	// Requested path and query, the password is posted back to it
+	Path  string
+	Wrong bool
+}
+
+func hashLinkPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkLinkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Password protected links and links with limited uses
+func isRestricted(link *storage.Link) bool {
+	return link.PasswordHash != "" || link.MaxUses > 0
+}
+
+// Caller of a request that only reads links, nil when it is anonymous.
+// Callers cannot be told apart when authentication is disabled
+func (a *Authenticator) reader(r *http.Request) *Principal {
+	if !a.IsEnabled() {
+		return nil
+	}
+	principal, err := a.Authenticate(r)
+	if err != nil {
+		return nil
+	}
+	return principal
+}
+
+// Where a protected link points to is only shown to the principals that
+// can modify it, everybody else sees the link without its destinations
+func hidesDestination(principal *Principal, key storage.StorageKey, link *storage.Link) bool {
+	return link != nil && link.PasswordHash != "" && (principal == nil || !principal.CanModify(key, link))
+}
+
+func withoutDestination(link *storage.Link) *storage.Link {
+	hidden := link.Copy()
+	hidden.URL = ""
+	hidden.Destinations = nil
+	hidden.Sticky = false
+	hidden.Rules = nil
+	return hidden
+}
+
+// Link as the principal may see it
+func visibleLink(principal *Principal, key storage.StorageKey, link *storage.Link) *storage.Link {
+	if hidesDestination(principal, key, link) {
+		return withoutDestination(link)
+	}
+	return link
+}
+
+func visibleItems(principal *Principal, items []*storage.StorageItem) []*storage.StorageItem {
+	visible := make([]*storage.StorageItem, 0, len(items))
+	for _, item := range items {
+		visible = append(visible, &storage.StorageItem{Key: item.Key,
+			Value: visibleLink(principal, item.Key, item.Value)})
+	}
+	return visible
+}
+
+func visibleTrash(principal *Principal, trash []*storage.TrashItem) []*storage.TrashItem {
+	visible := make([]*storage.TrashItem, 0, len(trash))
+	for _, item := range trash {
+		if hidesDestination(principal, item.Key, item.Link) {
+			item = item.Copy()
+			item.Link = withoutDestination(item.Link)
+		}
+		visible = append(visible, item)
+	}
+	return visible
+}
+
+// URL of a link for the text output of the CLI, only hidden ones are empty
+func shownURL(link *storage.Link) string {
+	if link.URL == "" {
+		return protectedURL
+	}
+	return link.URL
+}
+
+func (h *RedirectHandler) handlePasswordRequired(w http.ResponseWriter, r *http.Request, key storage.StorageKey,
+	wrong bool) {
+	required := &PasswordRequired{Key: key, Path: r.URL.RequestURI(), Wrong: wrong}
+
+	if r.UserAgent() == context.CLI_USER_AGENT {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		if wrong {
+			fmt.Fprintf(w, "> Wrong password for key %s\n", key)
+		} else {
+			fmt.Fprintf(w, "> Key %s is protected by a password\n", key)
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		if err := password_template.Execute(w, required); err != nil {
+			log.Errorf("Could not render password page %s", err)
+		}
+	}
+}
+
+const password_html = `
+<html>
+ <head>
+   <style>
+     body {
+     font-family: arial, sans-serif;
+     }
+
+     input {
+     padding: 6px;
+     margin: 4px;
+     }
+   </style>
+ </head>
+ <body>
+    <div align="center">
+    <h1>go/{{.Key}} is protected by a password</h1>
+{{if .Wrong}}
+    <h3>Wrong password, try again</h3>
+{{end}}
+    <form method="POST" action="{{.Path}}">
+      <input type="password" name="password" placeholder="Password" required autofocus>
+      <input type="submit" value="Continue">
+    </form>
+    </div>
+  </body>
+</html>
+`
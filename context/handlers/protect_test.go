@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestLinkPassword(t *testing.T) {
+	hash, err := hashLinkPassword("secret")
+	if err != nil {
+		t.Fatalf("hashLinkPassword returned error %v", err)
+	}
+	if strings.Contains(hash, "secret") || !checkLinkPassword(hash, "secret") {
+		t.Errorf("Expected %s to be a hash of the password", hash)
+	}
+	if checkLinkPassword(hash, "wrong") || checkLinkPassword(hash, "") || checkLinkPassword("malformed", "secret") {
+		t.Errorf("Expected only the right password to match %s", hash)
+	}
+	if other, _ := hashLinkPassword("secret"); other == hash {
+		t.Errorf("Expected hashes of the same password to be salted differently")
+	}
+}
+
+func TestRestrictedLinks(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+	for _, params := range []string{"key=gs&password=secret&url=https://github.com/kouzant/go-short",
+		"key=once&max-uses=1&url=https://golang.org"} {
+		// Sent as a form like the client does, passwords stay out of the URL
+		r, _ := http.NewRequest("POST", "http://go/_admin", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s expected status %d gotten %d - %s", params, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	if link, _ := stateStore.Load("gs"); !strings.HasPrefix(link.PasswordHash, "$2") {
+		t.Errorf("Expected the password of gs stored as a bcrypt hash gotten %s", link.PasswordHash)
+	}
+	redirect := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		method   string
+		path     string
+		password string
+		status   int
+		body     string
+	}{
+		{"GET", "/gs", "", http.StatusUnauthorized, "> Key gs is protected by a password"},
+		{"POST", "/gs", "wrong", http.StatusUnauthorized, "> Wrong password for key gs"},
+		{"POST", "/gs/issues", "secret", http.StatusSeeOther, "https://github.com/kouzant/go-short/issues"},
+		{"GET", "/once", "", http.StatusTemporaryRedirect, "https://golang.org"},
+		{"GET", "/once", "", http.StatusGone, "> Key once has been used 1 times and is no longer available"},
+	}
+	for _, test := range tests {
+		var r *http.Request
+		if test.method == "POST" {
+			form := url.Values{"password": {test.password}}
+			r, _ = http.NewRequest("POST", "http://go"+test.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r, _ = http.NewRequest("GET", "http://go"+test.path, nil)
+		}
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		redirect.ServeHTTP(w, r)
+		body := w.Body.String() + w.Header().Get("Location")
+		if w.Code != test.status || !strings.Contains(body, test.body) {
+			t.Errorf("%s %s expected status %d and %q gotten %d - %s", test.method, test.path, test.status,
+				test.body, w.Code, body)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://go/gs?q=1", nil)
+	w := httptest.NewRecorder()
+	redirect.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `action="/gs?q=1"`) {
+		t.Errorf("Expected password page posting back to /gs?q=1 gotten %d - %s", w.Code, w.Body.String())
+	}
+
+	apiHandler := &LinksAPIHandler{StateStore: stateStore}
+	r, _ = http.NewRequest("GET", "http://go"+APILinksPath+"/gs", nil)
+	w = httptest.NewRecorder()
+	apiHandler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "password_hash") {
+		t.Errorf("Expected the API to hide the password hash gotten %d - %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProtectedLinksHideDestinations(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	editor, _ := IssueToken(stateStore, "editor", storage.RoleEditor)
+	other, _ := IssueToken(stateStore, "other", storage.RoleEditor)
+	admin := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+	redirect := &RedirectHandler{StateStore: stateStore, Auth: authenticator}
+	api := &LinksAPIHandler{StateStore: stateStore, Auth: authenticator}
+
+	for _, params := range []string{
+		"key=gs&password=secret&description=Shortener&url=https://secret.example.com/gs" +
+			"&rules=device:mobile+https://secret.example.com/mobile",
+		"key=old&password=secret&url=https://secret.example.com/old",
+		"op=delete&key=old",
+	} {
+		r, _ := http.NewRequest("POST", "http://go/_admin?"+params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		r.Header.Set("Authorization", "Bearer "+editor)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s expected status 200 gotten %d - %s", params, w.Code, w.Body.String())
+		}
+	}
+
+	// Only the owner sees where the links point to
+	var tests = []struct {
+		handler  http.Handler
+		url      string
+		token    string
+		cli      bool
+		body     string
+		revealed bool
+	}{
+		{redirect, "/gs+", "", true, "> URL: protected by a password\n", false},
+		{redirect, "/gs+", other, true, "> URL: protected by a password\n", false},
+		{redirect, "/gs+", editor, true, "> URL: https://secret.example.com/gs\n", true},
+		{redirect, "/gs+", "", false, "protected by a password", false},
+		{redirect, "/gss", "", true, "> Short: gs\t URL: protected by a password\n", false},
+		{redirect, "/gss", "", false, "protected by a password", false},
+		{admin, "/_admin", "", true, "> Short: gs\t URL: protected by a password\t", false},
+		{admin, "/_admin", editor, true, "> Short: gs\t URL: https://secret.example.com/gs\t", true},
+		{admin, "/_admin", "", false, "protected by a password", false},
+		{admin, "/_admin?q=secret", "", true, "> Number of matching items: 0\n", false},
+		{admin, "/_admin?q=secret", editor, true, "> Number of matching items: 1\n", true},
+		{admin, "/_admin?q=shortener", "", true, "> Short: gs\t URL: protected by a password\t", false},
+		{admin, "/_admin?op=trash", "", true, "> Short: old\t URL: protected by a password\t", false},
+		{admin, "/_admin?op=trash", editor, true, "> Short: old\t URL: https://secret.example.com/old\t", true},
+		{admin, "/_admin?op=history&key=gs", "", true, "- -> protected by a password\n", false},
+		{admin, "/_admin?op=history&key=gs", editor, true, "- -> https://secret.example.com/gs\n", true},
+		{admin, "/_admin?op=history&key=old", "", false, "protected by a password", false},
+		{admin, "/_admin?op=stats&key=gs", "", true, "> Hits of gs", false},
+		{admin, "/_admin?op=stats&key=gs", editor, true, "> Rules:\n", true},
+		{admin, "/_admin?op=stats&key=gs", "", false, "Protected by a password", false},
+		{api, APILinksPath + "/gs", "", false, `"protected":true`, false},
+		{api, APILinksPath + "/gs", editor, false, `"protected":true`, true},
+		{api, APILinksPath, other, false, `"key":"gs"`, false},
+		{api, APILinksPath, testRootToken, false, `"key":"gs"`, true},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.url, nil)
+		if test.cli {
+			r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		}
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, r)
+		body := w.Body.String()
+		if !strings.Contains(body, test.body) || strings.Contains(body, "secret.example.com") != test.revealed {
+			t.Errorf("GET %s with token %q expected %q and the URL revealed %t gotten %d - %s", test.url,
+				test.token, test.body, test.revealed, w.Code, body)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Resolution of request paths to stored links. The longest stored key or
+ * alias that is a prefix of the path wins and the rest of the path is either
+ * substituted in the placeholders of the target, {1}, {2}... for the
+ * path segments following the key and {*} for all of them, or appended
+ * to the target as is
+ */
+
+var placeholderRegexp = regexp.MustCompile(`\{(\d+|\*)\}`)
+
+type Resolution struct {
+	// Canonical key of the link, even when the path matched an alias
+	Key  storage.StorageKey
+	Link *storage.Link
+	// Path after the matched key, it starts with a slash
+	Rest string
+	// Picked for links split across destinations, the target is its URL instead of the URL of the link
+	Destination *storage.Destination
+	// Matched by the request, the target is its URL instead of the URL of the link
+	Rule *storage.Rule
+}
+
+func (r *Resolution) Args() []string {
+	return nonEmpty(strings.Split(r.Rest, "/"))
+}
+
+// Target URL of the link with the rest of the path and the query passed through
+func (r *Resolution) Target(rawQuery string) string {
+	base := r.Link.URL
+	if r.Rule != nil {
+		base = r.Rule.URL
+	} else if r.Destination != nil {
+		base = r.Destination.URL
+	}
+	var target string
+	if isTemplate(base) {
+		target = expandTemplate(base, r.Args())
+	} else {
+		target = appendPath(base, r.Rest)
+	}
+	return appendQuery(target, rawQuery)
+}
+
+func resolve(stateStore storage.StateStore, path string) (*Resolution, error) {
+	match, err := stateStore.LoadLongestPrefix(storage.StorageKey(path))
+	if err != nil {
+		return nil, err
+	}
+	return &Resolution{Key: match.Item.Key, Link: match.Item.Value, Rest: path[len(match.Prefix):]}, nil
+}
+
+func isTemplate(target string) bool {
+	return placeholderRegexp.MatchString(target)
+}
+
+func expandTemplate(target string, args []string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(target, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if name == "*" {
+			escaped := make([]string, 0, len(args))
+			for _, arg := range args {
+				escaped = append(escaped, url.PathEscape(arg))
+			}
+			return strings.Join(escaped, "/")
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 1 || i > len(args) {
+			return ""
+		}
+		return url.PathEscape(args[i-1])
+	})
+}
+
+func appendPath(target, rest string) string {
+	if rest == "" || rest == "/" {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return strings.TrimSuffix(target, "/") + rest
+	}
+	escapedRest := (&url.URL{Path: rest}).EscapedPath()
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + escapedRest
+	u.Path = strings.TrimSuffix(u.Path, "/") + rest
+	return u.String()
+}
+
+func appendQuery(target, rawQuery string) string {
+	if rawQuery == "" {
+		return target
+	}
+	fragment := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	separator := "?"
+	if strings.Contains(target, "?") {
+		separator = "&"
+	}
+	return target + separator + rawQuery + fragment
+}
+
+func nonEmpty(segments []string) []string {
+	filtered := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment != "" {
+			filtered = append(filtered, segment)
+		}
+	}
+	return filtered
+}
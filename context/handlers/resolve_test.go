@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	var tests = []struct {
+		target string
+		args   []string
+		want   string
+	}{
+		{"https://jira.example.com/browse/{1}", []string{"ABC-123"}, "https://jira.example.com/browse/ABC-123"},
+		{"https://github.com/{1}/{2}", []string{"kouzant", "go-short"}, "https://github.com/kouzant/go-short"},
+		{"https://github.com/{2}/{1}", []string{"go-short", "kouzant"}, "https://github.com/kouzant/go-short"},
+		{"https://github.com/{*}", []string{"kouzant", "go-short"}, "https://github.com/kouzant/go-short"},
+		{"https://google.com/search?q={1}", []string{"a b"}, "https://google.com/search?q=a%20b"},
+		{"https://github.com/{1}/{2}", []string{"kouzant"}, "https://github.com/kouzant/"},
+		{"https://github.com/{*}", []string{}, "https://github.com/"},
+		{"https://github.com/kouzant", []string{"ignored"}, "https://github.com/kouzant"},
+	}
+
+	for _, test := range tests {
+		if got := expandTemplate(test.target, test.args); got != test.want {
+			t.Errorf("expandTemplate(%s, %v) expected %s gotten %s", test.target, test.args, test.want, got)
+		}
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	var tests = []struct {
+		target   string
+		rest     string
+		rawQuery string
+		want     string
+	}{
+		{"https://wiki.example.com/docs", "/setup/linux", "x=1", "https://wiki.example.com/docs/setup/linux?x=1"},
+		{"https://wiki.example.com/docs/", "/setup/", "", "https://wiki.example.com/docs/setup/"},
+		{"https://wiki.example.com/docs?lang=en", "/setup", "x=1", "https://wiki.example.com/docs/setup?lang=en&x=1"},
+		{"https://wiki.example.com/docs#top", "", "x=1", "https://wiki.example.com/docs?x=1#top"},
+		{"https://wiki.example.com/a%2Fb", "/c d", "", "https://wiki.example.com/a%2Fb/c%20d"},
+		{"https://wiki.example.com", "/setup", "", "https://wiki.example.com/setup"},
+	}
+
+	for _, test := range tests {
+		resolution := &Resolution{Key: "docs", Link: storage.NewLink(test.target), Rest: test.rest}
+		if got := resolution.Target(test.rawQuery); got != test.want {
+			t.Errorf("Target of %s with rest %s and query %s expected %s gotten %s",
+				test.target, test.rest, test.rawQuery, test.want, got)
+		}
+	}
+}
+
+func TestTemplatedRedirect(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.SaveAll([]*storage.StorageItem{
+		storage.NewStorageItem("jira", "https://jira.example.com/browse/{1}"),
+		storage.NewStorageItem("gh", "https://github.com/{*}"),
+		storage.NewStorageItem("gh/go-short", "https://github.com/kouzant/go-short"),
+		storage.NewStorageItem("docs", "https://wiki.example.com/docs"),
+	})
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		path     string
+		status   int
+		location string
+		key      storage.StorageKey
+	}{
+		{"/jira/ABC-123", http.StatusTemporaryRedirect, "https://jira.example.com/browse/ABC-123", "jira"},
+		{"/jira", http.StatusTemporaryRedirect, "https://jira.example.com/browse/", "jira"},
+		{"/gh/kouzant/go-short/", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short", "gh"},
+		{"/gh/go-short", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short", "gh/go-short"},
+		{"/docs", http.StatusTemporaryRedirect, "https://wiki.example.com/docs", "docs"},
+		{"/docs/setup/linux?x=1", http.StatusTemporaryRedirect, "https://wiki.example.com/docs/setup/linux?x=1", "docs"},
+		{"/docs?x=1&y=2", http.StatusTemporaryRedirect, "https://wiki.example.com/docs?x=1&y=2", "docs"},
+		{"/jira/ABC-123?focus=1", http.StatusTemporaryRedirect, "https://jira.example.com/browse/ABC-123?focus=1", "jira"},
+		{"/wiki/setup", http.StatusNotFound, "", "wiki/setup"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("GET %s expected status %d gotten %d", test.path, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("GET %s expected location %s gotten %s", test.path, test.location, location)
+		}
+		// Unknown keys are not recorded
+		if events, _ := stateStore.LoadHitEvents(test.key, 10); (len(events) > 0) != (test.status != http.StatusNotFound) {
+			t.Errorf("GET %s expected a hit recorded for %s only if it is stored gotten %v", test.path, test.key, events)
+		}
+	}
+}
+
+func TestNormalizedRedirect(t *testing.T) {
+	config := viper.New()
+	config.Set(context.StateStoreNormalizeFoldCaseKey, true)
+	config.Set(context.StateStoreNormalizeSeparatorsKey, true)
+	stateStore := &storage.MemoryStateStore{Config: config}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("my_docs", "https://wiki.example.com/docs"))
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		path     string
+		location string
+	}{
+		{"/my-docs", "https://wiki.example.com/docs"},
+		{"/My_Docs/", "https://wiki.example.com/docs"},
+		{"/MY-DOCS/Setup", "https://wiki.example.com/docs/Setup"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s expected %s gotten %d %s", test.path, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if link, _ := stateStore.Load("my-docs"); link.Hits != uint64(len(tests)) {
+		t.Errorf("Expected %d hits on my-docs gotten %v", len(tests), link)
+	}
+}
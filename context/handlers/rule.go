@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Routing of links by the rules stored with them. The attributes of the
+ * request the rules look at are collected once per redirect, times are
+ * those of the server
+ */
+
+// Value of the update command that removes every rule of a link
+const noRules = "none"
+
+// Headers that change where a link with rules redirects to
+const ruleVaryHeaders = "User-Agent, Accept-Language"
+
+func newRuleRequest(r *http.Request, now time.Time) *storage.RuleRequest {
+	return &storage.RuleRequest{
+		UserAgent: r.UserAgent(),
+		Languages: acceptedLanguages(r.Header.Get("Accept-Language")),
+		Query:     r.URL.Query(),
+		Time:      now,
+	}
+}
+
+// Languages of an Accept-Language header, most preferred first
+func acceptedLanguages(header string) []string {
+	type accepted struct {
+		language string
+		quality  float64
+	}
+	languages := make([]accepted, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := strings.TrimSpace(fields[0])
+		if language == "" || language == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if q, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, accepted{language, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	preferred := make([]string, 0, len(languages))
+	for _, l := range languages {
+		preferred = append(preferred, l.language)
+	}
+	return preferred
+}
+
+// Rules of the add and update commands, nil when they are not given
+func parseRules(value string) ([]*storage.Rule, error) {
+	if value == "" || value == noRules {
+		return nil, nil
+	}
+	return storage.ParseRules(value)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	var tests = []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de-CH", []string{"de-CH"}},
+		{"fr;q=0.5, de-CH, en;q=0.8", []string{"de-CH", "en", "fr"}},
+		{"en;q=0.8, de;q=0.8, *;q=0.1", []string{"en", "de"}},
+		{"sv;q=0, en", []string{"en"}},
+	}
+	for _, test := range tests {
+		if languages := acceptedLanguages(test.header); !reflect.DeepEqual(languages, test.want) {
+			t.Errorf("acceptedLanguages(%s) expected %v gotten %v", test.header, test.want, languages)
+		}
+	}
+}
+
+func TestRuleRedirects(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	admin := &AdminHandler{StateStore: stateStore}
+	redirect := &RedirectHandler{StateStore: stateStore}
+
+	params := url.Values{"key": {"app"}, "url": {"https://app.example.com"},
+		"rules": {"device:mobile https://m.example.com/{*}, lang:de https://app.example.de"}}
+	r, _ := http.NewRequest("POST", "http://go/_admin?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Adding app with rules expected status 200 gotten %d - %s", w.Code, w.Body.String())
+	}
+	r, _ = http.NewRequest("POST", "http://go/_admin?op=update&key=app&rules=device:tablet+https://t.example.com", nil)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Updating app with an invalid rule expected status 400 gotten %d - %s", w.Code, w.Body.String())
+	}
+
+	var tests = []struct {
+		path      string
+		userAgent string
+		language  string
+		location  string
+	}{
+		{"/app/settings", "Mozilla/5.0 (Linux; Android 10) Mobile Safari", "de-DE", "https://m.example.com/settings"},
+		{"/app/settings", "Mozilla/5.0 (X11; Linux x86_64) Firefox/70.0", "de-DE,en;q=0.5", "https://app.example.de/settings"},
+		{"/app/settings", "Mozilla/5.0 (X11; Linux x86_64) Firefox/70.0", "en-US,de;q=0.5", "https://app.example.com/settings"},
+		{"/app", context.CLI_USER_AGENT, "", "https://app.example.com"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://go"+test.path, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		r.Header.Set("Accept-Language", test.language)
+		w := httptest.NewRecorder()
+		redirect.ServeHTTP(w, r)
+		if w.Header().Get("Location") != test.location || w.Header().Get("Vary") != ruleVaryHeaders {
+			t.Errorf("GET %s as %s in %s expected %s gotten %d %s", test.path, test.userAgent, test.language,
+				test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	r, _ = http.NewRequest("POST", "http://go/_admin?op=update&key=app&rules=none", nil)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if link, _ := stateStore.Load("app"); w.Code != http.StatusOK || link.Rules != nil {
+		t.Errorf("Expected the rules of app removed gotten %d %v", w.Code, link)
+	}
+}
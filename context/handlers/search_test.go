@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestSearch(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		method string
+		params string
+		status int
+		body   string
+	}{
+		{"POST", "key=gs&url=https://github.com/kouzant/go-short&description=URL+shortener&tags=go,+code", http.StatusOK, ""},
+		{"POST", "key=wiki&url=https://wiki.example.com&tags=docs", http.StatusOK, ""},
+		{"GET", "q=shortener", http.StatusOK, "> Number of matching items: 1\n> Short: gs\t"},
+		{"GET", "op=search&tag=docs", http.StatusOK, "> Number of matching items: 1\n> Short: wiki\t"},
+		{"GET", "q=example&tag=code", http.StatusOK, "> Number of matching items: 0\n"},
+		{"POST", "op=update&key=wiki&description=Team+handbook", http.StatusOK, "Updated <wiki, https://wiki.example.com>"},
+		{"GET", "q=handbook", http.StatusOK, "> Short: wiki\t URL: https://wiki.example.com\t Revision: 2"},
+		{"GET", "", http.StatusOK, "> Number of listed items: 2\n"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://go/_admin?"+test.params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s %s expected status %d and %q gotten %d - %s", test.method, test.params, test.status,
+				test.body, w.Code, w.Body.String())
+		}
+	}
+
+	link, _ := stateStore.Load("gs")
+	if len(link.Tags) != 2 || link.Tags[0] != "go" || link.Tags[1] != "code" || link.Description != "URL shortener" {
+		t.Errorf("Expected gs with description and tags go, code gotten %v", link)
+	}
+
+	r, _ := http.NewRequest("GET", "http://go/_admin?tag=code", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Matching go-shortened URLs: 1") ||
+		!strings.Contains(body, `href="/_admin?tag=code"`) || strings.Contains(body, "wiki.example.com") {
+		t.Errorf("Expected search results page with gs only gotten %d - %s", w.Code, body)
+	}
+}
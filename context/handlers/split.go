@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/url"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Redirects of links split across weighted destinations. Every redirect
+ * picks a destination at random by weight, unless the link is sticky and
+ * the browser kept the destination it got before in a cookie of the link
+ */
+
+const (
+	splitCookiePrefix = "go-short-split-"
+	splitCookieMaxAge = 30 * 24 * 60 * 60
+)
+
+func selectDestination(w http.ResponseWriter, r *http.Request, key storage.StorageKey,
+	link *storage.Link) (*storage.Destination, error) {
+	name := splitCookieName(key)
+	if link.Sticky {
+		if cookie, err := r.Cookie(name); err == nil {
+			if previous, err := url.QueryUnescape(cookie.Value); err == nil {
+				if destination := link.Destination(previous); destination != nil {
+					return destination, nil
+				}
+			}
+		}
+	}
+	roll, err := rand.Int(rand.Reader, big.NewInt(int64(link.TotalWeight())))
+	if err != nil {
+		return nil, err
+	}
+	destination := link.PickDestination(uint(roll.Int64()))
+	if link.Sticky {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: url.QueryEscape(destination.URL), Path: "/",
+			MaxAge: splitCookieMaxAge, HttpOnly: true})
+	}
+	return destination, nil
+}
+
+// Keys are not valid cookie names, their hash is
+func splitCookieName(key storage.StorageKey) string {
+	sum := sha1.Sum([]byte(key))
+	return splitCookiePrefix + hex.EncodeToString(sum[:8])
+}
+
+// Destinations of the add and update commands, nil when they are not given
+func parseDestinations(value string) ([]*storage.Destination, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return storage.ParseDestinations(value)
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestSplitLinks(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	admin := &AdminHandler{StateStore: stateStore}
+	redirect := &RedirectHandler{StateStore: stateStore}
+
+	var tests = []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"POST", "http://go/_admin?key=wiki&split=https://old.example.com=1,https://new.example.com=1&sticky=true", http.StatusOK},
+		{"POST", "http://go/_admin?key=docs&split=https://docs.example.com=1", http.StatusBadRequest},
+		{"POST", "http://go/_admin?key=docs&split=https://docs.example.com", http.StatusBadRequest},
+		{"POST", "http://go/_admin?op=update&key=docs&split=https://a.example.com=1,https://a.example.com=2", http.StatusBadRequest},
+		{"POST", "http://go/_admin?key=docs&split=,", http.StatusBadRequest},
+		{"POST", "http://go/_admin?key=docs&split=,&url=https://docs.example.com", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, test.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s expected status %d gotten %d - %s", test.method, test.url, test.status, w.Code,
+				w.Body.String())
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://go/wiki/setup", nil)
+	w := httptest.NewRecorder()
+	redirect.ServeHTTP(w, r)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Name, splitCookiePrefix) {
+		t.Fatalf("Expected the destination of sticky wiki kept in a cookie gotten %v", cookies)
+	}
+	first := w.Header().Get("Location")
+	if first != "https://old.example.com/setup" && first != "https://new.example.com/setup" {
+		t.Fatalf("GET go/wiki/setup expected one of the destinations gotten %s", first)
+	}
+	for i := 0; i < 10; i++ {
+		r, _ = http.NewRequest("GET", "http://go/wiki/setup", nil)
+		r.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		redirect.ServeHTTP(w, r)
+		if w.Header().Get("Location") != first {
+			t.Fatalf("Expected the sticky destination %s gotten %s", first, w.Header().Get("Location"))
+		}
+	}
+
+	link, _ := stateStore.Load("wiki")
+	destination := link.Destination(strings.TrimSuffix(first, "/setup"))
+	if link.Hits != 11 || destination.Hits != 11 {
+		t.Errorf("Expected 11 hits of %s gotten %v", first, link.Destinations)
+	}
+
+	r, _ = http.NewRequest("GET", "http://go/_admin?op=stats&key=wiki", nil)
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "> "+destination.URL+"\t50%\t11 hits") {
+		t.Errorf("Expected the hits of %s in the stats gotten %s", destination.URL, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("POST", "http://go/_admin?op=update&key=wiki&url=https://wiki.example.com", nil)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if link, _ = stateStore.Load("wiki"); link.IsSplit() || link.Sticky || link.URL != "https://wiki.example.com" {
+		t.Errorf("Expected a new url to make wiki a plain link gotten %v", link)
+	}
+}
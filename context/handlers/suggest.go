@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Suggestions of stored keys that are close to a missing one. Keys are
+ * ranked by their edit distance to the missing key and ties are broken
+ * by trigram similarity, so that both typos and reordered words are found
+ */
+
+const (
+	maxSuggestions       = 5
+	minTrigramSimilarity = 0.3
+)
+
+type suggestion struct {
+	item       *storage.StorageItem
+	distance   int
+	similarity float64
+}
+
+func suggestKeys(items []*storage.StorageItem, missing storage.StorageKey, limit int) []*storage.StorageItem {
+	target := strings.ToLower(string(missing))
+	maxDistance := len(target)/3 + 1
+	targetTrigrams := trigrams(target)
+
+	candidates := make([]*suggestion, 0)
+	for _, item := range items {
+		key := strings.ToLower(string(item.Key))
+		distance := levenshtein(target, key)
+		similarity := trigramSimilarity(targetTrigrams, trigrams(key))
+		if distance <= maxDistance || similarity >= minTrigramSimilarity {
+			candidates = append(candidates, &suggestion{item, distance, similarity})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		if candidates[i].similarity != candidates[j].similarity {
+			return candidates[i].similarity > candidates[j].similarity
+		}
+		return candidates[i].item.Key < candidates[j].item.Key
+	})
+
+	suggestions := make([]*storage.StorageItem, 0, limit)
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		suggestions = append(suggestions, candidates[i].item)
+	}
+	return suggestions
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// Trigrams of a string padded with spaces so that short strings have some
+func trigrams(s string) map[string]bool {
+	runes := []rune("  " + s + " ")
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
+
+func trigramSimilarity(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for gram := range a {
+		if b[gram] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+func minInt(first int, rest ...int) int {
+	min := first
+	for _, i := range rest {
+		if i < min {
+			min = i
+		}
+	}
+	return min
+}
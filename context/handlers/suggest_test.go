@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestLevenshtein(t *testing.T) {
+	var tests = []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"", "", 0},
+		{"docs", "docs", 0},
+		{"docs", "doc", 1},
+		{"docs", "dcos", 2},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	}
+	for _, test := range tests {
+		if got := levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("levenshtein(%s, %s) expected %d gotten %d", test.a, test.b, test.want, got)
+		}
+	}
+}
+
+func TestSuggestKeys(t *testing.T) {
+	items := []*storage.StorageItem{
+		storage.NewStorageItem("docs", "https://wiki.example.com/docs"),
+		storage.NewStorageItem("doc", "https://wiki.example.com/doc"),
+		storage.NewStorageItem("team-calendar", "https://calendar.example.com/team"),
+		storage.NewStorageItem("jira", "https://jira.example.com"),
+	}
+	var tests = []struct {
+		missing storage.StorageKey
+		want    []storage.StorageKey
+	}{
+		{"dosc", []storage.StorageKey{"doc", "docs"}},
+		{"Docs", []storage.StorageKey{"docs", "doc"}},
+		{"calendar-team", []storage.StorageKey{"team-calendar"}},
+		{"unrelated", []storage.StorageKey{}},
+	}
+	for _, test := range tests {
+		suggestions := suggestKeys(items, test.missing, maxSuggestions)
+		keys := make([]storage.StorageKey, 0, len(suggestions))
+		for _, item := range suggestions {
+			keys = append(keys, item.Key)
+		}
+		if !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("suggestKeys(%s) expected %v gotten %v", test.missing, test.want, keys)
+		}
+	}
+}
+
+func TestNotFoundPage(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("docs", "https://wiki.example.com/docs"))
+	handler := &RedirectHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("GET", "http://go/dcos", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Missing key expected status %d gotten %d", http.StatusNotFound, w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `href="/docs"`) || !strings.Contains(body, `name="key" value="dcos"`) {
+		t.Errorf("Not found page should suggest docs and prefill the form with dcos, gotten %s", body)
+	}
+
+	r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "> Short: docs") {
+		t.Errorf("CLI expected plain text suggestions gotten %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCreateFromForm(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	handler := &AdminHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("POST", "http://go/_admin",
+		strings.NewReader("key=docs&url=https%3A%2F%2Fwiki.example.com%2Fdocs"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Form submission expected status %d gotten %d", http.StatusSeeOther, w.Code)
+	}
+	link, err := stateStore.Load("docs")
+	if err != nil || link.URL != "https://wiki.example.com/docs" {
+		t.Errorf("Form submission expected to store docs gotten %v - %v", link, err)
+	}
+}
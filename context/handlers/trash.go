@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Deleted links stay in the trash of the state store until the trash
+ * retention period is over and they can be restored until then
+ */
+
+const (
+	maxRecentlyDeleted = 10
+)
+
+func (h *AdminHandler) handleTrashCommand(command TrashCommand, principal *Principal, w http.ResponseWriter) {
+	trash, err := h.loadTrash(command.namespace)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	trash = visibleTrash(principal, trash)
+	var buffer strings.Builder
+	fmt.Fprintf(&buffer, "> Number of deleted items: %d\n", len(trash))
+	for _, item := range trash {
+		fmt.Fprintf(&buffer, "> Short: %s\t URL: %s\t Deleted: %s by %s\n", item.Key, shownURL(item.Link),
+			item.DeletedAt.Format(time.RFC3339), actorName(item.DeletedBy))
+	}
+	fmt.Fprint(w, buffer.String())
+}
+
+func (h *AdminHandler) handleRestoreCommand(command RestoreCommand, principal *Principal,
+	w http.ResponseWriter, r *http.Request) {
+	key := storage.StorageKey(command.key)
+	trash, err := h.StateStore.LoadTrash()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, item := range trash {
+		if item.Key == key && !principal.CanModify(key, item.Link) {
+			writeAuthError(w, forbiddenToModify(principal, key))
+			return
+		}
+	}
+	link, err := h.StateStore.Restore(key, principal.Name)
+	if err != nil {
+		if _, ok := err.(storage.KeyNotFound); ok {
+			http.Error(w, fmt.Sprintf("Key %s is not in the trash", command.key), http.StatusNotFound)
+			return
+		}
+		writeAdminStorageError(w, err)
+		return
+	}
+	if isFormSubmission(r) {
+		http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintf(w, "Restored key %s -> %s", command.key, link.URL)
+}
+
+// Trash of the namespace with the most recently deleted links first
+func (h *AdminHandler) loadTrash(namespace string) ([]*storage.TrashItem, error) {
+	stored, err := h.StateStore.LoadTrash()
+	if err != nil {
+		return nil, err
+	}
+	trash := make([]*storage.TrashItem, 0, len(stored))
+	for _, item := range stored {
+		if h.Namespaces.keyNamespace(item.Key) == namespace {
+			trash = append(trash, item)
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.After(trash[j].DeletedAt)
+	})
+	return trash, nil
+}
+
+func (h *AdminHandler) loadRecentlyDeleted(namespace string) ([]*storage.TrashItem, error) {
+	trash, err := h.loadTrash(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(trash) > maxRecentlyDeleted {
+		trash = trash[:maxRecentlyDeleted]
+	}
+	return trash, nil
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	stateStore, authenticator := createAuthenticator(t)
+	editor, _ := IssueToken(stateStore, "editor", storage.RoleEditor)
+	other, _ := IssueToken(stateStore, "other", storage.RoleEditor)
+	handler := &AdminHandler{StateStore: stateStore, Auth: authenticator}
+
+	var tests = []struct {
+		method string
+		params string
+		token  string
+		status int
+		body   string
+	}{
+		{"POST", "key=gs&url=https://github.com/kouzant/go-short", editor, http.StatusOK, ""},
+		{"DELETE", "key=gs", editor, http.StatusOK, "Deleted key gs"},
+		{"GET", "op=trash", "", http.StatusOK, "> Short: gs\t URL: https://github.com/kouzant/go-short\t Deleted: "},
+		{"POST", "op=restore&key=gs", "", http.StatusUnauthorized, ""},
+		{"POST", "op=restore&key=gs", other, http.StatusForbidden, ""},
+		{"POST", "op=restore&key=missing", editor, http.StatusNotFound, ""},
+		{"POST", "op=restore&key=gs", editor, http.StatusOK, "Restored key gs -> https://github.com/kouzant/go-short"},
+		{"POST", "op=restore&key=gs", editor, http.StatusNotFound, ""},
+		{"GET", "op=trash", "", http.StatusOK, "> Number of deleted items: 0"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://go/_admin?"+test.params, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s %s expected status %d and %q gotten %d - %s", test.method, test.params, test.status,
+				test.body, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := stateStore.Load("gs"); err != nil {
+		t.Errorf("Expected gs to be restored gotten %v", err)
+	}
+}
+
+func TestRecentlyDeletedSection(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	stateStore.Save(storage.NewStorageItem("go", "https://golang.org"))
+	handler := &AdminHandler{StateStore: stateStore}
+
+	r, _ := http.NewRequest("GET", "http://go/_admin", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), "Recently deleted") {
+		t.Errorf("Expected no recently deleted section with an empty trash")
+	}
+
+	stateStore.Delete("gs", "antonis")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "go-shortened URLs: 1") ||
+		!strings.Contains(body, "Recently deleted") || !strings.Contains(body, `value="Restore"`) {
+		t.Errorf("Expected one link and gs recently deleted gotten %d - %s", w.Code, body)
+	}
+}
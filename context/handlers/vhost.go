@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kouzant/go-short/storage"
+)
+
+/**
+ * Virtual hosts served by the same process. Every host has the links of
+ * a namespace, its own landing URL for / and its own handling of the keys
+ * it does not have. Requests for hosts without a configuration behave
+ * like the global namespace always did
+ */
+
+const (
+	// Keys missing from the namespace are looked up in the global namespace
+	FallbackGlobal = "global"
+	// Only the links of the namespace are used
+	FallbackNone = "none"
+)
+
+type VirtualHost struct {
+	Host string `mapstructure:"host"`
+	// Empty for the global namespace
+	Namespace string `mapstructure:"namespace"`
+	// Target of /, empty for the not found page
+	Landing string `mapstructure:"landing"`
+	// Either global or none, global when empty
+	Fallback string `mapstructure:"fallback"`
+	// Target of unknown keys instead of the not found page, it takes the placeholders of
+	// templated links for the path of the key
+	NotFoundURL string `mapstructure:"not-found-url"`
+}
+
+var defaultVirtualHost = &VirtualHost{}
+
+func (v *VirtualHost) validate(namespaces *Namespaces) error {
+	if v.Host == "" {
+		return fmt.Errorf("Virtual host is missing host")
+	}
+	if v.Namespace != "" && !namespaces.Has(v.Namespace) {
+		return fmt.Errorf("Virtual host %s has unknown namespace %s", v.Host, v.Namespace)
+	}
+	switch v.Fallback {
+	case "", FallbackGlobal, FallbackNone:
+	default:
+		return fmt.Errorf("Virtual host %s has unknown fallback %s, it should be %s or %s", v.Host, v.Fallback,
+			FallbackGlobal, FallbackNone)
+	}
+	for _, target := range []string{v.Landing, v.NotFoundURL} {
+		if target == "" {
+			continue
+		}
+		if u, err := url.Parse(target); err != nil || !u.IsAbs() {
+			return fmt.Errorf("Virtual host %s target %s should be an absolute URL", v.Host, target)
+		}
+	}
+	return nil
+}
+
+func (v *VirtualHost) fallsBack() bool {
+	return v.Fallback != FallbackNone
+}
+
+// Redirects / to the landing URL, true when the request is handled
+func (v *VirtualHost) handleLanding(w http.ResponseWriter, r *http.Request, path string) bool {
+	if path != "" || v.Landing == "" {
+		return false
+	}
+	http.Redirect(w, r, v.Landing, http.StatusTemporaryRedirect)
+	return true
+}
+
+// Redirects unknown keys to the not found URL, true when the request is handled
+func (v *VirtualHost) handleNotFound(w http.ResponseWriter, r *http.Request, path string) bool {
+	if v.NotFoundURL == "" {
+		return false
+	}
+	args := nonEmpty(strings.Split(path, "/"))
+	target := v.NotFoundURL
+	if isTemplate(target) {
+		target = expandTemplate(target, args)
+	}
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	return true
+}
+
+func (v *VirtualHost) key(path string) storage.StorageKey {
+	if path == "" {
+		return ""
+	}
+	return storage.NamespacedKey(v.Namespace, storage.StorageKey(path))
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kouzant/go-short/context"
+	"github.com/kouzant/go-short/storage"
+	"github.com/spf13/viper"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	stateStore := &storage.MemoryStateStore{}
+	stateStore.Init()
+	stateStore.Save(storage.NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	stateStore.Save(storage.NewStorageItem("docs:setup", "https://docs.example.com/setup"))
+	config := viper.New()
+	config.Set(context.NamespacesKey, []map[string]interface{}{{"name": "docs"}})
+	config.Set(context.VirtualHostsKey, []map[string]interface{}{
+		{"host": "go", "landing": "https://go.example.com/_admin"},
+		{"host": "docs", "namespace": "docs", "fallback": "none",
+			"not-found-url": "https://docs.example.com/search?q={*}"},
+		{"host": "s.example.com", "landing": "https://example.com"},
+	})
+	namespaces, err := NewNamespaces(config)
+	if err != nil {
+		t.Fatalf("NewNamespaces returned error %v", err)
+	}
+	handler := &RedirectHandler{StateStore: stateStore, Namespaces: namespaces}
+
+	var tests = []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{"http://go/", http.StatusTemporaryRedirect, "https://go.example.com/_admin"},
+		{"http://go/gs", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short"},
+		{"http://go/docs/setup", http.StatusTemporaryRedirect, "https://docs.example.com/setup"},
+		{"http://docs/setup", http.StatusTemporaryRedirect, "https://docs.example.com/setup"},
+		{"http://docs/gs", http.StatusTemporaryRedirect, "https://docs.example.com/search?q=gs"},
+		{"http://docs/", http.StatusTemporaryRedirect, "https://docs.example.com/search?q="},
+		{"http://s.example.com:8080/", http.StatusTemporaryRedirect, "https://example.com"},
+		{"http://s.example.com/missing", http.StatusNotFound, ""},
+		{"http://localhost/gs", http.StatusTemporaryRedirect, "https://github.com/kouzant/go-short"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		r.Header.Set("User-Agent", context.CLI_USER_AGENT)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s expected %d %s gotten %d %s", test.url, test.status, test.location, w.Code,
+				w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestInvalidVirtualHosts(t *testing.T) {
+	namespaces := []NamespaceConfig{{Name: "team", Hosts: []string{"team.go"}}}
+	var invalid = [][]*VirtualHost{
+		{{Namespace: "team"}},
+		{{Host: "docs", Namespace: "docs"}},
+		{{Host: "go", Fallback: "nearest"}},
+		{{Host: "go", Landing: "/_admin"}},
+		{{Host: "team.go", Landing: "https://example.com"}},
+	}
+	for _, vhosts := range invalid {
+		if _, err := newNamespaces(namespaces, vhosts); err == nil {
+			t.Errorf("newNamespaces(%v) expected error", vhosts[0])
+		}
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/dgraph-io/badger v1.6.0
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/viper v1.4.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 )
@@ -8,8 +8,12 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/kouzant/go-short/context"
@@ -19,18 +23,51 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// API token sent with every request, read from the client configuration
+var clientToken string
+
+// Namespace sent with every admin request, and the path prefix of resolved keys
+var clientNamespace string
+
 func main() {
 	serverMode := flag.NewFlagSet("server", flag.ExitOnError)
 	clientMode := flag.NewFlagSet("client", flag.ExitOnError)
+	migrateKeysMode := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+
+	// Migrate keys mode arguments
+	applyArg := migrateKeysMode.Bool("apply", false, "Move the keys to their normalized form, otherwise only report them")
 
 	// Client mode arguments
-	opArg := clientMode.String("op", "add", "Operation (add | delete | list | add-batch)")
+	opArg := clientMode.String("op", "add", "Operation (add | update | upsert | rename | alias | delete | restore | trash | list | search | add-batch | stats | history | rollback | resolve | issue-token | revoke-token | tokens)")
 	keyArg := clientMode.String("key", "", "Shortened URL key")
 	valueArg := clientMode.String("url", "", "URL")
+	toArg := clientMode.String("to", "", "New shortened URL key when renaming, or key an alias leads to")
+	descriptionArg := clientMode.String("description", "", "Description of the added or updated URL")
+	tagsArg := clientMode.String("tags", "", "Comma separated tags of the added or updated URL")
+	splitArg := clientMode.String("split", "", "Comma separated URL=weight destinations the added or updated URL splits its traffic across")
+	stickyArg := clientMode.Bool("sticky", false, "Keep sending a browser to the destination of a split URL it got first")
+	rulesArg := clientMode.String("rules", "", "Comma separated CONDITIONS URL rules of the added or updated URL, like 'device:mobile https://m.example.com', none removes them")
+	queryArg := clientMode.String("q", "", "Words to search for in keys, URLs, descriptions and tags")
+	tagArg := clientMode.String("tag", "", "Tag to search for")
+	sortArg := clientMode.String("sort", "key", "Order of listed URLs (key | created | hits)")
+	limitArg := clientMode.Int("limit", 100, "Number of listed URLs per page")
+	cursorArg := clientMode.String("cursor", "", "Cursor of the next page of listed URLs")
+	expiresArg := clientMode.String("expires", "", "Expire the added URL after a duration, like 72h, or at an RFC 3339 time")
+	notBeforeArg := clientMode.String("not-before", "", "Activate the added URL after a duration, or at an RFC 3339 time")
+	passwordArg := clientMode.String("password", "", "Password asked for before redirecting to the added URL")
+	maxUsesArg := clientMode.Uint64("max-uses", 0, "Number of times the added URL can be used, unlimited when 0")
+	redirectStatusArg := clientMode.Int("redirect-status", 0, "Redirect status of the added URL (301 | 302 | 307 | 308), the server default when 0")
+	yesArg := clientMode.Bool("yes", false, "Delete without asking for confirmation")
+	cascadeArg := clientMode.Bool("cascade", false, "Delete the aliases of the deleted URL too")
+	revisionArg := clientMode.Uint64("revision", 0, "Update or delete only if the URL is still at this revision, or revision to roll back to")
 	batchFileArg := clientMode.String("file", "", "Path to CSV file key,URL")
+	daysArg := clientMode.Int("days", 30, "Number of days to show hit trends for")
+	nameArg := clientMode.String("name", "", "API token name")
+	roleArg := clientMode.String("role", "editor", "API token role (viewer | editor | admin)")
+	namespaceArg := clientMode.String("namespace", "", "Namespace of the keys, listed URLs and issued tokens, the global namespace when empty")
 
 	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s [server | client] ...\n", os.Args[0])
+		fmt.Printf("Usage: %s [server | client | migrate-keys] ...\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -39,6 +76,8 @@ func main() {
 		serverMode.Parse(os.Args[2:])
 	case "client":
 		clientMode.Parse(os.Args[2:])
+	case "migrate-keys":
+		migrateKeysMode.Parse(os.Args[2:])
 	default:
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -46,6 +85,8 @@ func main() {
 
 	conf := context.ReadConfig()
 	logger.Init(conf)
+	clientToken = conf.GetString(context.ClientTokenKey)
+	clientNamespace = *namespaceArg
 	log.Info("Starting go-short")
 
 	listeningOn := fmt.Sprintf("%s:%d", conf.GetString(context.WebListenKey),
@@ -57,6 +98,13 @@ func main() {
 			log.Fatal("Could not initialize state store ", error)
 		}
 		defer stateStore.Close()
+		if storage.NewKeyNormalizer(conf) != nil {
+			migration, error := stateStore.MigrateKeys(false)
+			if error == nil && (len(migration.Renamed) > 0 || len(migration.Collisions) > 0) {
+				log.Warnf("%d keys are not normalized and %d normalized keys collide, run migrate-keys to move them",
+					len(migration.Renamed), len(migration.Collisions))
+			}
+		}
 
 		// Trap exit signal
 		sigs := make(chan os.Signal, 1)
@@ -73,29 +121,144 @@ func main() {
 		}()
 
 		mux := http.NewServeMux()
-		redirectHandler := &handlers.RedirectHandler{StateStore: stateStore}
-		adminHandler := &handlers.AdminHandler{StateStore: stateStore}
+		authenticator := handlers.NewAuthenticator(conf, stateStore)
+		if authenticator.IsEnabled() {
+			log.Info("Admin requests require an API token")
+		}
+		keyGenerator, error := handlers.NewKeyGenerator(conf)
+		if error != nil {
+			log.Fatal("Could not initialize key generator ", error)
+		}
+		redirectStatus, error := handlers.ParseRedirectStatus(conf.GetString(context.WebRedirectStatusKey))
+		if error != nil {
+			log.Fatal("Invalid default redirect status ", error)
+		}
+		namespaces, error := handlers.NewNamespaces(conf)
+		if error != nil {
+			log.Fatal("Invalid namespaces or virtual hosts ", error)
+		}
+		redirectHandler := &handlers.RedirectHandler{StateStore: stateStore, Auth: authenticator,
+			DefaultStatus: redirectStatus, Namespaces: namespaces}
+		adminHandler := &handlers.AdminHandler{StateStore: stateStore, Auth: authenticator, KeyGen: keyGenerator,
+			Namespaces: namespaces}
+		apiHandler := &handlers.LinksAPIHandler{StateStore: stateStore, Auth: authenticator, KeyGen: keyGenerator,
+			Namespaces: namespaces}
 		mux.Handle("/", redirectHandler)
 		mux.Handle("/_admin", adminHandler)
+		mux.Handle(handlers.APILinksPath, apiHandler)
+		mux.Handle(handlers.APILinksPath+"/", apiHandler)
 
 		log.Info("Start listening on ", listeningOn)
 		log.Fatal(http.ListenAndServe(listeningOn, mux))
+	} else if migrateKeysMode.Parsed() {
+		if storage.NewKeyNormalizer(conf) == nil {
+			fmt.Println("> Key normalization is disabled, there is nothing to migrate")
+			os.Exit(1)
+		}
+		stateStore := &storage.BadgerStateStore{Config: conf}
+		if error := stateStore.Init(); error != nil {
+			log.Fatal("Could not initialize state store ", error)
+		}
+		// Exits only once the state store is closed
+		status := migrateKeys(stateStore, *applyArg)
+		stateStore.Close()
+		os.Exit(status)
 	} else if clientMode.Parsed() {
 		switch *opArg {
 		case "add":
+			// The server generates a key when it is missing
+			if *valueArg == "" && *splitArg == "" {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			params := url.Values{"key": {*keyArg}, "url": {*valueArg}}
+			if *splitArg != "" {
+				params.Set("split", *splitArg)
+				params.Set("sticky", strconv.FormatBool(*stickyArg))
+			}
+			if *rulesArg != "" {
+				params.Set("rules", *rulesArg)
+			}
+			if *descriptionArg != "" {
+				params.Set("description", *descriptionArg)
+			}
+			if *tagsArg != "" {
+				params.Set("tags", *tagsArg)
+			}
+			if *expiresArg != "" {
+				params.Set("expires", *expiresArg)
+			}
+			if *notBeforeArg != "" {
+				params.Set("not-before", *notBeforeArg)
+			}
+			if *passwordArg != "" {
+				params.Set("password", *passwordArg)
+			}
+			if *maxUsesArg > 0 {
+				params.Set("max-uses", strconv.FormatUint(*maxUsesArg, 10))
+			}
+			if *redirectStatusArg != 0 {
+				params.Set("redirect-status", strconv.Itoa(*redirectStatusArg))
+			}
+			doAddRequest(listeningOn, params)
+		case "update":
+			if *keyArg == "" || (*valueArg == "" && *descriptionArg == "" && *tagsArg == "" && *splitArg == "" &&
+				*rulesArg == "") {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			params := url.Values{"key": {*keyArg}, "url": {*valueArg}, "description": {*descriptionArg},
+				"tags": {*tagsArg}, "split": {*splitArg}, "sticky": {strconv.FormatBool(*stickyArg)},
+				"rules": {*rulesArg}}
+			doEditRequest(listeningOn, *opArg, params, *revisionArg)
+		case "upsert":
 			if *keyArg == "" || *valueArg == "" {
 				clientMode.PrintDefaults()
 				os.Exit(1)
 			}
-			doAddRequest(listeningOn, *keyArg, *valueArg)
+			doEditRequest(listeningOn, *opArg, url.Values{"key": {*keyArg}, "url": {*valueArg}}, *revisionArg)
+		case "rename":
+			if *keyArg == "" || *toArg == "" {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doEditRequest(listeningOn, *opArg, url.Values{"key": {*keyArg}, "to": {*toArg}}, 0)
+		case "alias":
+			if *keyArg == "" || *toArg == "" {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doEditRequest(listeningOn, *opArg, url.Values{"key": {*keyArg}, "to": {*toArg}}, 0)
 		case "delete":
 			if *keyArg == "" {
 				clientMode.PrintDefaults()
 				os.Exit(1)
 			}
-			doDeleteRequest(listeningOn, *keyArg)
+			if !*yesArg && !confirm(fmt.Sprintf("Delete %s? It can be restored from the trash until it is purged", *keyArg)) {
+				fmt.Println("> Not deleted")
+				os.Exit(1)
+			}
+			doDeleteRequest(listeningOn, *keyArg, *revisionArg, *cascadeArg)
+		case "restore":
+			if *keyArg == "" {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doEditRequest(listeningOn, *opArg, url.Values{"key": {*keyArg}}, 0)
+		case "trash":
+			doTrashRequest(listeningOn)
 		case "list":
-			doListRequest(listeningOn)
+			params := url.Values{"sort": {*sortArg}, "limit": {strconv.Itoa(*limitArg)}}
+			if *cursorArg != "" {
+				params.Set("cursor", *cursorArg)
+			}
+			doListRequest(listeningOn, params)
+		case "search":
+			if *queryArg == "" && *tagArg == "" {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doSearchRequest(listeningOn, *queryArg, *tagArg)
 		case "add-batch":
 			if *batchFileArg == "" {
 				fmt.Printf("> ERROR: Missing -file argument")
@@ -103,6 +266,43 @@ func main() {
 				os.Exit(1)
 			}
 			doBatchAddRequest(listeningOn, *batchFileArg)
+		case "stats":
+			if *keyArg == "" {
+				fmt.Printf("> ERROR: Missing -key argument")
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doStatsRequest(listeningOn, *keyArg, *daysArg)
+		case "history":
+			if *keyArg == "" {
+				fmt.Printf("> ERROR: Missing -key argument")
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doHistoryRequest(listeningOn, *keyArg)
+		case "rollback":
+			if *keyArg == "" || *revisionArg == 0 {
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doEditRequest(listeningOn, *opArg, url.Values{"key": {*keyArg},
+				"revision": {strconv.FormatUint(*revisionArg, 10)}}, 0)
+		case "resolve":
+			if *keyArg == "" {
+				fmt.Printf("> ERROR: Missing -key argument")
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doResolveRequest(listeningOn, *keyArg)
+		case "issue-token", "revoke-token":
+			if *nameArg == "" {
+				fmt.Printf("> ERROR: Missing -name argument")
+				clientMode.PrintDefaults()
+				os.Exit(1)
+			}
+			doTokenRequest(listeningOn, *opArg, *nameArg, *roleArg)
+		case "tokens":
+			doListTokensRequest(listeningOn)
 		default:
 			clientMode.PrintDefaults()
 			os.Exit(1)
@@ -110,9 +310,48 @@ func main() {
 	}
 }
 
-func doAddRequest(url, key, value string) {
-	reqUrl := fmt.Sprintf("http://%s/_admin?key=%s&url=%s", url, key, value)
-	statusCode, body := doRequest("POST", reqUrl, nil)
+// Parameters are sent as a form so that passwords stay out of URLs and logs
+func doAddRequest(address string, params url.Values) {
+	reqUrl := fmt.Sprintf("http://%s/_admin", address)
+	statusCode, body := doFormRequest(reqUrl, params)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doEditRequest(address, op string, params url.Values, revision uint64) {
+	params.Set("op", op)
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
+	statusCode, body := doConditionalRequest("POST", reqUrl, nil, revision)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doHistoryRequest(address, key string) {
+	params := url.Values{"op": {"history"}, "key": {key}}
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
+	statusCode, body := doRequest("GET", reqUrl, nil)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doTrashRequest(address string) {
+	reqUrl := fmt.Sprintf("http://%s/_admin?op=trash", address)
+	statusCode, body := doRequest("GET", reqUrl, nil)
 
 	if statusCode == http.StatusOK {
 		fmt.Println(string(body))
@@ -122,9 +361,69 @@ func doAddRequest(url, key, value string) {
 	}
 }
 
-func doDeleteRequest(url, key string) {
+// Reports the keys that do not match their normalized form, and moves them with apply. Keys
+// that collide after normalization are never moved, they have to be renamed or deleted by hand.
+// It returns the exit status
+func migrateKeys(stateStore storage.StateStore, apply bool) int {
+	migration, err := stateStore.MigrateKeys(apply)
+	if err != nil {
+		fmt.Printf("> ERROR: Could not migrate keys, reason %s\n", err)
+		return 3
+	}
+	collisions := make([]string, 0, len(migration.Collisions))
+	for normalized, keys := range migration.Collisions {
+		colliding := make([]string, 0, len(keys))
+		for _, key := range keys {
+			colliding = append(colliding, string(key))
+		}
+		collisions = append(collisions, fmt.Sprintf("> %s: %s", normalized, strings.Join(colliding, ", ")))
+	}
+	renamed := make([]string, 0, len(migration.Renamed))
+	for from, to := range migration.Renamed {
+		renamed = append(renamed, fmt.Sprintf("> %s -> %s", from, to))
+	}
+	sort.Strings(collisions)
+	sort.Strings(renamed)
+
+	if migration.Applied {
+		fmt.Printf("> Moved %d keys to their normalized form\n", len(renamed))
+	} else {
+		fmt.Printf("> %d keys would move to their normalized form, run again with -apply to move them\n",
+			len(renamed))
+	}
+	for _, line := range renamed {
+		fmt.Println(line)
+	}
+	if len(collisions) > 0 {
+		fmt.Printf("> %d normalized keys collide, rename or delete all but one of their keys\n", len(collisions))
+		for _, line := range collisions {
+			fmt.Println(line)
+		}
+		return 4
+	}
+	return 0
+}
+
+func confirm(question string) bool {
+	fmt.Printf("> %s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+func doDeleteRequest(url, key string, revision uint64, cascade bool) {
 	reqUrl := fmt.Sprintf("http://%s/_admin?key=%s", url, key)
-	statusCode, body := doRequest("DELETE", reqUrl, nil)
+	if cascade {
+		reqUrl += "&cascade=true"
+	}
+	statusCode, body := doConditionalRequest("DELETE", reqUrl, nil, revision)
 
 	if statusCode == http.StatusOK {
 		fmt.Println(string(body))
@@ -134,8 +433,21 @@ func doDeleteRequest(url, key string) {
 	}
 }
 
-func doListRequest(url string) {
-	reqUrl := fmt.Sprintf("http://%s/_admin", url)
+func doListRequest(address string, params url.Values) {
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
+	statusCode, body := doRequest("GET", reqUrl, nil)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doSearchRequest(address, query, tag string) {
+	params := url.Values{"op": {"search"}, "q": {query}, "tag": {tag}}
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
 	statusCode, body := doRequest("GET", reqUrl, nil)
 
 	if statusCode == http.StatusOK {
@@ -172,11 +484,121 @@ func doBatchAddRequest(url, path string) {
 	}
 }
 
+func doStatsRequest(address, key string, days int) {
+	params := url.Values{}
+	params.Set("op", "stats")
+	params.Set("key", key)
+	params.Set("days", strconv.Itoa(days))
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
+	statusCode, body := doRequest("GET", reqUrl, nil)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doResolveRequest(address, key string) {
+	path := key
+	if clientNamespace != "" {
+		path = clientNamespace + "/" + key
+	}
+	reqUrl := fmt.Sprintf("http://%s/%s", address, (&url.URL{Path: path}).EscapedPath())
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("GET", reqUrl, nil)
+	handleClientError("resolve", err)
+	req.Header.Add("User-Agent", context.CLI_USER_AGENT)
+	resp, err := client.Do(req)
+	handleClientError("resolve", err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	handleClientError("resolve", err)
+
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		fmt.Printf("> %s -> %s\n", key, resp.Header.Get("Location"))
+	case resp.StatusCode == http.StatusNotFound:
+		fmt.Print(string(body))
+		os.Exit(3)
+	default:
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doTokenRequest(address, op, name, role string) {
+	params := url.Values{}
+	params.Set("op", op)
+	params.Set("name", name)
+	method := "POST"
+	if op == "revoke-token" {
+		method = "DELETE"
+	} else {
+		params.Set("role", role)
+	}
+	reqUrl := fmt.Sprintf("http://%s/_admin?%s", address, params.Encode())
+	statusCode, body := doRequest(method, reqUrl, nil)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
+func doListTokensRequest(address string) {
+	reqUrl := fmt.Sprintf("http://%s/_admin?op=tokens", address)
+	statusCode, body := doRequest("GET", reqUrl, nil)
+
+	if statusCode == http.StatusOK {
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("> ERROR: %s\n", body)
+		os.Exit(3)
+	}
+}
+
 func doRequest(method, url string, reqBody io.Reader) (int, []byte) {
-	client := http.Client{}
+	return doConditionalRequest(method, url, reqBody, 0)
+}
+
+// Sends the request with an If-Match precondition unless revision is 0
+func doConditionalRequest(method, url string, reqBody io.Reader, revision uint64) (int, []byte) {
 	req, err := http.NewRequest(method, url, reqBody)
 	handleClientError(method, err)
+	return sendRequest(req, revision)
+}
+
+func doFormRequest(url string, form url.Values) (int, []byte) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	handleClientError("POST", err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return sendRequest(req, 0)
+}
+
+func sendRequest(req *http.Request, revision uint64) (int, []byte) {
+	method := req.Method
+	client := http.Client{}
+	if clientNamespace != "" {
+		query := req.URL.Query()
+		query.Set("ns", clientNamespace)
+		req.URL.RawQuery = query.Encode()
+	}
 	req.Header.Add("User-Agent", context.CLI_USER_AGENT)
+	if clientToken != "" {
+		req.Header.Add("Authorization", "Bearer "+clientToken)
+	}
+	if revision > 0 {
+		req.Header.Add("If-Match", fmt.Sprintf(`"%d"`, revision))
+	}
 	resp, err := client.Do(req)
 	handleClientError("add", err)
 	defer resp.Body.Close()
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Aliases are alternative keys of a link. An alias points to a key, which
+ * is either a link or another alias, and redirects follow aliases until
+ * the canonical link. Links that still have aliases are only deleted
+ * together with their aliases
+ */
+
+type Alias struct {
+	Key       StorageKey `json:"key"`
+	Target    StorageKey `json:"target"`
+	Creator   string     `json:"creator,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (a *Alias) Copy() *Alias {
+	alias := *a
+	return &alias
+}
+
+// Link whose key or alias is the longest prefix of a key
+type PrefixMatch struct {
+	// Key or alias that matched
+	Prefix StorageKey
+	// Canonical link, its key differs from the prefix when an alias matched
+	Item *StorageItem
+}
+
+type AliasCycle struct {
+	Key StorageKey
+}
+
+func (e AliasCycle) Error() string {
+	return fmt.Sprintf("Alias %s would lead back to itself", e.Key)
+}
+
+type HasAliases struct {
+	Key     StorageKey
+	Aliases []StorageKey
+}
+
+func (e HasAliases) Error() string {
+	aliases := make([]string, 0, len(e.Aliases))
+	for _, alias := range e.Aliases {
+		aliases = append(aliases, string(alias))
+	}
+	return fmt.Sprintf("Key %s has aliases %s", e.Key, strings.Join(aliases, ", "))
+}
+
+// Returns the target of key when it is an alias, false when it is not
+type aliasLookup func(key StorageKey) (StorageKey, bool, error)
+
+// Follows aliases from key to the canonical key
+func followAliases(key StorageKey, lookup aliasLookup) (StorageKey, error) {
+	visited := make(map[StorageKey]bool)
+	for {
+		target, ok, err := lookup(key)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return key, nil
+		}
+		if visited[key] {
+			return "", AliasCycle{Key: key}
+		}
+		visited[key] = true
+		key = target
+	}
+}
+
+// Follows the target of a new alias, which should not lead back to the alias
+func followNewAlias(alias *Alias, lookup aliasLookup) (StorageKey, error) {
+	return followAliases(alias.Target, func(key StorageKey) (StorageKey, bool, error) {
+		if key == alias.Key {
+			return "", false, AliasCycle{Key: alias.Key}
+		}
+		return lookup(key)
+	})
+}
+
+// Aliases grouped under the canonical key they lead to, sorted by key
+func GroupAliases(aliases []*Alias) map[StorageKey][]StorageKey {
+	targets := make(map[StorageKey]StorageKey, len(aliases))
+	for _, alias := range aliases {
+		targets[alias.Key] = alias.Target
+	}
+	lookup := func(key StorageKey) (StorageKey, bool, error) {
+		target, ok := targets[key]
+		return target, ok, nil
+	}
+	groups := make(map[StorageKey][]StorageKey)
+	for _, alias := range aliases {
+		canonical, err := followAliases(alias.Key, lookup)
+		if err != nil {
+			continue
+		}
+		groups[canonical] = append(groups[canonical], alias.Key)
+	}
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i] < group[j]
+		})
+	}
+	return groups
+}
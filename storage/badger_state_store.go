@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kouzant/go-short/context"
@@ -10,10 +13,41 @@ import (
 	"github.com/spf13/viper"
 )
 
+/**
+ * Key spaces of the Badger state store. Databases created before
+ * schema version 1 stored every link as a plain URL under its bare key
+ * and the search index exists since schema version 2
+ */
+const (
+	schemaVersion = 2
+
+	linkPrefix       = "link:"
+	dailyHitsPrefix  = "hits:"
+	hitEventPrefix   = "event:"
+	tokenPrefix      = "token:"
+	historyPrefix    = "history:"
+	trashPrefix      = "trash:"
+	termIndexPrefix  = "term:"
+	tagIndexPrefix   = "tagged:"
+	aliasPrefix      = "alias:"
+	schemaVersionKey = "meta:schema-version"
+
+	// Separates a link key from the rest of a composite key
+	keySeparator = "\x00"
+
+	maxConflictRetries = 10
+)
+
 type BadgerStateStore struct {
 	Config *viper.Viper
 	db     *badger.DB
 	ticker *time.Ticker
+
+	hitEventsRetention time.Duration
+	dailyHitsRetention time.Duration
+	trashRetention     time.Duration
+	expiredRetention   time.Duration
+	normalizer         *KeyNormalizer
 }
 
 func (s *BadgerStateStore) Init() error {
@@ -26,10 +60,32 @@ func (s *BadgerStateStore) Init() error {
 		return err
 	}
 	s.db = db
+	if err = s.migrate(); err != nil {
+		s.db.Close()
+		s.db = nil
+		return err
+	}
 	gcInterval, err := time.ParseDuration(s.Config.GetString(context.StateStoreGCKey))
 	if err != nil {
 		gcInterval = 1 * time.Hour
 	}
+	s.hitEventsRetention, err = time.ParseDuration(s.Config.GetString(context.StateStoreHitEventsRetentionKey))
+	if err != nil {
+		s.hitEventsRetention = 30 * 24 * time.Hour
+	}
+	s.dailyHitsRetention, err = time.ParseDuration(s.Config.GetString(context.StateStoreDailyHitsRetentionKey))
+	if err != nil {
+		s.dailyHitsRetention = defaultDailyHitsRetention
+	}
+	s.trashRetention, err = time.ParseDuration(s.Config.GetString(context.StateStoreTrashRetentionKey))
+	if err != nil {
+		s.trashRetention = 30 * 24 * time.Hour
+	}
+	s.expiredRetention, err = time.ParseDuration(s.Config.GetString(context.StateStoreExpiredRetentionKey))
+	if err != nil {
+		s.expiredRetention = 7 * 24 * time.Hour
+	}
+	s.normalizer = NewKeyNormalizer(s.Config)
 	s.ticker = time.NewTicker(gcInterval)
 	go s.startGCRoutine()
 
@@ -38,6 +94,14 @@ func (s *BadgerStateStore) Init() error {
 
 func (s *BadgerStateStore) startGCRoutine() {
 	for range s.ticker.C {
+		if s.trashRetention > 0 {
+			purged, err := s.PurgeTrash(time.Now().Add(-s.trashRetention))
+			if err != nil {
+				log.Errorf("Could not purge the trash %s", err)
+			} else if purged > 0 {
+				log.Infof("Purged %d links from the trash", purged)
+			}
+		}
 	again:
 		err := s.db.RunValueLogGC(0.5)
 		if err == nil {
@@ -46,14 +110,99 @@ func (s *BadgerStateStore) startGCRoutine() {
 	}
 }
 
+func (s *BadgerStateStore) migrate() error {
+	version, err := s.loadSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return UnknownSchemaVersion{Version: version}
+	}
+	if version == 0 {
+		if err = s.migrateLegacyLinks(); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		if err = s.buildSearchIndex(); err != nil {
+			return err
+		}
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(schemaVersionKey), []byte(strconv.Itoa(schemaVersion)))
+	})
+}
+
+func (s *BadgerStateStore) loadSchemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(schemaVersionKey))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		version, err = strconv.Atoi(string(value))
+		return err
+	})
+	return version, err
+}
+
+// Moves plain URL values stored under bare keys to encoded links in the link key space
+func (s *BadgerStateStore) migrateLegacyLinks() error {
+	legacyItems := make([]*StorageItem, 0, 100)
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			valueCopy, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			legacyItems = append(legacyItems, NewStorageItem(string(item.KeyCopy(nil)), string(valueCopy)))
+		}
+		return nil
+	})
+	if err != nil || len(legacyItems) == 0 {
+		return err
+	}
+	log.Infof("Migrating %d links to schema version %d", len(legacyItems), schemaVersion)
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	now := time.Now()
+	for _, i := range legacyItems {
+		i.Value.revise(nil, now)
+		encoded, err := encodeLink(i.Value)
+		if err != nil {
+			return err
+		}
+		if err = wb.Delete([]byte(string(i.Key))); err != nil {
+			return err
+		}
+		if err = wb.Set(linkKey(i.Key), encoded); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
 func (s *BadgerStateStore) Save(item *StorageItem) error {
+	item.Key = s.normalizer.Normalize(item.Key)
 	err := s.db.Update(func(txn *badger.Txn) error {
-		var key []byte = []byte(string(item.Key))
-		_, err := txn.Get(key)
+		_, err := txn.Get(linkKey(item.Key))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				err = txn.Set([]byte(string(item.Key)), []byte(item.Value.(string)))
-				return err
+				if err = checkNotAlias(txn, item.Key); err != nil {
+					return err
+				}
+				return s.writeLink(txn, item.Key, nil, item.Value, time.Now())
 			}
 			return err
 		}
@@ -62,39 +211,213 @@ func (s *BadgerStateStore) Save(item *StorageItem) error {
 	return err
 }
 
+// Overwrites links in one transaction, it fails with KeyAlreadyExists
+// without writing any of them when a key is taken by an alias
 func (s *BadgerStateStore) SaveAll(items []*StorageItem) error {
-	wb := s.db.NewWriteBatch()
-	defer wb.Cancel()
-
 	for _, i := range items {
-		err := wb.Set([]byte(string(i.Key)), []byte(i.Value.(string)))
+		i.Key = s.normalizer.Normalize(i.Key)
+	}
+	return s.update(func(txn *badger.Txn) error {
+		previous := make(map[StorageKey]*Link)
+		now := time.Now()
+		for n, i := range items {
+			existing, ok := previous[i.Key]
+			if !ok {
+				link, err := getLink(txn, i.Key)
+				if err == nil {
+					existing = link
+				} else if _, notFound := err.(KeyNotFound); !notFound {
+					return err
+				} else if err = checkNotAlias(txn, i.Key); err != nil {
+					return err
+				}
+			}
+			// Keeps the history keys of a key saved twice in the batch apart
+			changedAt := now.Add(time.Duration(n))
+			if err := s.writeLink(txn, i.Key, existing, i.Value, changedAt); err != nil {
+				return err
+			}
+			previous[i.Key] = i.Value
+		}
+		return nil
+	})
+}
+
+// Replaces an existing link, it fails with KeyNotFound when there is nothing to replace
+func (s *BadgerStateStore) Update(item *StorageItem) error {
+	item.Key = s.normalizer.Normalize(item.Key)
+	return s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, item.Key)
 		if err != nil {
 			return err
 		}
-	}
-	return wb.Flush()
+		return s.writeLink(txn, item.Key, existing, item.Value, time.Now())
+	})
 }
 
-func (s *BadgerStateStore) Load(key StorageKey) (StorageValue, error) {
-	var valueCopy []byte
-	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(string(key)))
+// Creates or replaces a link, it returns true when the link was created
+func (s *BadgerStateStore) Upsert(item *StorageItem) (bool, error) {
+	item.Key = s.normalizer.Normalize(item.Key)
+	created := false
+	err := s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, item.Key)
 		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return KeyNotFound{Key: key}
+			if _, ok := err.(KeyNotFound); !ok {
+				return err
 			}
+			if err = checkNotAlias(txn, item.Key); err != nil {
+				return err
+			}
+			created = true
+		}
+		return s.writeLink(txn, item.Key, existing, item.Value, time.Now())
+	})
+	return created, err
+}
+
+// Moves a link together with its hit statistics, history and aliases to a key that does not exist
+func (s *BadgerStateStore) Rename(from, to StorageKey, actor string) error {
+	from = s.normalizer.Normalize(from)
+	to = s.normalizer.Normalize(to)
+	return s.update(func(txn *badger.Txn) error {
+		return s.rename(txn, from, to, actor)
+	})
+}
+
+func (s *BadgerStateStore) rename(txn *badger.Txn, from, to StorageKey, actor string) error {
+	link, err := getLink(txn, from)
+	if err != nil {
+		return err
+	}
+	_, err = getLink(txn, to)
+	if err == nil {
+		return KeyAlreadyExists{Key: to}
+	}
+	if _, ok := err.(KeyNotFound); !ok {
+		return err
+	}
+	if err = checkNotAlias(txn, to); err != nil {
+		return err
+	}
+	aliases, err := loadAliases(txn)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if alias.Target != from {
+			continue
+		}
+		alias.Target = to
+		if err = setAlias(txn, alias); err != nil {
+			return err
+		}
+	}
+	if err = moveKeySpace(txn, dailyHitsKey(from, ""), dailyHitsKey(to, "")); err != nil {
+		return err
+	}
+	if err = moveKeySpace(txn, hitEventKeyPrefix(from), hitEventKeyPrefix(to)); err != nil {
+		return err
+	}
+	if err = moveKeySpace(txn, historyKeyPrefix(from), historyKeyPrefix(to)); err != nil {
+		return err
+	}
+	if err = txn.Delete(linkKey(from)); err != nil {
+		return err
+	}
+	if err = s.indexLink(txn, from, link, nil); err != nil {
+		return err
+	}
+	renamed := link.Copy()
+	renamed.UpdatedBy = actor
+	now := time.Now()
+	renamed.revise(link, now)
+	if err = s.setLink(txn, to, renamed); err != nil {
+		return err
+	}
+	if err = s.indexLink(txn, to, nil, renamed); err != nil {
+		return err
+	}
+	revision := newLinkRevision(to, link, renamed, actor, now)
+	revision.Action = ActionRename
+	revision.From = from
+	return putLinkRevision(txn, revision)
+}
+
+// Replaces a link only if it is still at the expected revision
+func (s *BadgerStateStore) CompareAndSwap(key StorageKey, revision uint64, link *Link) error {
+	key = s.normalizer.Normalize(key)
+	return s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, key)
+		if err != nil {
 			return err
 		}
-		valueCopy, err = item.ValueCopy(nil)
+		if existing.Revision != revision {
+			return RevisionMismatch{Key: key, Expected: revision, Actual: existing.Revision}
+		}
+		return s.writeLink(txn, key, existing, link, time.Now())
+	})
+}
+
+// Deletes a link only if it is still at the expected revision
+func (s *BadgerStateStore) CompareAndDelete(key StorageKey, revision uint64, actor string) error {
+	key = s.normalizer.Normalize(key)
+	return s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, key)
 		if err != nil {
 			return err
 		}
-		return nil
+		if existing.Revision != revision {
+			return RevisionMismatch{Key: key, Expected: revision, Actual: existing.Revision}
+		}
+		if err = checkNoAliases(txn, key); err != nil {
+			return err
+		}
+		return s.removeLink(txn, key, existing, actor, time.Now())
+	})
+}
+
+func (s *BadgerStateStore) Load(key StorageKey) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	var link *Link
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		link, err = getLink(txn, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// Link of the longest prefix of key, following the prefix when it is an alias. Prefixes are
+// normalized one by one, so the matched prefix is the one of key as it was given
+func (s *BadgerStateStore) LoadLongestPrefix(key StorageKey) (*PrefixMatch, error) {
+	var match *PrefixMatch
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range keyPrefixes(key) {
+			normalized := s.normalizer.Normalize(prefix)
+			canonical, err := followAliases(normalized, func(key StorageKey) (StorageKey, bool, error) {
+				return aliasTarget(txn, key)
+			})
+			if err != nil {
+				return err
+			}
+			link, err := getLink(txn, canonical)
+			if err == nil {
+				match = &PrefixMatch{Prefix: prefix, Item: &StorageItem{canonical, link}}
+				return nil
+			}
+			if _, ok := err.(KeyNotFound); !ok {
+				return err
+			}
+		}
+		return KeyNotFound{Key: key}
 	})
 	if err != nil {
 		return nil, err
 	}
-	return StorageValue(string(valueCopy)), nil
+	return match, nil
 }
 
 func (s *BadgerStateStore) LoadAll() ([]*StorageItem, error) {
@@ -103,6 +426,7 @@ func (s *BadgerStateStore) LoadAll() ([]*StorageItem, error) {
 	err := s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
+		opts.Prefix = []byte(linkPrefix)
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
@@ -112,7 +436,11 @@ func (s *BadgerStateStore) LoadAll() ([]*StorageItem, error) {
 			if err != nil {
 				return err
 			}
-			storedItems = append(storedItems, NewStorageItem(string(keyCopy), string(valueCopy)))
+			link, err := decodeLink(valueCopy)
+			if err != nil {
+				return err
+			}
+			storedItems = append(storedItems, &StorageItem{keyFromLinkKey(keyCopy), link})
 		}
 		return nil
 	})
@@ -122,30 +450,1021 @@ func (s *BadgerStateStore) LoadAll() ([]*StorageItem, error) {
 	return storedItems, nil
 }
 
-func (s *BadgerStateStore) Delete(key StorageKey) (StorageValue, error) {
-	item, err := s.Load(key)
+// Streams the links from the start key on, in key order, until fn returns false
+func (s *BadgerStateStore) Iterate(start StorageKey, fn func(item *StorageItem) bool) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		opts.Prefix = []byte(linkPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(linkKey(start)); it.Valid(); it.Next() {
+			item := it.Item()
+			valueCopy, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			link, err := decodeLink(valueCopy)
+			if err != nil {
+				return err
+			}
+			if !fn(&StorageItem{keyFromLinkKey(item.KeyCopy(nil)), link}) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStateStore) LoadPage(options *ListOptions) (*Page, error) {
+	return loadPage(s.Iterate, options)
+}
+
+// Looks the matching keys up in the search index, sorted by key
+func (s *BadgerStateStore) Search(query, tag string) ([]*StorageItem, error) {
+	terms := searchTerms(query)
+	tag = NormalizeTag(tag)
+	if len(terms) == 0 && tag == "" {
+		storedItems, err := s.LoadAll()
+		return storedItems, err
+	}
+	storedItems := make([]*StorageItem, 0)
+	err := s.db.View(func(txn *badger.Txn) error {
+		var matches map[StorageKey]bool
+		for _, term := range terms {
+			matches = intersectKeys(matches, indexedKeys(txn, []byte(termIndexPrefix+term)))
+		}
+		if tag != "" {
+			matches = intersectKeys(matches, indexedKeys(txn, []byte(tagIndexPrefix+tag+keySeparator)))
+		}
+		for key := range matches {
+			link, err := getLink(txn, key)
+			if err != nil {
+				if _, ok := err.(KeyNotFound); ok {
+					continue
+				}
+				return err
+			}
+			storedItems = append(storedItems, &StorageItem{key, link})
+		}
+		return nil
+	})
 	if err != nil {
-		if _, ok := err.(KeyNotFound); ok {
-			return nil, nil
+		return nil, err
+	}
+	sortItemsByKey(storedItems)
+	return storedItems, nil
+}
+
+func (s *BadgerStateStore) Delete(key StorageKey, actor string) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	var deleted *Link
+	err := s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, key)
+		if err != nil {
+			if _, ok := err.(KeyNotFound); ok {
+				return nil
+			}
+			return err
+		}
+		if err = checkNoAliases(txn, key); err != nil {
+			return err
 		}
+		deleted = existing
+		return s.removeLink(txn, key, existing, actor, time.Now())
+	})
+	if err != nil {
 		return nil, err
 	}
+	return deleted, nil
+}
+
+// Deletes a link together with the aliases that lead to it
+func (s *BadgerStateStore) DeleteWithAliases(key StorageKey, actor string) (*Link, []StorageKey, error) {
+	key = s.normalizer.Normalize(key)
+	var deleted *Link
+	var aliases []StorageKey
+	err := s.update(func(txn *badger.Txn) error {
+		existing, err := getLink(txn, key)
+		if err != nil {
+			return err
+		}
+		all, err := loadAliases(txn)
+		if err != nil {
+			return err
+		}
+		aliases = GroupAliases(all)[key]
+		for _, alias := range aliases {
+			if err = txn.Delete(aliasKey(alias)); err != nil {
+				return err
+			}
+		}
+		deleted = existing
+		return s.removeLink(txn, key, existing, actor, time.Now())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return deleted, aliases, nil
+}
 
-	err = s.db.Update(func(txn *badger.Txn) error {
-		err = txn.Delete([]byte(string(key)))
+func (s *BadgerStateStore) LoadTrash() ([]*TrashItem, error) {
+	var trash []*TrashItem
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		trash, err = loadTrash(txn)
 		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return trash, nil
+}
 
+// Moves a deleted link back from the trash, unless its key has been taken again
+func (s *BadgerStateStore) Restore(key StorageKey, actor string) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	var restored *Link
+	err := s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(trashKey(key))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return KeyNotFound{Key: key}
+			}
+			return err
+		}
+		trashed := &TrashItem{}
+		err = item.Value(func(value []byte) error {
+			return json.Unmarshal(value, trashed)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = getLink(txn, key)
+		if err == nil {
+			return KeyAlreadyExists{Key: key}
+		}
+		if _, ok := err.(KeyNotFound); !ok {
+			return err
+		}
+		if err = checkNotAlias(txn, key); err != nil {
+			return err
+		}
+		if err = txn.Delete(trashKey(key)); err != nil {
+			return err
+		}
+		restored = trashed.Link.Copy()
+		restored.UpdatedBy = actor
+		now := time.Now()
+		restored.revise(trashed.Link, now)
+		if err = s.setLink(txn, key, restored); err != nil {
+			return err
+		}
+		if err = s.indexLink(txn, key, nil, restored); err != nil {
+			return err
+		}
+		revision := newLinkRevision(key, nil, restored, actor, now)
+		revision.Action = ActionRestore
+		return putLinkRevision(txn, revision)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return item, nil
+	return restored, nil
 }
 
-func (s *BadgerStateStore) Close() error {
-	s.ticker.Stop()
-	if s.db != nil {
-		return s.db.Close()
+// Removes for good the links deleted before the given time, together with
+// their hits unless a new link took their key
+func (s *BadgerStateStore) PurgeTrash(before time.Time) (int, error) {
+	purged := 0
+	err := s.update(func(txn *badger.Txn) error {
+		purged = 0
+		trash, err := loadTrash(txn)
+		if err != nil {
+			return err
+		}
+		for _, item := range trash {
+			if item.DeletedAt.Before(before) {
+				if err = txn.Delete(trashKey(item.Key)); err != nil {
+					return err
+				}
+				if _, err = getLink(txn, item.Key); err == nil {
+					purged++
+					continue
+				} else if _, ok := err.(KeyNotFound); !ok {
+					return err
+				}
+				if err = deleteKeySpace(txn, dailyHitsKey(item.Key, "")); err != nil {
+					return err
+				}
+				if err = deleteKeySpace(txn, hitEventKeyPrefix(item.Key)); err != nil {
+					return err
+				}
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func (s *BadgerStateStore) RecordHit(event *HitEvent) error {
+	event.Key = s.normalizer.Normalize(event.Key)
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		link, err := getLink(txn, event.Key)
+		if err != nil {
+			// Only links count hits, anything else could grow the store without bounds
+			if _, ok := err.(KeyNotFound); ok {
+				return nil
+			}
+			return err
+		}
+		if event.IsRedirect() {
+			link.Hits++
+			if d := link.Destination(event.Destination); d != nil {
+				d.Hits++
+			}
+			if err = s.setLink(txn, event.Key, link); err != nil {
+				return err
+			}
+			if err = s.countDailyHit(txn, event); err != nil {
+				return err
+			}
+		}
+
+		entry := badger.NewEntry(hitEventKey(event.Key, event.Time), encoded)
+		if s.hitEventsRetention > 0 {
+			entry = entry.WithTTL(s.hitEventsRetention)
+		}
+		return txn.SetEntry(entry)
+	})
+}
+
+// Daily counters are kept for the retention period after their day
+func (s *BadgerStateStore) countDailyHit(txn *badger.Txn, event *HitEvent) error {
+	day := HitDay(event.Time)
+	counter := badger.NewEntry(dailyHitsKey(event.Key, day), nil)
+	if s.dailyHitsRetention > 0 {
+		ttl := time.Until(hitDayEnd(day).Add(s.dailyHitsRetention))
+		if ttl <= 0 {
+			return nil
+		}
+		counter = counter.WithTTL(ttl)
+	}
+	count := uint64(0)
+	item, err := txn.Get(counter.Key)
+	if err == nil {
+		err = item.Value(func(value []byte) error {
+			count = decodeCounter(value)
+			return nil
+		})
+	}
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	counter.Value = encodeCounter(count + 1)
+	return txn.SetEntry(counter)
+}
+
+// Counts a use of a link that can only be used a number of times, it fails
+// with UsesExhausted when the link is used up
+func (s *BadgerStateStore) ConsumeUse(key StorageKey) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	var link *Link
+	err := s.update(func(txn *badger.Txn) error {
+		var err error
+		link, err = getLink(txn, key)
+		if err != nil {
+			return err
+		}
+		if link.IsUsedUp() {
+			return UsesExhausted{Key: key, MaxUses: link.MaxUses}
+		}
+		link.Uses++
+		return s.setLink(txn, key, link)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (s *BadgerStateStore) LoadDailyHits(key StorageKey, since time.Time) ([]*DailyHits, error) {
+	key = s.normalizer.Normalize(key)
+	dailyHits := make([]*DailyHits, 0)
+	prefix := dailyHitsKey(key, "")
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(dailyHitsKey(key, HitDay(since))); it.Valid(); it.Next() {
+			item := it.Item()
+			day := string(item.Key()[len(prefix):])
+			err := item.Value(func(value []byte) error {
+				dailyHits = append(dailyHits, &DailyHits{day, decodeCounter(value)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dailyHits, nil
+}
+
+func (s *BadgerStateStore) LoadHitEvents(key StorageKey, limit int) ([]*HitEvent, error) {
+	key = s.normalizer.Normalize(key)
+	events := make([]*HitEvent, 0, limit)
+	prefix := hitEventKeyPrefix(key)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(append(prefix, 0xFF)); it.Valid() && len(events) < limit; it.Next() {
+			event := &HitEvent{}
+			err := it.Item().Value(func(value []byte) error {
+				return json.Unmarshal(value, event)
+			})
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *BadgerStateStore) LoadHistory(key StorageKey, limit int) ([]*LinkRevision, error) {
+	key = s.normalizer.Normalize(key)
+	history := make([]*LinkRevision, 0, limit)
+	prefix := historyKeyPrefix(key)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(append(prefix, 0xFF)); it.Valid() && len(history) < limit; it.Next() {
+			revision := &LinkRevision{}
+			err := it.Item().Value(func(value []byte) error {
+				return json.Unmarshal(value, revision)
+			})
+			if err != nil {
+				return err
+			}
+			history = append(history, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *BadgerStateStore) SaveToken(token *Token) error {
+	encoded, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		tokens, err := loadTokens(txn)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.Name == token.Name && t.Namespace == token.Namespace {
+				return TokenAlreadyExists{Name: token.Name, Namespace: token.Namespace}
+			}
+		}
+		return txn.Set([]byte(tokenPrefix+token.Hash), encoded)
+	})
+}
+
+func (s *BadgerStateStore) LoadTokenByHash(hash string) (*Token, error) {
+	token := &Token{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(tokenPrefix + hash))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return TokenNotFound{}
+			}
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			return json.Unmarshal(value, token)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *BadgerStateStore) LoadAllTokens() ([]*Token, error) {
+	var tokens []*Token
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		tokens, err = loadTokens(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *BadgerStateStore) DeleteToken(namespace, name string) (*Token, error) {
+	var deleted *Token
+	err := s.update(func(txn *badger.Txn) error {
+		tokens, err := loadTokens(txn)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if token.Name == name && token.Namespace == namespace {
+				deleted = token
+				return txn.Delete([]byte(tokenPrefix + token.Hash))
+			}
+		}
+		return TokenNotFound{Name: name}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Creates an alias or points an existing one elsewhere, its target should lead to a link
+func (s *BadgerStateStore) SaveAlias(alias *Alias) error {
+	alias.Key = s.normalizer.Normalize(alias.Key)
+	alias.Target = s.normalizer.Normalize(alias.Target)
+	return s.update(func(txn *badger.Txn) error {
+		_, err := getLink(txn, alias.Key)
+		if err == nil {
+			return KeyAlreadyExists{Key: alias.Key}
+		}
+		if _, ok := err.(KeyNotFound); !ok {
+			return err
+		}
+		canonical, err := followNewAlias(alias, func(key StorageKey) (StorageKey, bool, error) {
+			return aliasTarget(txn, key)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = getLink(txn, canonical); err != nil {
+			if _, ok := err.(KeyNotFound); ok {
+				return KeyNotFound{Key: alias.Target}
+			}
+			return err
+		}
+		return setAlias(txn, alias)
+	})
+}
+
+func (s *BadgerStateStore) LoadAlias(key StorageKey) (*Alias, error) {
+	key = s.normalizer.Normalize(key)
+	var alias *Alias
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		alias, err = getAlias(txn, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+func (s *BadgerStateStore) LoadAllAliases() ([]*Alias, error) {
+	var aliases []*Alias
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		aliases, err = loadAliases(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// Deletes an alias, the aliases that point to it are pointed to its target instead
+func (s *BadgerStateStore) DeleteAlias(key StorageKey) (*Alias, error) {
+	key = s.normalizer.Normalize(key)
+	var deleted *Alias
+	err := s.update(func(txn *badger.Txn) error {
+		var err error
+		deleted, err = getAlias(txn, key)
+		if err != nil {
+			return err
+		}
+		aliases, err := loadAliases(txn)
+		if err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			if alias.Target != key {
+				continue
+			}
+			alias.Target = deleted.Target
+			if err = setAlias(txn, alias); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(aliasKey(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Moves links and aliases to their normalized keys, except the ones whose normalized keys
+// collide. Nothing changes unless apply is set
+func (s *BadgerStateStore) MigrateKeys(apply bool) (*KeyMigration, error) {
+	var migration *KeyMigration
+	err := s.update(func(txn *badger.Txn) error {
+		keys := loadLinkKeys(txn)
+		aliases, err := loadAliases(txn)
+		if err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			keys = append(keys, alias.Key)
+		}
+		migration = planKeyMigration(keys, s.normalizer)
+		if !apply {
+			return nil
+		}
+		for from, to := range migration.Renamed {
+			alias, err := getAlias(txn, from)
+			if err != nil {
+				if _, ok := err.(KeyNotFound); !ok {
+					return err
+				}
+				if err = s.rename(txn, from, to, ""); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = txn.Delete(aliasKey(from)); err != nil {
+				return err
+			}
+			alias.Key = to
+			if err = setAlias(txn, alias); err != nil {
+				return err
+			}
+		}
+		// Renaming links points their aliases to the new keys, aliases of aliases are left
+		if aliases, err = loadAliases(txn); err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			if to, ok := migration.Renamed[alias.Target]; ok {
+				alias.Target = to
+				if err = setAlias(txn, alias); err != nil {
+					return err
+				}
+			}
+		}
+		migration.Applied = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
+
+// Runs an update transaction retrying it when it conflicts with a concurrent one
+func (s *BadgerStateStore) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		err = s.db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *BadgerStateStore) Close() error {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	if s.db != nil {
+		return s.db.Close()
+	}
+	return nil
+}
+
+func linkKey(key StorageKey) []byte {
+	return []byte(linkPrefix + string(key))
+}
+
+func keyFromLinkKey(key []byte) StorageKey {
+	return StorageKey(key[len(linkPrefix):])
+}
+
+func dailyHitsKey(key StorageKey, day string) []byte {
+	return []byte(dailyHitsPrefix + string(key) + keySeparator + day)
+}
+
+func hitEventKey(key StorageKey, t time.Time) []byte {
+	return append(hitEventKeyPrefix(key), encodeCounter(uint64(t.UnixNano()))...)
+}
+
+func hitEventKeyPrefix(key StorageKey) []byte {
+	return []byte(hitEventPrefix + string(key) + keySeparator)
+}
+
+// Moves every entry under one key prefix to another, keeping what is left of their TTL
+func moveKeySpace(txn *badger.Txn, from, to []byte) error {
+	keys := make([][]byte, 0)
+	entries := make([]*badger.Entry, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = from
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return err
+		}
+		key := item.KeyCopy(nil)
+		keys = append(keys, key)
+		entry := badger.NewEntry(append(append([]byte{}, to...), key[len(from):]...), value)
+		if expiresAt := item.ExpiresAt(); expiresAt > 0 {
+			ttl := time.Until(time.Unix(int64(expiresAt), 0))
+			if ttl <= 0 {
+				continue
+			}
+			entry = entry.WithTTL(ttl)
+		}
+		entries = append(entries, entry)
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteKeySpace(txn *badger.Txn, prefix []byte) error {
+	keys := make([][]byte, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadTokens(txn *badger.Txn) ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(tokenPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		token := &Token{}
+		err := it.Item().Value(func(value []byte) error {
+			return json.Unmarshal(value, token)
+		})
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func historyKey(key StorageKey, t time.Time) []byte {
+	return append(historyKeyPrefix(key), encodeCounter(uint64(t.UnixNano()))...)
+}
+
+func historyKeyPrefix(key StorageKey) []byte {
+	return []byte(historyPrefix + string(key) + keySeparator)
+}
+
+func putLinkRevision(txn *badger.Txn, revision *LinkRevision) error {
+	encoded, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	return txn.Set(historyKey(revision.Key, revision.Time), encoded)
+}
+
+// Stores a link that replaces previous, which is nil for new links, and records the change
+func (s *BadgerStateStore) writeLink(txn *badger.Txn, key StorageKey, previous, link *Link, now time.Time) error {
+	link.revise(previous, now)
+	if err := s.setLink(txn, key, link); err != nil {
+		return err
+	}
+	if err := s.indexLink(txn, key, previous, link); err != nil {
+		return err
+	}
+	return putLinkRevision(txn, newLinkRevision(key, previous, link, link.UpdatedBy, now))
+}
+
+// Moves a link to the trash and records the change
+func (s *BadgerStateStore) removeLink(txn *badger.Txn, key StorageKey, previous *Link, actor string,
+	now time.Time) error {
+	encoded, err := json.Marshal(&TrashItem{Key: key, Link: previous, DeletedAt: now, DeletedBy: actor})
+	if err != nil {
+		return err
+	}
+	if err = txn.Set(trashKey(key), encoded); err != nil {
+		return err
+	}
+	if err = txn.Delete(linkKey(key)); err != nil {
+		return err
+	}
+	if err = s.indexLink(txn, key, previous, nil); err != nil {
+		return err
+	}
+	return putLinkRevision(txn, newLinkRevision(key, previous, nil, actor, now))
+}
+
+func trashKey(key StorageKey) []byte {
+	return []byte(trashPrefix + string(key))
+}
+
+func loadTrash(txn *badger.Txn) ([]*TrashItem, error) {
+	trash := make([]*TrashItem, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(trashPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := &TrashItem{}
+		err := it.Item().Value(func(value []byte) error {
+			return json.Unmarshal(value, item)
+		})
+		if err != nil {
+			return nil, err
+		}
+		trash = append(trash, item)
+	}
+	return trash, nil
+}
+
+func loadLinkKeys(txn *badger.Txn) []StorageKey {
+	keys := make([]StorageKey, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(linkPrefix)
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, keyFromLinkKey(it.Item().KeyCopy(nil)))
+	}
+	return keys
+}
+
+func getLink(txn *badger.Txn, key StorageKey) (*Link, error) {
+	item, err := txn.Get(linkKey(key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, KeyNotFound{Key: key}
+		}
+		return nil, err
+	}
+	valueCopy, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLink(valueCopy)
+}
+
+func (s *BadgerStateStore) setLink(txn *badger.Txn, key StorageKey, link *Link) error {
+	entry, err := s.linkEntry(key, link)
+	if err != nil {
+		return err
+	}
+	return txn.SetEntry(entry)
+}
+
+// Links that expire are written with a TTL, so Badger drops them once
+// the expired retention period is over
+func (s *BadgerStateStore) linkEntry(key StorageKey, link *Link) (*badger.Entry, error) {
+	encoded, err := encodeLink(link)
+	if err != nil {
+		return nil, err
+	}
+	return s.withLinkTTL(badger.NewEntry(linkKey(key), encoded), link), nil
+}
+
+func (s *BadgerStateStore) withLinkTTL(entry *badger.Entry, link *Link) *badger.Entry {
+	if removableAt, ok := link.removableAfter(s.expiredRetention); ok {
+		return entry.WithTTL(time.Until(removableAt))
+	}
+	return entry
+}
+
+// Both transactions and write batches maintain the search index
+type badgerWriter interface {
+	SetEntry(entry *badger.Entry) error
+	Delete(key []byte) error
+}
+
+// Replaces the index entries of previous with the ones of link, either of them is nil
+// when the link is created or removed. Index entries expire together with the link
+func (s *BadgerStateStore) indexLink(w badgerWriter, key StorageKey, previous, link *Link) error {
+	indexed := make(map[string]bool)
+	if link != nil {
+		for _, indexKey := range searchIndexKeys(key, link) {
+			indexed[string(indexKey)] = true
+			if err := w.SetEntry(s.withLinkTTL(badger.NewEntry(indexKey, nil), link)); err != nil {
+				return err
+			}
+		}
+	}
+	if previous != nil {
+		for _, indexKey := range searchIndexKeys(key, previous) {
+			if indexed[string(indexKey)] {
+				continue
+			}
+			if err := w.Delete(indexKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func searchIndexKeys(key StorageKey, link *Link) [][]byte {
+	terms := linkTerms(key, link)
+	tags := linkTags(link)
+	indexKeys := make([][]byte, 0, len(terms)+len(tags))
+	for _, term := range terms {
+		indexKeys = append(indexKeys, []byte(termIndexPrefix+term+keySeparator+string(key)))
+	}
+	for _, tag := range tags {
+		indexKeys = append(indexKeys, []byte(tagIndexPrefix+tag+keySeparator+string(key)))
+	}
+	return indexKeys
+}
+
+// Keys of the index entries starting with prefix, which is either a whole
+// index key up to the separator or the start of a term
+func indexedKeys(txn *badger.Txn, prefix []byte) map[StorageKey]bool {
+	keys := make(map[StorageKey]bool)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		indexKey := string(it.Item().Key())
+		if i := strings.Index(indexKey, keySeparator); i >= 0 {
+			keys[StorageKey(indexKey[i+len(keySeparator):])] = true
+		}
+	}
+	return keys
+}
+
+func intersectKeys(keys, other map[StorageKey]bool) map[StorageKey]bool {
+	if keys == nil {
+		return other
+	}
+	for key := range keys {
+		if !other[key] {
+			delete(keys, key)
+		}
+	}
+	return keys
+}
+
+// Indexes the links stored before the search index existed
+func (s *BadgerStateStore) buildSearchIndex() error {
+	storedItems, err := s.LoadAll()
+	if err != nil || len(storedItems) == 0 {
+		return err
+	}
+	log.Infof("Building the search index of %d links", len(storedItems))
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, i := range storedItems {
+		if err = s.indexLink(wb, i.Key, nil, i.Value); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func aliasKey(key StorageKey) []byte {
+	return []byte(aliasPrefix + string(key))
+}
+
+func getAlias(txn *badger.Txn, key StorageKey) (*Alias, error) {
+	item, err := txn.Get(aliasKey(key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, KeyNotFound{Key: key}
+		}
+		return nil, err
+	}
+	alias := &Alias{}
+	err = item.Value(func(value []byte) error {
+		return json.Unmarshal(value, alias)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+func setAlias(txn *badger.Txn, alias *Alias) error {
+	encoded, err := json.Marshal(alias)
+	if err != nil {
+		return err
+	}
+	return txn.Set(aliasKey(alias.Key), encoded)
+}
+
+func aliasTarget(txn *badger.Txn, key StorageKey) (StorageKey, bool, error) {
+	alias, err := getAlias(txn, key)
+	if err != nil {
+		if _, ok := err.(KeyNotFound); ok {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return alias.Target, true, nil
+}
+
+func loadAliases(txn *badger.Txn) ([]*Alias, error) {
+	aliases := make([]*Alias, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(aliasPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		alias := &Alias{}
+		err := it.Item().Value(func(value []byte) error {
+			return json.Unmarshal(value, alias)
+		})
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// Links are not created under keys that are taken by aliases
+func checkNotAlias(txn *badger.Txn, key StorageKey) error {
+	_, err := txn.Get(aliasKey(key))
+	if err == nil {
+		return KeyAlreadyExists{Key: key}
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+func checkNoAliases(txn *badger.Txn, key StorageKey) error {
+	aliases, err := loadAliases(txn)
+	if err != nil {
+		return err
+	}
+	if keys := GroupAliases(aliases)[key]; len(keys) > 0 {
+		return HasAliases{Key: key, Aliases: keys}
 	}
 	return nil
 }
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Links that split their traffic across weighted destinations, like 90%
+ * to the old wiki and 10% to the new one. The URL of such a link is the
+ * one of its first destination and every destination counts its own hits
+ */
+
+type Destination struct {
+	URL    string `json:"url"`
+	Weight uint   `json:"weight"`
+	Hits   uint64 `json:"hits"`
+}
+
+type InvalidDestinations struct {
+	Reason string
+}
+
+func (e InvalidDestinations) Error() string {
+	return fmt.Sprintf("Invalid destinations, %s", e.Reason)
+}
+
+func (l *Link) IsSplit() bool {
+	return len(l.Destinations) > 0
+}
+
+func (l *Link) TotalWeight() uint {
+	total := uint(0)
+	for _, d := range l.Destinations {
+		total += d.Weight
+	}
+	return total
+}
+
+// Destination the roll falls in, the roll is a number from 0 up to the total weight
+func (l *Link) PickDestination(roll uint) *Destination {
+	for _, d := range l.Destinations {
+		if roll < d.Weight {
+			return d
+		}
+		roll -= d.Weight
+	}
+	return l.Destinations[len(l.Destinations)-1]
+}
+
+// Nil when the link has no destination with the URL
+func (l *Link) Destination(url string) *Destination {
+	for _, d := range l.Destinations {
+		if d.URL == url {
+			return d
+		}
+	}
+	return nil
+}
+
+// Sets the destinations of a split link, or makes it a plain link when there are none
+func (l *Link) SetDestinations(destinations []*Destination) {
+	if len(destinations) == 0 {
+		l.Destinations = nil
+		return
+	}
+	l.Destinations = destinations
+	l.URL = destinations[0].URL
+}
+
+// Destinations of a split link, plain links leave them out instead
+func ValidateDestinations(destinations []*Destination) error {
+	if len(destinations) < 2 {
+		return InvalidDestinations{"a split link needs at least two of them"}
+	}
+	urls := make(map[string]bool)
+	for _, d := range destinations {
+		if d.URL == "" {
+			return InvalidDestinations{"every destination needs a URL"}
+		}
+		if d.Weight == 0 {
+			return InvalidDestinations{fmt.Sprintf("destination %s needs a positive weight", d.URL)}
+		}
+		if urls[d.URL] {
+			return InvalidDestinations{fmt.Sprintf("destination %s is given more than once", d.URL)}
+		}
+		urls[d.URL] = true
+	}
+	return nil
+}
+
+// Destinations given as comma separated URL=weight pairs, nil when there are none
+func ParseDestinations(value string) ([]*Destination, error) {
+	destinations := make([]*Destination, 0)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		// URLs can have = in their query, the weight follows the last one
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, InvalidDestinations{fmt.Sprintf("%s should be URL=weight", pair)}
+		}
+		weight, err := strconv.ParseUint(pair[i+1:], 10, 32)
+		if err != nil {
+			return nil, InvalidDestinations{fmt.Sprintf("%s should be URL=weight", pair)}
+		}
+		destinations = append(destinations, &Destination{URL: pair[:i], Weight: uint(weight)})
+	}
+	if len(destinations) == 0 {
+		return nil, nil
+	}
+	if err := ValidateDestinations(destinations); err != nil {
+		return nil, err
+	}
+	return destinations, nil
+}
+
+func copyDestinations(destinations []*Destination) []*Destination {
+	if destinations == nil {
+		return nil
+	}
+	copied := make([]*Destination, 0, len(destinations))
+	for _, d := range destinations {
+		destination := *d
+		copied = append(copied, &destination)
+	}
+	return copied
+}
+
+// Hits are counted by the state store, destinations that are kept keep counting theirs
+func (l *Link) keepDestinationHits(previous *Link) {
+	for _, d := range l.Destinations {
+		d.Hits = 0
+		if kept := previous.Destination(d.URL); kept != nil {
+			d.Hits = kept.Hits
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"time"
+)
+
+type RevisionAction string
+
+const (
+	ActionCreate  RevisionAction = "create"
+	ActionUpdate  RevisionAction = "update"
+	ActionRename  RevisionAction = "rename"
+	ActionDelete  RevisionAction = "delete"
+	ActionRestore RevisionAction = "restore"
+)
+
+// One change of a link, Old is nil for created links and New is nil for deleted ones
+type LinkRevision struct {
+	Key    StorageKey     `json:"key"`
+	Time   time.Time      `json:"time"`
+	Actor  string         `json:"actor,omitempty"`
+	Action RevisionAction `json:"action"`
+	// Key of the link before it was renamed
+	From StorageKey `json:"from,omitempty"`
+	Old  *Link      `json:"old,omitempty"`
+	New  *Link      `json:"new,omitempty"`
+}
+
+func newLinkRevision(key StorageKey, old, new *Link, actor string, now time.Time) *LinkRevision {
+	revision := &LinkRevision{Key: key, Time: now, Actor: actor, Action: ActionUpdate}
+	if old != nil {
+		revision.Old = old.Copy()
+	} else {
+		revision.Action = ActionCreate
+	}
+	if new != nil {
+		revision.New = new.Copy()
+	} else {
+		revision.Action = ActionDelete
+	}
+	return revision
+}
+
+// Revision of the link after the change, or before it for deletions
+func (r *LinkRevision) Revision() uint64 {
+	if r.New != nil {
+		return r.New.Revision
+	}
+	return r.Old.Revision
+}
+
+func (r *LinkRevision) Copy() *LinkRevision {
+	revision := *r
+	if r.Old != nil {
+		revision.Old = r.Old.Copy()
+	}
+	if r.New != nil {
+		revision.New = r.New.Copy()
+	}
+	return &revision
+}
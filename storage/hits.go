@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	dayFormat = "2006-01-02"
+	// A year and a day, longer than the longest hit trend
+	defaultDailyHitsRetention = 366 * 24 * time.Hour
+)
+
+// A single resolution of a key by the redirect handler
+type HitEvent struct {
+	Key       StorageKey `json:"key"`
+	Time      time.Time  `json:"time"`
+	Referer   string     `json:"referer,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Status    int        `json:"status"`
+	// URL of the destination of a split link
+	Destination string `json:"destination,omitempty"`
+}
+
+// Only redirects count as hits, other responses are kept as events
+func (e *HitEvent) IsRedirect() bool {
+	return e.Status >= 300 && e.Status < 400
+}
+
+type DailyHits struct {
+	Day   string `json:"day"`
+	Count uint64 `json:"count"`
+}
+
+func HitDay(t time.Time) string {
+	return t.UTC().Format(dayFormat)
+}
+
+// End of the day of HitDay
+func hitDayEnd(day string) time.Time {
+	start, _ := time.Parse(dayFormat, day)
+	return start.AddDate(0, 0, 1)
+}
+
+func encodeCounter(count uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, count)
+	return encoded
+}
+
+func decodeCounter(data []byte) uint64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// First byte of every encoded link, bump it when the layout of Link
+	// changes in an incompatible way
+	linkEncodingV1 byte = 1
+)
+
+type Link struct {
+	URL         string    `json:"url"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Creator     string    `json:"creator,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Hits        uint64    `json:"hits"`
+	// Incremented by the state store on every change, but not on hits
+	Revision uint64 `json:"revision"`
+	// Optional, expired links answer with Gone until they are removed
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Optional, the link does not redirect before it
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// Bcrypt hash of the password asked for before redirecting, empty for public links
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Optional, the link is used up after MaxUses redirects
+	MaxUses uint64 `json:"max_uses,omitempty"`
+	// Counted by the state store, like the revision
+	Uses uint64 `json:"uses,omitempty"`
+	// Optional, the default redirect status of the server is used when zero
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Optional, redirects are split across the destinations by their weight
+	Destinations []*Destination `json:"destinations,omitempty"`
+	// Redirects of the same browser keep going to the destination it got first
+	Sticky bool `json:"sticky,omitempty"`
+	// Optional, requests matching a rule are sent to its URL instead
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+func NewLink(url string) *Link {
+	return &Link{URL: url}
+}
+
+func (l *Link) Copy() *Link {
+	link := *l
+	if l.Tags != nil {
+		link.Tags = make([]string, len(l.Tags))
+		copy(link.Tags, l.Tags)
+	}
+	if l.ExpiresAt != nil {
+		expiresAt := *l.ExpiresAt
+		link.ExpiresAt = &expiresAt
+	}
+	if l.NotBefore != nil {
+		notBefore := *l.NotBefore
+		link.NotBefore = &notBefore
+	}
+	link.Destinations = copyDestinations(l.Destinations)
+	link.Rules = copyRules(l.Rules)
+	return &link
+}
+
+func (l *Link) IsExpired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+func (l *Link) IsUsedUp() bool {
+	return l.MaxUses > 0 && l.Uses >= l.MaxUses
+}
+
+// Redirects of dynamic links change over time or from request to request,
+// so browsers should not cache them
+func (l *Link) IsDynamic() bool {
+	return l.IsSplit() || len(l.Rules) > 0 || l.ExpiresAt != nil || l.NotBefore != nil || l.MaxUses > 0
+}
+
+func (l *Link) IsActive(now time.Time) bool {
+	return (l.NotBefore == nil || !now.Before(*l.NotBefore)) && !l.IsExpired(now) && !l.IsUsedUp()
+}
+
+// Expired links are kept for the expired retention period so that they can answer with Gone
+func (l *Link) removableAfter(expiredRetention time.Duration) (time.Time, bool) {
+	if l.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return l.ExpiresAt.Add(expiredRetention), true
+}
+
+// Sets the creation time of new links and the update time of all links
+func (l *Link) touch(now time.Time) {
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = now
+	}
+	l.UpdatedAt = now
+}
+
+// Prepares a link that replaces previous, which is nil when there is no stored link yet
+func (l *Link) revise(previous *Link, now time.Time) {
+	l.Revision = 1
+	if previous != nil {
+		if l.CreatedAt.IsZero() {
+			l.CreatedAt = previous.CreatedAt
+		}
+		l.Revision = previous.Revision + 1
+		l.Hits = previous.Hits
+		l.Uses = previous.Uses
+		l.keepDestinationHits(previous)
+	}
+	l.touch(now)
+}
+
+type RevisionMismatch struct {
+	Key      StorageKey
+	Expected uint64
+	Actual   uint64
+}
+
+func (e RevisionMismatch) Error() string {
+	return fmt.Sprintf("Key %s is at revision %d, not %d", e.Key, e.Actual, e.Expected)
+}
+
+type UsesExhausted struct {
+	Key     StorageKey
+	MaxUses uint64
+}
+
+func (e UsesExhausted) Error() string {
+	return fmt.Sprintf("Key %s has been used %d times already", e.Key, e.MaxUses)
+}
+
+type UnknownLinkEncoding struct {
+	Version byte
+}
+
+func (e UnknownLinkEncoding) Error() string {
+	return fmt.Sprintf("Unknown link encoding version %d", e.Version)
+}
+
+func encodeLink(link *Link) ([]byte, error) {
+	encoded, err := json.Marshal(link)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{linkEncodingV1}, encoded...), nil
+}
+
+func decodeLink(data []byte) (*Link, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Encoded link is empty")
+	}
+	switch data[0] {
+	case linkEncodingV1:
+		link := &Link{}
+		if err := json.Unmarshal(data[1:], link); err != nil {
+			return nil, err
+		}
+		return link, nil
+	default:
+		return nil, UnknownLinkEncoding{Version: data[0]}
+	}
+}
@@ -1,61 +1,582 @@
 package storage
 
 import (
+	"sort"
+	"time"
+
+	"github.com/kouzant/go-short/context"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 type MemoryStateStore struct {
-	Config *viper.Viper
-	db     map[StorageKey]StorageValue
+	Config    *viper.Viper
+	db        map[StorageKey]*Link
+	dailyHits map[StorageKey]map[string]uint64
+	hitEvents map[StorageKey][]*HitEvent
+	tokens    map[string]*Token
+	history   map[StorageKey][]*LinkRevision
+	trash     map[StorageKey]*TrashItem
+	aliases   map[StorageKey]*Alias
+
+	expiredRetention   time.Duration
+	dailyHitsRetention time.Duration
+	normalizer         *KeyNormalizer
 }
 
 func (s *MemoryStateStore) Init() error {
 	log.Info("Initializing memory state store")
-	s.db = make(map[StorageKey]StorageValue)
+	s.db = make(map[StorageKey]*Link)
+	s.dailyHits = make(map[StorageKey]map[string]uint64)
+	s.hitEvents = make(map[StorageKey][]*HitEvent)
+	s.tokens = make(map[string]*Token)
+	s.history = make(map[StorageKey][]*LinkRevision)
+	s.trash = make(map[StorageKey]*TrashItem)
+	s.aliases = make(map[StorageKey]*Alias)
+	s.expiredRetention = 7 * 24 * time.Hour
+	s.dailyHitsRetention = defaultDailyHitsRetention
+	if s.Config != nil {
+		if retention, err := time.ParseDuration(s.Config.GetString(context.StateStoreExpiredRetentionKey)); err == nil {
+			s.expiredRetention = retention
+		}
+		if retention, err := time.ParseDuration(s.Config.GetString(context.StateStoreDailyHitsRetentionKey)); err == nil {
+			s.dailyHitsRetention = retention
+		}
+	}
+	s.normalizer = NewKeyNormalizer(s.Config)
 	return nil
 }
 
 func (s *MemoryStateStore) Save(item *StorageItem) error {
+	item.Key = s.normalizer.Normalize(item.Key)
+	s.sweepExpired(time.Now())
 	if _, ok := s.db[item.Key]; ok {
 		return KeyAlreadyExists{Key: item.Key}
 	}
-	s.db[item.Key] = item.Value
+	if _, ok := s.aliases[item.Key]; ok {
+		return KeyAlreadyExists{Key: item.Key}
+	}
+	s.writeLink(item.Key, nil, item.Value, time.Now())
 	return nil
 }
 
 func (s *MemoryStateStore) SaveAll(items []*StorageItem) error {
+	s.sweepExpired(time.Now())
+	for _, i := range items {
+		i.Key = s.normalizer.Normalize(i.Key)
+		if _, ok := s.aliases[i.Key]; ok {
+			return KeyAlreadyExists{Key: i.Key}
+		}
+	}
+	now := time.Now()
 	for _, i := range items {
-		s.db[i.Key] = i.Value
+		s.writeLink(i.Key, s.db[i.Key], i.Value, now)
 	}
 
 	return nil
 }
 
-func (s *MemoryStateStore) Load(key StorageKey) (StorageValue, error) {
+func (s *MemoryStateStore) Update(item *StorageItem) error {
+	item.Key = s.normalizer.Normalize(item.Key)
+	s.sweepExpired(time.Now())
+	existing, ok := s.db[item.Key]
+	if !ok {
+		return KeyNotFound{Key: item.Key}
+	}
+	s.writeLink(item.Key, existing, item.Value, time.Now())
+	return nil
+}
+
+func (s *MemoryStateStore) Upsert(item *StorageItem) (bool, error) {
+	item.Key = s.normalizer.Normalize(item.Key)
+	s.sweepExpired(time.Now())
+	existing, ok := s.db[item.Key]
+	if _, isAlias := s.aliases[item.Key]; isAlias && !ok {
+		return false, KeyAlreadyExists{Key: item.Key}
+	}
+	s.writeLink(item.Key, existing, item.Value, time.Now())
+	return !ok, nil
+}
+
+func (s *MemoryStateStore) Rename(from, to StorageKey, actor string) error {
+	s.sweepExpired(time.Now())
+	return s.rename(s.normalizer.Normalize(from), s.normalizer.Normalize(to), actor)
+}
+
+func (s *MemoryStateStore) rename(from, to StorageKey, actor string) error {
+	link, ok := s.db[from]
+	if !ok {
+		return KeyNotFound{Key: from}
+	}
+	if _, ok := s.db[to]; ok {
+		return KeyAlreadyExists{Key: to}
+	}
+	if _, ok := s.aliases[to]; ok {
+		return KeyAlreadyExists{Key: to}
+	}
+	for _, alias := range s.aliases {
+		if alias.Target == from {
+			alias.Target = to
+		}
+	}
+	delete(s.db, from)
+	if days, ok := s.dailyHits[from]; ok {
+		s.dailyHits[to] = days
+		delete(s.dailyHits, from)
+	}
+	if events, ok := s.hitEvents[from]; ok {
+		s.hitEvents[to] = events
+		delete(s.hitEvents, from)
+	}
+	if history, ok := s.history[from]; ok {
+		s.history[to] = append(s.history[to], history...)
+		delete(s.history, from)
+	}
+	renamed := link.Copy()
+	renamed.UpdatedBy = actor
+	now := time.Now()
+	renamed.revise(link, now)
+	s.db[to] = renamed
+	revision := newLinkRevision(to, link, renamed, actor, now)
+	revision.Action = ActionRename
+	revision.From = from
+	s.history[to] = append(s.history[to], revision)
+	return nil
+}
+
+func (s *MemoryStateStore) CompareAndSwap(key StorageKey, revision uint64, link *Link) error {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
+	existing, ok := s.db[key]
+	if !ok {
+		return KeyNotFound{Key: key}
+	}
+	if existing.Revision != revision {
+		return RevisionMismatch{Key: key, Expected: revision, Actual: existing.Revision}
+	}
+	s.writeLink(key, existing, link, time.Now())
+	return nil
+}
+
+func (s *MemoryStateStore) CompareAndDelete(key StorageKey, revision uint64, actor string) error {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
+	existing, ok := s.db[key]
+	if !ok {
+		return KeyNotFound{Key: key}
+	}
+	if existing.Revision != revision {
+		return RevisionMismatch{Key: key, Expected: revision, Actual: existing.Revision}
+	}
+	if err := s.checkNoAliases(key); err != nil {
+		return err
+	}
+	s.removeLink(key, existing, actor, time.Now())
+	return nil
+}
+
+func (s *MemoryStateStore) Load(key StorageKey) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
 	if value, ok := s.db[key]; ok {
-		return value, nil
+		return value.Copy(), nil
+	}
+	return nil, KeyNotFound{Key: key}
+}
+
+func (s *MemoryStateStore) LoadLongestPrefix(key StorageKey) (*PrefixMatch, error) {
+	s.sweepExpired(time.Now())
+	for _, prefix := range keyPrefixes(key) {
+		canonical, err := followAliases(s.normalizer.Normalize(prefix), s.aliasTarget)
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := s.db[canonical]; ok {
+			return &PrefixMatch{Prefix: prefix, Item: &StorageItem{canonical, value.Copy()}}, nil
+		}
 	}
 	return nil, KeyNotFound{Key: key}
 }
 
 func (s *MemoryStateStore) LoadAll() ([]*StorageItem, error) {
+	s.sweepExpired(time.Now())
 	storedItems := make([]*StorageItem, 0, len(s.db))
 	for key, value := range s.db {
-		storedItems = append(storedItems, &StorageItem{key, value})
+		storedItems = append(storedItems, &StorageItem{key, value.Copy()})
 	}
 	return storedItems, nil
 }
 
-func (s *MemoryStateStore) Delete(key StorageKey) (StorageValue, error) {
+func (s *MemoryStateStore) Iterate(start StorageKey, fn func(item *StorageItem) bool) error {
+	s.sweepExpired(time.Now())
+	keys := make([]StorageKey, 0, len(s.db))
+	for key := range s.db {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		if !fn(&StorageItem{key, s.db[key].Copy()}) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStateStore) LoadPage(options *ListOptions) (*Page, error) {
+	return loadPage(s.Iterate, options)
+}
+
+func (s *MemoryStateStore) Search(query, tag string) ([]*StorageItem, error) {
+	s.sweepExpired(time.Now())
+	terms := searchTerms(query)
+	tag = NormalizeTag(tag)
+	storedItems := make([]*StorageItem, 0)
+	for key, value := range s.db {
+		if matchesSearch(key, value, terms, tag) {
+			storedItems = append(storedItems, &StorageItem{key, value.Copy()})
+		}
+	}
+	sortItemsByKey(storedItems)
+	return storedItems, nil
+}
+
+func (s *MemoryStateStore) Delete(key StorageKey, actor string) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
 	if value, ok := s.db[key]; ok {
-		delete(s.db, key)
+		if err := s.checkNoAliases(key); err != nil {
+			return nil, err
+		}
+		s.removeLink(key, value, actor, time.Now())
 		return value, nil
 	}
 	return nil, nil
 }
 
+func (s *MemoryStateStore) DeleteWithAliases(key StorageKey, actor string) (*Link, []StorageKey, error) {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
+	value, ok := s.db[key]
+	if !ok {
+		return nil, nil, KeyNotFound{Key: key}
+	}
+	aliases := GroupAliases(s.aliasList())[key]
+	for _, alias := range aliases {
+		delete(s.aliases, alias)
+	}
+	s.removeLink(key, value, actor, time.Now())
+	return value, aliases, nil
+}
+
+func (s *MemoryStateStore) LoadTrash() ([]*TrashItem, error) {
+	trash := make([]*TrashItem, 0, len(s.trash))
+	for _, item := range s.trash {
+		trash = append(trash, item.Copy())
+	}
+	return trash, nil
+}
+
+func (s *MemoryStateStore) Restore(key StorageKey, actor string) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
+	trashed, ok := s.trash[key]
+	if !ok {
+		return nil, KeyNotFound{Key: key}
+	}
+	if _, ok := s.db[key]; ok {
+		return nil, KeyAlreadyExists{Key: key}
+	}
+	if _, ok := s.aliases[key]; ok {
+		return nil, KeyAlreadyExists{Key: key}
+	}
+	delete(s.trash, key)
+	restored := trashed.Link.Copy()
+	restored.UpdatedBy = actor
+	now := time.Now()
+	restored.revise(trashed.Link, now)
+	s.db[key] = restored.Copy()
+	revision := newLinkRevision(key, nil, restored, actor, now)
+	revision.Action = ActionRestore
+	s.history[key] = append(s.history[key], revision)
+	return restored, nil
+}
+
+func (s *MemoryStateStore) PurgeTrash(before time.Time) (int, error) {
+	purged := 0
+	for key, item := range s.trash {
+		if item.DeletedAt.Before(before) {
+			delete(s.trash, key)
+			if _, ok := s.db[key]; !ok {
+				s.deleteHits(key)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *MemoryStateStore) RecordHit(event *HitEvent) error {
+	event.Key = s.normalizer.Normalize(event.Key)
+	s.sweepExpired(time.Now())
+	// Only links count hits, anything else could grow the store without bounds
+	link, ok := s.db[event.Key]
+	if !ok {
+		return nil
+	}
+	if event.IsRedirect() {
+		s.countHit(link, event)
+	}
+	eventCopy := *event
+	s.hitEvents[event.Key] = append(s.hitEvents[event.Key], &eventCopy)
+	return nil
+}
+
+func (s *MemoryStateStore) countHit(link *Link, event *HitEvent) {
+	link.Hits++
+	if d := link.Destination(event.Destination); d != nil {
+		d.Hits++
+	}
+	days, ok := s.dailyHits[event.Key]
+	if !ok {
+		days = make(map[string]uint64)
+		s.dailyHits[event.Key] = days
+	}
+	days[HitDay(event.Time)]++
+	// Daily counters are kept for the retention period after their day
+	if s.dailyHitsRetention > 0 {
+		now := time.Now()
+		for day := range days {
+			if !now.Before(hitDayEnd(day).Add(s.dailyHitsRetention)) {
+				delete(days, day)
+			}
+		}
+	}
+}
+
+func (s *MemoryStateStore) ConsumeUse(key StorageKey) (*Link, error) {
+	key = s.normalizer.Normalize(key)
+	s.sweepExpired(time.Now())
+	link, ok := s.db[key]
+	if !ok {
+		return nil, KeyNotFound{Key: key}
+	}
+	if link.IsUsedUp() {
+		return nil, UsesExhausted{Key: key, MaxUses: link.MaxUses}
+	}
+	link.Uses++
+	return link.Copy(), nil
+}
+
+func (s *MemoryStateStore) LoadDailyHits(key StorageKey, since time.Time) ([]*DailyHits, error) {
+	key = s.normalizer.Normalize(key)
+	sinceDay := HitDay(since)
+	dailyHits := make([]*DailyHits, 0)
+	for day, count := range s.dailyHits[key] {
+		if day >= sinceDay {
+			dailyHits = append(dailyHits, &DailyHits{day, count})
+		}
+	}
+	sort.Slice(dailyHits, func(i, j int) bool {
+		return dailyHits[i].Day < dailyHits[j].Day
+	})
+	return dailyHits, nil
+}
+
+func (s *MemoryStateStore) LoadHitEvents(key StorageKey, limit int) ([]*HitEvent, error) {
+	key = s.normalizer.Normalize(key)
+	stored := s.hitEvents[key]
+	events := make([]*HitEvent, 0, limit)
+	for i := len(stored) - 1; i >= 0 && len(events) < limit; i-- {
+		eventCopy := *stored[i]
+		events = append(events, &eventCopy)
+	}
+	return events, nil
+}
+
+func (s *MemoryStateStore) LoadHistory(key StorageKey, limit int) ([]*LinkRevision, error) {
+	key = s.normalizer.Normalize(key)
+	stored := s.history[key]
+	history := make([]*LinkRevision, 0, limit)
+	for i := len(stored) - 1; i >= 0 && len(history) < limit; i-- {
+		history = append(history, stored[i].Copy())
+	}
+	return history, nil
+}
+
+func (s *MemoryStateStore) SaveToken(token *Token) error {
+	for _, t := range s.tokens {
+		if t.Name == token.Name && t.Namespace == token.Namespace {
+			return TokenAlreadyExists{Name: token.Name, Namespace: token.Namespace}
+		}
+	}
+	s.tokens[token.Hash] = token.Copy()
+	return nil
+}
+
+func (s *MemoryStateStore) LoadTokenByHash(hash string) (*Token, error) {
+	if token, ok := s.tokens[hash]; ok {
+		return token.Copy(), nil
+	}
+	return nil, TokenNotFound{}
+}
+
+func (s *MemoryStateStore) LoadAllTokens() ([]*Token, error) {
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token.Copy())
+	}
+	return tokens, nil
+}
+
+func (s *MemoryStateStore) DeleteToken(namespace, name string) (*Token, error) {
+	for hash, token := range s.tokens {
+		if token.Name == name && token.Namespace == namespace {
+			delete(s.tokens, hash)
+			return token, nil
+		}
+	}
+	return nil, TokenNotFound{Name: name}
+}
+
+func (s *MemoryStateStore) SaveAlias(alias *Alias) error {
+	alias.Key = s.normalizer.Normalize(alias.Key)
+	alias.Target = s.normalizer.Normalize(alias.Target)
+	s.sweepExpired(time.Now())
+	if _, ok := s.db[alias.Key]; ok {
+		return KeyAlreadyExists{Key: alias.Key}
+	}
+	canonical, err := followNewAlias(alias, s.aliasTarget)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.db[canonical]; !ok {
+		return KeyNotFound{Key: alias.Target}
+	}
+	s.aliases[alias.Key] = alias.Copy()
+	return nil
+}
+
+func (s *MemoryStateStore) LoadAlias(key StorageKey) (*Alias, error) {
+	key = s.normalizer.Normalize(key)
+	if alias, ok := s.aliases[key]; ok {
+		return alias.Copy(), nil
+	}
+	return nil, KeyNotFound{Key: key}
+}
+
+func (s *MemoryStateStore) LoadAllAliases() ([]*Alias, error) {
+	return s.aliasList(), nil
+}
+
+func (s *MemoryStateStore) DeleteAlias(key StorageKey) (*Alias, error) {
+	key = s.normalizer.Normalize(key)
+	deleted, ok := s.aliases[key]
+	if !ok {
+		return nil, KeyNotFound{Key: key}
+	}
+	for _, alias := range s.aliases {
+		if alias.Target == key {
+			alias.Target = deleted.Target
+		}
+	}
+	delete(s.aliases, key)
+	return deleted, nil
+}
+
+func (s *MemoryStateStore) MigrateKeys(apply bool) (*KeyMigration, error) {
+	s.sweepExpired(time.Now())
+	keys := make([]StorageKey, 0, len(s.db)+len(s.aliases))
+	for key := range s.db {
+		keys = append(keys, key)
+	}
+	for key := range s.aliases {
+		keys = append(keys, key)
+	}
+	migration := planKeyMigration(keys, s.normalizer)
+	if !apply {
+		return migration, nil
+	}
+	for from, to := range migration.Renamed {
+		if alias, ok := s.aliases[from]; ok {
+			delete(s.aliases, from)
+			alias.Key = to
+			s.aliases[to] = alias
+			continue
+		}
+		if err := s.rename(from, to, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, alias := range s.aliases {
+		if to, ok := migration.Renamed[alias.Target]; ok {
+			alias.Target = to
+		}
+	}
+	migration.Applied = true
+	return migration, nil
+}
+
 func (s *MemoryStateStore) Close() error {
-	s.db = make(map[StorageKey]StorageValue)
+	s.db = make(map[StorageKey]*Link)
+	s.dailyHits = make(map[StorageKey]map[string]uint64)
+	s.hitEvents = make(map[StorageKey][]*HitEvent)
+	s.tokens = make(map[string]*Token)
+	s.history = make(map[StorageKey][]*LinkRevision)
+	s.trash = make(map[StorageKey]*TrashItem)
+	s.aliases = make(map[StorageKey]*Alias)
 	return nil
 }
+
+func (s *MemoryStateStore) writeLink(key StorageKey, previous, link *Link, now time.Time) {
+	link.revise(previous, now)
+	s.db[key] = link.Copy()
+	s.history[key] = append(s.history[key], newLinkRevision(key, previous, link, link.UpdatedBy, now))
+}
+
+func (s *MemoryStateStore) removeLink(key StorageKey, previous *Link, actor string, now time.Time) {
+	s.trash[key] = &TrashItem{Key: key, Link: previous.Copy(), DeletedAt: now, DeletedBy: actor}
+	delete(s.db, key)
+	s.history[key] = append(s.history[key], newLinkRevision(key, previous, nil, actor, now))
+}
+
+func (s *MemoryStateStore) aliasList() []*Alias {
+	aliases := make([]*Alias, 0, len(s.aliases))
+	for _, alias := range s.aliases {
+		aliases = append(aliases, alias.Copy())
+	}
+	return aliases
+}
+
+func (s *MemoryStateStore) aliasTarget(key StorageKey) (StorageKey, bool, error) {
+	if alias, ok := s.aliases[key]; ok {
+		return alias.Target, true, nil
+	}
+	return "", false, nil
+}
+
+func (s *MemoryStateStore) checkNoAliases(key StorageKey) error {
+	if keys := GroupAliases(s.aliasList())[key]; len(keys) > 0 {
+		return HasAliases{Key: key, Aliases: keys}
+	}
+	return nil
+}
+
+// Stands in for the TTL of the Badger state store, links are swept before they are accessed
+func (s *MemoryStateStore) sweepExpired(now time.Time) {
+	for key, link := range s.db {
+		if removableAt, ok := link.removableAfter(s.expiredRetention); ok && !now.Before(removableAt) {
+			delete(s.db, key)
+			s.deleteHits(key)
+		}
+	}
+}
+
+func (s *MemoryStateStore) deleteHits(key StorageKey) {
+	delete(s.dailyHits, key)
+	delete(s.hitEvents, key)
+}
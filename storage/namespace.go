@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/**
+ * Namespaces let teams sharing a server have their own links under the
+ * same keys. The key of a link in a namespace starts with the namespace
+ * and a colon, team:docs is the docs key of the team namespace. Only
+ * configured namespaces make such a prefix, keys without one, like docs
+ * or jira:123, belong to the global namespace
+ */
+
+const NamespaceSeparator = ":"
+
+// Names of the configured namespaces, nil has none
+type NamespaceSet struct {
+	names map[string]bool
+}
+
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func ValidateNamespace(namespace string) error {
+	if !namespaceRegexp.MatchString(namespace) {
+		return fmt.Errorf("Namespace %s should be lower case letters, digits and dashes", namespace)
+	}
+	return nil
+}
+
+// Keys already in the namespace are kept as they are, any other key is put
+// in it, so ops:docs of the team namespace is team:ops:docs
+func NamespacedKey(namespace string, key StorageKey) StorageKey {
+	if namespace == "" || InNamespace(key, namespace) {
+		return key
+	}
+	return StorageKey(namespace + NamespaceSeparator + string(key))
+}
+
+// Whether the key belongs to the namespace, false for the global one
+func InNamespace(key StorageKey, namespace string) bool {
+	return namespace != "" && strings.HasPrefix(string(key), string(namespacePrefix(namespace)))
+}
+
+func NewNamespaceSet(names ...string) *NamespaceSet {
+	namespaces := &NamespaceSet{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		namespaces.Add(name)
+	}
+	return namespaces
+}
+
+func (n *NamespaceSet) Add(namespace string) {
+	n.names[namespace] = true
+}
+
+func (n *NamespaceSet) Has(namespace string) bool {
+	return n != nil && n.names[namespace]
+}
+
+// Empty for keys of the global namespace
+func (n *NamespaceSet) KeyNamespace(key StorageKey) string {
+	i := strings.Index(string(key), NamespaceSeparator)
+	if i < 0 || !n.Has(string(key[:i])) {
+		return ""
+	}
+	return string(key[:i])
+}
+
+func namespacePrefix(namespace string) StorageKey {
+	if namespace == "" {
+		return ""
+	}
+	return StorageKey(namespace + NamespaceSeparator)
+}
+
+func (n *NamespaceSet) Filter(items []*StorageItem, namespace string) []*StorageItem {
+	filtered := make([]*StorageItem, 0, len(items))
+	for _, item := range items {
+		if n.KeyNamespace(item.Key) == namespace {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
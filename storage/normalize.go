@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kouzant/go-short/context"
+
+	"github.com/spf13/viper"
+)
+
+/**
+ * Normalization of keys, so that go/Docs, go/docs/ and go/my_docs find
+ * go/docs and go/my-docs. State stores normalize every key they are
+ * given, links stored before normalization was enabled are moved to
+ * their normalized keys with MigrateKeys
+ */
+
+type KeyNormalizer struct {
+	FoldCase           bool
+	StripTrailingSlash bool
+	// Treats - and _ as equal by storing both as -
+	EqualSeparators bool
+}
+
+// Nil when every normalization is disabled
+func NewKeyNormalizer(config *viper.Viper) *KeyNormalizer {
+	if config == nil {
+		return nil
+	}
+	normalizer := &KeyNormalizer{
+		FoldCase:           config.GetBool(context.StateStoreNormalizeFoldCaseKey),
+		StripTrailingSlash: config.GetBool(context.StateStoreNormalizeTrailingSlashKey),
+		EqualSeparators:    config.GetBool(context.StateStoreNormalizeSeparatorsKey),
+	}
+	if !normalizer.FoldCase && !normalizer.StripTrailingSlash && !normalizer.EqualSeparators {
+		return nil
+	}
+	return normalizer
+}
+
+func (n *KeyNormalizer) Normalize(key StorageKey) StorageKey {
+	if n == nil {
+		return key
+	}
+	normalized := string(key)
+	if n.FoldCase {
+		normalized = strings.ToLower(normalized)
+	}
+	if n.StripTrailingSlash {
+		normalized = strings.TrimRight(normalized, "/")
+	}
+	if n.EqualSeparators {
+		normalized = strings.Replace(normalized, "_", "-", -1)
+	}
+	return StorageKey(normalized)
+}
+
+// Keys of links and aliases that do not match their normalized form
+type KeyMigration struct {
+	// Keys moved to their normalized key
+	Renamed map[StorageKey]StorageKey
+	// Keys left as they are because they share a normalized key, sorted
+	Collisions map[StorageKey][]StorageKey
+	// False when the keys were only checked
+	Applied bool
+}
+
+func planKeyMigration(keys []StorageKey, normalizer *KeyNormalizer) *KeyMigration {
+	migration := &KeyMigration{
+		Renamed:    make(map[StorageKey]StorageKey),
+		Collisions: make(map[StorageKey][]StorageKey),
+	}
+	groups := make(map[StorageKey][]StorageKey)
+	for _, key := range keys {
+		normalized := normalizer.Normalize(key)
+		groups[normalized] = append(groups[normalized], key)
+	}
+	for normalized, group := range groups {
+		if len(group) > 1 {
+			sort.Slice(group, func(i, j int) bool {
+				return group[i] < group[j]
+			})
+			migration.Collisions[normalized] = group
+		} else if group[0] != normalized {
+			migration.Renamed[group[0]] = normalized
+		}
+	}
+	return migration
+}
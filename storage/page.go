@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Pages of links. Pages sorted by key seek to the cursor, pages sorted
+ * otherwise stream every link through a heap of the page size, so both
+ * keep at most a page of links in memory. Cursors are opaque to clients,
+ * they encode the sort value and the key of the last link of a page
+ */
+
+type SortOrder string
+
+const (
+	SortByKey SortOrder = "key"
+	// Newest first
+	SortByCreated SortOrder = "created"
+	// Most hits first
+	SortByHits SortOrder = "hits"
+)
+
+type ListOptions struct {
+	// Empty for the first page
+	Cursor string
+	Limit  int
+	Sort   SortOrder
+	// Only links of the namespace are listed, empty for the global namespace
+	Namespace string
+	// Configured namespaces, keys of other prefixes are listed in the global namespace
+	Namespaces *NamespaceSet
+}
+
+type Page struct {
+	Items []*StorageItem
+	// Empty on the last page
+	NextCursor string
+}
+
+type InvalidCursor struct {
+	Cursor string
+}
+
+func (e InvalidCursor) Error() string {
+	return fmt.Sprintf("Cursor %s is not valid", e.Cursor)
+}
+
+func ParseSortOrder(value string) (SortOrder, error) {
+	switch SortOrder(value) {
+	case "", SortByKey:
+		return SortByKey, nil
+	case SortByCreated, SortByHits:
+		return SortOrder(value), nil
+	default:
+		return "", fmt.Errorf("Unknown sort order %s, it should be %s, %s or %s", value, SortByKey, SortByCreated,
+			SortByHits)
+	}
+}
+
+// Position of a link in a sort order
+type sortPosition struct {
+	value int64
+	key   StorageKey
+}
+
+func positionOf(item *StorageItem, order SortOrder) sortPosition {
+	switch order {
+	case SortByCreated:
+		return sortPosition{item.Value.CreatedAt.UnixNano(), item.Key}
+	case SortByHits:
+		return sortPosition{int64(item.Value.Hits), item.Key}
+	default:
+		return sortPosition{0, item.Key}
+	}
+}
+
+// Larger values come first, ties and key sorting go by key
+func (p sortPosition) before(other sortPosition) bool {
+	if p.value != other.value {
+		return p.value > other.value
+	}
+	return p.key < other.key
+}
+
+func encodeCursor(position sortPosition) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(position.value, 10) + keySeparator +
+		string(position.key)))
+}
+
+func decodeCursor(cursor string) (sortPosition, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return sortPosition{}, InvalidCursor{cursor}
+	}
+	parts := strings.SplitN(string(decoded), keySeparator, 2)
+	if len(parts) != 2 {
+		return sortPosition{}, InvalidCursor{cursor}
+	}
+	value, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return sortPosition{}, InvalidCursor{cursor}
+	}
+	return sortPosition{value, StorageKey(parts[1])}, nil
+}
+
+// Iterates from the start key, in key order, until fn returns false
+type iterateFunc func(start StorageKey, fn func(item *StorageItem) bool) error
+
+func loadPage(iterate iterateFunc, options *ListOptions) (*Page, error) {
+	if options.Limit < 1 {
+		return nil, fmt.Errorf("Page limit should be positive, it is %d", options.Limit)
+	}
+	var after *sortPosition
+	if options.Cursor != "" {
+		position, err := decodeCursor(options.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &position
+	}
+	// One more than the limit tells whether there is a next page
+	page := &pageHeap{order: options.Sort, size: options.Limit + 1}
+	start := namespacePrefix(options.Namespace)
+	if options.Sort == SortByKey && after != nil && after.key > start {
+		start = after.key
+	}
+	err := iterate(start, func(item *StorageItem) bool {
+		// Keys of a namespace are adjacent, keys of the namespaces are skipped in the global one
+		if options.Namespace != "" && !InNamespace(item.Key, options.Namespace) {
+			return false
+		}
+		if options.Namespace == "" && options.Namespaces.KeyNamespace(item.Key) != "" {
+			return true
+		}
+		position := positionOf(item, options.Sort)
+		if after != nil && !after.before(position) {
+			return true
+		}
+		page.offer(item)
+		// Keys come in order, the page is complete once it is full
+		return options.Sort != SortByKey || page.Len() < page.size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := page.sorted()
+	result := &Page{Items: items}
+	if len(items) > options.Limit {
+		result.Items = items[:options.Limit]
+		result.NextCursor = encodeCursor(positionOf(result.Items[options.Limit-1], options.Sort))
+	}
+	return result, nil
+}
+
+// Keeps the first size items of a sort order, the last of them on top
+type pageHeap struct {
+	order SortOrder
+	size  int
+	items []*StorageItem
+}
+
+func (h *pageHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *pageHeap) Less(i, j int) bool {
+	return positionOf(h.items[j], h.order).before(positionOf(h.items[i], h.order))
+}
+
+func (h *pageHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *pageHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*StorageItem))
+}
+
+func (h *pageHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+func (h *pageHeap) offer(item *StorageItem) {
+	if h.Len() < h.size {
+		heap.Push(h, item)
+		return
+	}
+	if positionOf(item, h.order).before(positionOf(h.items[0], h.order)) {
+		h.items[0] = item
+		heap.Fix(h, 0)
+	}
+}
+
+func (h *pageHeap) sorted() []*StorageItem {
+	items := make([]*StorageItem, h.Len())
+	for i := len(items) - 1; i >= 0; i-- {
+		items[i] = heap.Pop(h).(*StorageItem)
+	}
+	return items
+}
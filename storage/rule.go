@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Conditional routing of links. Every rule of a link has the conditions
+ * a request should meet to be sent to the URL of the rule instead of the
+ * URL of the link, like mobile browsers to the mobile site or the on-call
+ * person of the week. Rules are tried in order and the first one whose
+ * conditions all match wins
+ */
+
+const (
+	// User agent contains the value, case insensitive
+	ConditionUserAgent = "ua"
+	// mobile or desktop, guessed from the user agent
+	ConditionDevice = "device"
+	// Most preferred language of Accept-Language, de also matches de-CH
+	ConditionLanguage = "lang"
+	// name=value, or only name for any value
+	ConditionQuery = "query"
+	// Time of day like 09:00-17:00, the end is not included
+	ConditionTime = "time"
+	// Day of the week like sat or mon-fri
+	ConditionDay = "day"
+	// Weeks since the rota epoch modulo the total, 1/3 is the second of every three weeks
+	ConditionWeek = "week"
+)
+
+type Rule struct {
+	Conditions []*Condition `json:"conditions"`
+	URL        string       `json:"url"`
+}
+
+type Condition struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// The attributes of a request rules are evaluated against
+type RuleRequest struct {
+	UserAgent string
+	// Most preferred first
+	Languages []string
+	Query     url.Values
+	Time      time.Time
+}
+
+type InvalidRule struct {
+	Rule   string
+	Reason string
+}
+
+func (e InvalidRule) Error() string {
+	return fmt.Sprintf("Invalid rule %s, %s", e.Rule, e.Reason)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+var mobileAgents = []string{"mobi", "android", "iphone", "ipad"}
+
+// Weeks of rotas are counted from this Monday, ISO week numbers would
+// repeat a slot in years with 53 weeks
+var rotaEpoch = time.Date(1970, time.January, 5, 0, 0, 0, 0, time.UTC)
+
+// First rule the request matches, nil when it matches none
+func (l *Link) MatchRule(request *RuleRequest) *Rule {
+	for _, rule := range l.Rules {
+		if rule.Matches(request) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Matches(request *RuleRequest) bool {
+	for _, c := range r.Conditions {
+		matches, err := c.Matches(request)
+		if err != nil || !matches {
+			return false
+		}
+	}
+	return true
+}
+
+// Written the way ParseRules reads it
+func (r *Rule) String() string {
+	conditions := make([]string, 0, len(r.Conditions))
+	for _, c := range r.Conditions {
+		conditions = append(conditions, c.String())
+	}
+	return strings.Join(conditions, "&") + " " + r.URL
+}
+
+func (c *Condition) String() string {
+	return c.Kind + ":" + c.Value
+}
+
+func (c *Condition) Matches(request *RuleRequest) (bool, error) {
+	switch c.Kind {
+	case ConditionUserAgent:
+		return strings.Contains(strings.ToLower(request.UserAgent), strings.ToLower(c.Value)), nil
+	case ConditionDevice:
+		switch c.Value {
+		case "mobile":
+			return isMobile(request.UserAgent), nil
+		case "desktop":
+			return !isMobile(request.UserAgent), nil
+		}
+		return false, fmt.Errorf("device should be mobile or desktop")
+	case ConditionLanguage:
+		if len(request.Languages) == 0 {
+			return false, nil
+		}
+		language := strings.ToLower(request.Languages[0])
+		value := strings.ToLower(c.Value)
+		return language == value || strings.HasPrefix(language, value+"-"), nil
+	case ConditionQuery:
+		i := strings.Index(c.Value, "=")
+		if i < 0 {
+			_, ok := request.Query[c.Value]
+			return ok, nil
+		}
+		return request.Query.Get(c.Value[:i]) == c.Value[i+1:], nil
+	case ConditionTime:
+		start, end, err := parseTimeRange(c.Value)
+		if err != nil {
+			return false, err
+		}
+		now := request.Time.Hour()*60 + request.Time.Minute()
+		return inRange(now, start, end, false), nil
+	case ConditionDay:
+		first, last, err := parseDayRange(c.Value)
+		if err != nil {
+			return false, err
+		}
+		return inRange(int(request.Time.Weekday()), int(first), int(last), true), nil
+	case ConditionWeek:
+		week, total, err := parseWeekRota(c.Value)
+		if err != nil {
+			return false, err
+		}
+		return rotaWeek(request.Time)%total == week, nil
+	}
+	return false, fmt.Errorf("unknown condition %s", c.Kind)
+}
+
+func ValidateRules(rules []*Rule) error {
+	for _, rule := range rules {
+		if rule.URL == "" {
+			return InvalidRule{rule.String(), "it needs a URL"}
+		}
+		if len(rule.Conditions) == 0 {
+			return InvalidRule{rule.String(), "it needs at least one condition"}
+		}
+		for _, c := range rule.Conditions {
+			if c.Value == "" {
+				return InvalidRule{rule.String(), fmt.Sprintf("condition %s needs a value", c.Kind)}
+			}
+			if _, err := c.Matches(&RuleRequest{}); err != nil {
+				return InvalidRule{rule.String(), err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// Rules given as comma separated CONDITIONS URL pairs, where the conditions
+// are kind:value joined with &, like device:mobile&lang:de https://m.example.de
+func ParseRules(value string) ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+	for _, text := range strings.Split(value, ",") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, InvalidRule{strings.TrimSpace(text), "it should be CONDITIONS URL"}
+		}
+		rule := &Rule{URL: fields[1]}
+		for _, condition := range strings.Split(fields[0], "&") {
+			i := strings.Index(condition, ":")
+			if i < 0 {
+				return nil, InvalidRule{strings.TrimSpace(text), fmt.Sprintf("%s should be kind:value", condition)}
+			}
+			rule.Conditions = append(rule.Conditions, &Condition{Kind: condition[:i], Value: condition[i+1:]})
+		}
+		rules = append(rules, rule)
+	}
+	if err := ValidateRules(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func copyRules(rules []*Rule) []*Rule {
+	if rules == nil {
+		return nil
+	}
+	copied := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		rule := &Rule{URL: r.URL, Conditions: make([]*Condition, 0, len(r.Conditions))}
+		for _, c := range r.Conditions {
+			condition := *c
+			rule.Conditions = append(rule.Conditions, &condition)
+		}
+		copied = append(copied, rule)
+	}
+	return copied
+}
+
+// Weeks from the rota epoch to the day of the time, in the location of the time
+func rotaWeek(t time.Time) int {
+	year, month, day := t.Date()
+	days := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Sub(rotaEpoch).Hours() / 24)
+	if days < 0 {
+		return 0
+	}
+	return days / 7
+}
+
+func isMobile(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, agent := range mobileAgents {
+		if strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ranges whose end comes before their start wrap around, like 22:00-06:00 or fri-mon
+func inRange(value, start, end int, inclusive bool) bool {
+	if inclusive {
+		end++
+	}
+	if start < end {
+		return value >= start && value < end
+	}
+	return value >= start || value < end
+}
+
+// Minutes of the day the range starts and ends at
+func parseTimeRange(value string) (int, int, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("time should be HH:MM-HH:MM")
+	}
+	start, err := time.Parse("15:04", parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("time should be HH:MM-HH:MM")
+	}
+	end, err := time.Parse("15:04", parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("time should be HH:MM-HH:MM")
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+func parseDayRange(value string) (time.Weekday, time.Weekday, error) {
+	parts := strings.Split(strings.ToLower(value), "-")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("day should be a day like mon or a range like mon-fri")
+	}
+	first, ok := weekdays[parts[0]]
+	if !ok {
+		return 0, 0, fmt.Errorf("day should be a day like mon or a range like mon-fri")
+	}
+	last, ok := weekdays[parts[len(parts)-1]]
+	if !ok {
+		return 0, 0, fmt.Errorf("day should be a day like mon or a range like mon-fri")
+	}
+	return first, last, nil
+}
+
+func parseWeekRota(value string) (int, int, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("week should be N/TOTAL like 0/2")
+	}
+	week, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("week should be N/TOTAL like 0/2")
+	}
+	total, err := strconv.Atoi(parts[1])
+	if err != nil || total < 1 || week < 0 || week >= total {
+		return 0, 0, fmt.Errorf("week should be N/TOTAL with N less than TOTAL")
+	}
+	return week, total, nil
+}
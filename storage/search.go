@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/**
+ * Search of links by the words of their key, URL, description and tags,
+ * and by tag. Every word of a query should be the start of a word of
+ * the link, so partial words match too. Tags match as a whole and case
+ * does not matter for either
+ */
+
+// Lower case words of text, without duplicates
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	seen := make(map[string]bool, len(words))
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func linkTerms(key StorageKey, link *Link) []string {
+	return searchTerms(strings.Join([]string{string(key), link.URL, link.Description,
+		strings.Join(link.Tags, " ")}, " "))
+}
+
+func linkTags(link *Link) []string {
+	tags := make([]string, 0, len(link.Tags))
+	seen := make(map[string]bool, len(link.Tags))
+	for _, tag := range link.Tags {
+		tag = NormalizeTag(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Whether a search for the query and tag finds the link, like Search does
+func MatchesSearch(key StorageKey, link *Link, query, tag string) bool {
+	return matchesSearch(key, link, searchTerms(query), NormalizeTag(tag))
+}
+
+func matchesSearch(key StorageKey, link *Link, terms []string, tag string) bool {
+	if tag != "" && !containsString(linkTags(link), tag) {
+		return false
+	}
+	words := linkTerms(key, link)
+	for _, term := range terms {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortItemsByKey(items []*StorageItem) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+}
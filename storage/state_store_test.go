@@ -3,9 +3,13 @@ package storage
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
+	badger "github.com/dgraph-io/badger"
 	"github.com/kouzant/go-short/context"
 	"github.com/spf13/viper"
 )
@@ -30,6 +34,1159 @@ func TestWriteBatch(t *testing.T) {
 	testWriteBatchMemory(t)
 }
 
+func TestLinkRecord(t *testing.T) {
+	testLinkRecordBadger(t)
+	testLinkRecordMemory(t)
+}
+
+func TestHits(t *testing.T) {
+	testHitsBadger(t)
+	testHitsMemory(t)
+}
+
+func TestLongestPrefix(t *testing.T) {
+	testLongestPrefixBadger(t)
+	testLongestPrefixMemory(t)
+}
+
+func TestTokens(t *testing.T) {
+	testTokensBadger(t)
+	testTokensMemory(t)
+}
+
+func TestUpdate(t *testing.T) {
+	testUpdateBadger(t)
+	testUpdateMemory(t)
+}
+
+func TestRename(t *testing.T) {
+	testRenameBadger(t)
+	testRenameMemory(t)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	testCompareAndSwapBadger(t)
+	testCompareAndSwapMemory(t)
+}
+
+func TestHistory(t *testing.T) {
+	testHistoryBadger(t)
+	testHistoryMemory(t)
+}
+
+func TestTrash(t *testing.T) {
+	testTrashBadger(t)
+	testTrashMemory(t)
+}
+
+func TestExpiry(t *testing.T) {
+	testExpiryBadger(t)
+	testExpiryMemory(t)
+}
+
+func TestConsumeUse(t *testing.T) {
+	testConsumeUseBadger(t)
+	testConsumeUseMemory(t)
+}
+
+func TestSearch(t *testing.T) {
+	testSearchBadger(t)
+	testSearchMemory(t)
+}
+
+func TestPagination(t *testing.T) {
+	testPaginationBadger(t)
+	testPaginationMemory(t)
+}
+
+func TestNamespaces(t *testing.T) {
+	testNamespacesBadger(t)
+	testNamespacesMemory(t)
+}
+
+func TestAliases(t *testing.T) {
+	testAliasesBadger(t)
+	testAliasesMemory(t)
+}
+
+func TestKeyNormalization(t *testing.T) {
+	testKeyNormalizationBadger(t)
+	testKeyNormalizationMemory(t)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	testMigrateKeysBadger(t)
+	testMigrateKeysMemory(t)
+}
+
+func TestSplitLinks(t *testing.T) {
+	testSplitLinksBadger(t)
+	testSplitLinksMemory(t)
+}
+
+func TestParseDestinations(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  []*Destination
+		err   bool
+	}{
+		{"https://a.example.com=90,https://b.example.com=10",
+			[]*Destination{{URL: "https://a.example.com", Weight: 90}, {URL: "https://b.example.com", Weight: 10}}, false},
+		{" https://a.example.com?x=1=1 , https://b.example.com=3 ,",
+			[]*Destination{{URL: "https://a.example.com?x=1", Weight: 1}, {URL: "https://b.example.com", Weight: 3}}, false},
+		{"https://a.example.com=90", nil, true},
+		{"https://a.example.com=90,https://b.example.com", nil, true},
+		{"https://a.example.com=90,https://b.example.com=0", nil, true},
+		{"https://a.example.com=1,https://a.example.com=2", nil, true},
+		{" , ,", nil, false},
+	}
+	for _, test := range tests {
+		destinations, err := ParseDestinations(test.value)
+		if (err != nil) != test.err || !reflect.DeepEqual(destinations, test.want) {
+			t.Errorf("ParseDestinations(%s) expected %v gotten %v - %v", test.value, test.want, destinations, err)
+		}
+	}
+
+	link := &Link{}
+	link.SetDestinations([]*Destination{{URL: "https://a.example.com", Weight: 3}, {URL: "https://b.example.com", Weight: 1}})
+	for roll, want := range []string{"https://a.example.com", "https://a.example.com", "https://a.example.com",
+		"https://b.example.com"} {
+		if picked := link.PickDestination(uint(roll)); picked.URL != want {
+			t.Errorf("PickDestination(%d) expected %s gotten %s", roll, want, picked.URL)
+		}
+	}
+}
+
+func TestRuleMatching(t *testing.T) {
+	// A Wednesday of rota week 2597
+	wednesday := time.Date(2019, 10, 16, 10, 30, 0, 0, time.UTC)
+	request := &RuleRequest{
+		UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 13_1 like Mac OS X) Mobile/15E148",
+		Languages: []string{"de-CH", "en"},
+		Query:     url.Values{"env": {"staging"}, "debug": {""}},
+		Time:      wednesday,
+	}
+	var tests = []struct {
+		condition Condition
+		want      bool
+	}{
+		{Condition{ConditionUserAgent, "IPHONE"}, true},
+		{Condition{ConditionUserAgent, "Firefox"}, false},
+		{Condition{ConditionDevice, "mobile"}, true},
+		{Condition{ConditionDevice, "desktop"}, false},
+		{Condition{ConditionLanguage, "de"}, true},
+		{Condition{ConditionLanguage, "de-ch"}, true},
+		{Condition{ConditionLanguage, "d"}, false},
+		{Condition{ConditionLanguage, "en"}, false},
+		{Condition{ConditionQuery, "env=staging"}, true},
+		{Condition{ConditionQuery, "env=production"}, false},
+		{Condition{ConditionQuery, "debug"}, true},
+		{Condition{ConditionQuery, "verbose"}, false},
+		{Condition{ConditionTime, "09:00-17:00"}, true},
+		{Condition{ConditionTime, "10:30-11:00"}, true},
+		{Condition{ConditionTime, "09:00-10:30"}, false},
+		{Condition{ConditionTime, "22:00-11:00"}, true},
+		{Condition{ConditionTime, "22:00-06:00"}, false},
+		{Condition{ConditionDay, "wed"}, true},
+		{Condition{ConditionDay, "mon-fri"}, true},
+		{Condition{ConditionDay, "fri-tue"}, false},
+		{Condition{ConditionDay, "sat-sun"}, false},
+		{Condition{ConditionWeek, "1/2"}, true},
+		{Condition{ConditionWeek, "0/2"}, false},
+		{Condition{ConditionWeek, "2/3"}, true},
+		{Condition{ConditionWeek, "1/4"}, true},
+	}
+	for _, test := range tests {
+		if matches, err := test.condition.Matches(request); err != nil || matches != test.want {
+			t.Errorf("Condition %s expected %t gotten %t - %v", &test.condition, test.want, matches, err)
+		}
+	}
+
+	// 2026 has an ISO week 53, the rota keeps alternating into 2027
+	rota := &Condition{ConditionWeek, "0/2"}
+	for day, want := range map[string]bool{"2026-12-21": true, "2026-12-28": false, "2027-01-03": false,
+		"2027-01-04": true, "2027-01-11": false} {
+		date, _ := time.Parse("2006-01-02", day)
+		if matches, _ := rota.Matches(&RuleRequest{Time: date}); matches != want {
+			t.Errorf("Condition %s on %s expected %t gotten %t", rota, day, want, matches)
+		}
+	}
+
+	link := &Link{URL: "https://example.com", Rules: []*Rule{
+		{Conditions: []*Condition{{ConditionDevice, "mobile"}, {ConditionLanguage, "fr"}}, URL: "https://m.example.fr"},
+		{Conditions: []*Condition{{ConditionDevice, "mobile"}}, URL: "https://m.example.com"},
+	}}
+	if rule := link.MatchRule(request); rule == nil || rule.URL != "https://m.example.com" {
+		t.Errorf("Expected the second rule to match gotten %v", rule)
+	}
+	if rule := link.MatchRule(&RuleRequest{UserAgent: "curl/7.64.1"}); rule != nil {
+		t.Errorf("Expected no rule to match curl gotten %v", rule)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  []*Rule
+		err   bool
+	}{
+		{"device:mobile https://m.example.com, lang:de&query:env=staging https://staging.example.de",
+			[]*Rule{
+				{Conditions: []*Condition{{ConditionDevice, "mobile"}}, URL: "https://m.example.com"},
+				{Conditions: []*Condition{{ConditionLanguage, "de"}, {ConditionQuery, "env=staging"}},
+					URL: "https://staging.example.de"},
+			}, false},
+		{"device:mobile", nil, true},
+		{"device:tablet https://m.example.com", nil, true},
+		{"mobile https://m.example.com", nil, true},
+		{"color:red https://red.example.com", nil, true},
+		{"time:9-17 https://work.example.com", nil, true},
+		{"day:monday https://work.example.com", nil, true},
+		{"week:3/3 https://oncall.example.com", nil, true},
+		{"ua: https://example.com", nil, true},
+	}
+	for _, test := range tests {
+		rules, err := ParseRules(test.value)
+		if (err != nil) != test.err || !reflect.DeepEqual(rules, test.want) {
+			t.Errorf("ParseRules(%s) expected %v gotten %v - %v", test.value, test.want, rules, err)
+		}
+	}
+	if rules, _ := ParseRules("day:mon-fri&time:09:00-17:00 https://work.example.com"); rules[0].String() !=
+		"day:mon-fri&time:09:00-17:00 https://work.example.com" {
+		t.Errorf("Expected the rule written back as parsed gotten %s", rules[0])
+	}
+}
+
+func TestNamespacedKey(t *testing.T) {
+	var tests = []struct {
+		namespace string
+		key       StorageKey
+		want      StorageKey
+	}{
+		{"", "docs", "docs"},
+		{"team", "docs", "team:docs"},
+		{"team", "docs/api", "team:docs/api"},
+		{"team", "team:docs", "team:docs"},
+		{"team", "ops:docs", "team:ops:docs"},
+	}
+	for _, test := range tests {
+		key := NamespacedKey(test.namespace, test.key)
+		if key != test.want {
+			t.Errorf("NamespacedKey(%s, %s) expected %s gotten %s", test.namespace, test.key, test.want, key)
+		}
+	}
+
+	namespaces := NewNamespaceSet("team", "ops")
+	var keys = []struct {
+		key  StorageKey
+		want string
+	}{
+		{"team:docs/api", "team"},
+		{"team:ops:docs", "team"},
+		{"docs/api", ""},
+		{"jira:123", ""},
+		{"teams:docs", ""},
+	}
+	for _, test := range keys {
+		if namespace := namespaces.KeyNamespace(test.key); namespace != test.want {
+			t.Errorf("KeyNamespace(%s) expected %q gotten %q", test.key, test.want, namespace)
+		}
+	}
+}
+
+func TestLinkEncoding(t *testing.T) {
+	link := &Link{URL: "https://github.com/kouzant/go-short", Creator: "antonis",
+		Description: "go-short repository", Tags: []string{"go", "code"}, Hits: 42,
+		CreatedAt: time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2019, 10, 2, 12, 0, 0, 0, time.UTC)}
+	encoded, err := encodeLink(link)
+	if err != nil {
+		t.Fatalf("encodeLink(%v) returned error %v", link, err)
+	}
+	if encoded[0] != linkEncodingV1 {
+		t.Errorf("Encoded link should start with version %d but starts with %d", linkEncodingV1, encoded[0])
+	}
+	decoded, err := decodeLink(encoded)
+	if err != nil {
+		t.Fatalf("decodeLink(%v) returned error %v", encoded, err)
+	}
+	if !reflect.DeepEqual(link, decoded) {
+		t.Errorf("Decoded link %v is different than %v", decoded, link)
+	}
+
+	_, err = decodeLink([]byte("https://github.com"))
+	if _, ok := err.(UnknownLinkEncoding); !ok {
+		t.Errorf("decodeLink of plain string expected %v gotten %v", UnknownLinkEncoding{}, err)
+	}
+}
+
+func TestBadgerLegacyMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_badger_state_store")
+	if err != nil {
+		t.Fatal("Error creating tmp directory for Badger")
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := map[string]string{"gs": "https://github.com/kouzant/go-short", "go": "https://golang.org"}
+	db, err := badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Could not open legacy Badger database %s", err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for key, url := range legacy {
+			if err := txn.Set([]byte(key), []byte(url)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not write legacy links %s", err)
+	}
+	db.Close()
+
+	stateStore := &BadgerStateStore{Config: createConfig(dir)}
+	if err = stateStore.Init(); err != nil {
+		t.Fatalf("stateStore.Init() on legacy database failed with %s", err)
+	}
+	defer stateStore.Close()
+
+	storedItems, err := stateStore.LoadAll()
+	if err != nil {
+		t.Fatalf("stateStore.LoadAll failed with %v", err)
+	}
+	if len(storedItems) != len(legacy) {
+		t.Errorf("Expected %d migrated links gotten %d", len(legacy), len(storedItems))
+	}
+	if items, err := stateStore.Search("golang", ""); err != nil || len(items) != 1 || items[0].Key != "go" {
+		t.Errorf("Expected migrated links to be indexed gotten %v - %v", items, err)
+	}
+	for key, url := range legacy {
+		link, err := stateStore.Load(StorageKey(key))
+		if err != nil {
+			t.Errorf("stateStore.Load(%s) after migration returned error %v", key, err)
+			continue
+		}
+		if link.URL != url || link.CreatedAt.IsZero() {
+			t.Errorf("Migrated link %s expected URL %s gotten %v", key, url, link)
+		}
+	}
+}
+
+func testHits(t *testing.T, stateStore StateStore) {
+	item := NewStorageItem("gs", "https://github.com/kouzant/go-short")
+	if err := stateStore.Save(item); err != nil {
+		t.Fatalf("stateStore.Save(%v) returned error %v", item, err)
+	}
+
+	today := time.Now().UTC()
+	yesterday := today.AddDate(0, 0, -1).Truncate(24 * time.Hour).Add(12 * time.Hour)
+	lastMonth := today.AddDate(0, -1, 0)
+	times := []time.Time{lastMonth, yesterday, yesterday.Add(time.Second), today}
+	for i, hitTime := range times {
+		event := &HitEvent{Key: item.Key, Time: hitTime, Referer: fmt.Sprintf("referer_%d", i),
+			UserAgent: "test", Status: 307}
+		if err := stateStore.RecordHit(event); err != nil {
+			t.Errorf("stateStore.RecordHit(%v) returned error %v", event, err)
+		}
+	}
+	if err := stateStore.RecordHit(&HitEvent{Key: "missing", Time: today, Status: 404}); err != nil {
+		t.Errorf("stateStore.RecordHit of missing key returned error %v", err)
+	}
+
+	link, err := stateStore.Load(item.Key)
+	if err != nil {
+		t.Fatalf("stateStore.Load(%v) returned error %v", item.Key, err)
+	}
+	if link.Hits != uint64(len(times)) {
+		t.Errorf("Expected link to have %d hits gotten %d", len(times), link.Hits)
+	}
+
+	dailyHits, err := stateStore.LoadDailyHits(item.Key, yesterday)
+	if err != nil {
+		t.Fatalf("stateStore.LoadDailyHits(%v) returned error %v", item.Key, err)
+	}
+	want := []*DailyHits{{HitDay(yesterday), 2}, {HitDay(today), 1}}
+	if !reflect.DeepEqual(dailyHits, want) {
+		t.Errorf("stateStore.LoadDailyHits(%v) expected %v gotten %v", item.Key, want, dailyHits)
+	}
+
+	events, err := stateStore.LoadHitEvents(item.Key, 2)
+	if err != nil {
+		t.Fatalf("stateStore.LoadHitEvents(%v) returned error %v", item.Key, err)
+	}
+	if len(events) != 2 || events[0].Referer != "referer_3" || events[1].Referer != "referer_2" {
+		t.Errorf("stateStore.LoadHitEvents(%v) expected the two most recent events gotten %v", item.Key, events)
+	}
+
+	// Daily counters are only kept for the retention period
+	stateStore.RecordHit(&HitEvent{Key: item.Key, Time: today.AddDate(-2, 0, 0), Status: 307})
+	if dailyHits, _ = stateStore.LoadDailyHits(item.Key, today.AddDate(-3, 0, 0)); len(dailyHits) != 3 {
+		t.Errorf("Expected the hits of two years ago not counted daily gotten %v", dailyHits)
+	}
+
+	// Hits of keys that are not stored would let anybody grow the store
+	missing, err := stateStore.LoadHitEvents("missing", 10)
+	if err != nil || len(missing) != 0 {
+		t.Errorf("stateStore.LoadHitEvents(missing) expected no events gotten %v - %v", missing, err)
+	}
+	if days, err := stateStore.LoadDailyHits("missing", lastMonth); err != nil || len(days) != 0 {
+		t.Errorf("stateStore.LoadDailyHits(missing) expected no hits gotten %v - %v", days, err)
+	}
+
+	// Responses other than redirects are kept as events without counting
+	stateStore.RecordHit(&HitEvent{Key: item.Key, Time: today, Referer: "gone", Status: 410})
+	if link, _ = stateStore.Load(item.Key); link.Hits != uint64(len(times)+1) {
+		t.Errorf("Expected the 410 response not counted as a hit gotten %d hits", link.Hits)
+	}
+	if events, _ = stateStore.LoadHitEvents(item.Key, 1); len(events) != 1 || events[0].Referer != "gone" {
+		t.Errorf("Expected the 410 response kept as an event gotten %v", events)
+	}
+}
+
+func testLongestPrefix(t *testing.T, stateStore StateStore) {
+	stateStore.SaveAll([]*StorageItem{
+		NewStorageItem("docs", "https://wiki.example.com/docs"),
+		NewStorageItem("docs/setup", "https://wiki.example.com/setup"),
+		NewStorageItem("doc", "https://wiki.example.com/doc"),
+	})
+
+	var tests = []struct {
+		key  StorageKey
+		want StorageKey
+	}{
+		{"docs", "docs"},
+		{"docs/", "docs"},
+		{"docs/setup", "docs/setup"},
+		{"docs/setup/linux", "docs/setup"},
+		{"docs/install/linux", "docs"},
+		{"docsx", ""},
+		{"missing/docs", ""},
+	}
+	for _, test := range tests {
+		match, err := stateStore.LoadLongestPrefix(test.key)
+		if test.want == "" {
+			if _, ok := err.(KeyNotFound); !ok {
+				t.Errorf("stateStore.LoadLongestPrefix(%s) expected %v gotten %v - %v", test.key, KeyNotFound{}, match, err)
+			}
+			continue
+		}
+		if err != nil || match.Prefix != test.want || match.Item.Key != test.want {
+			t.Errorf("stateStore.LoadLongestPrefix(%s) expected %s gotten %v - %v", test.key, test.want, match, err)
+		}
+	}
+}
+
+func testUpdate(t *testing.T, stateStore StateStore) {
+	err := stateStore.Update(NewStorageItem("gs", "https://github.com"))
+	if _, ok := err.(KeyNotFound); !ok {
+		t.Errorf("stateStore.Update of missing key expected %v gotten %v", KeyNotFound{}, err)
+	}
+
+	created, err := stateStore.Upsert(NewStorageItem("gs", "https://github.com"))
+	if err != nil || !created {
+		t.Fatalf("stateStore.Upsert of new key expected to create it gotten %t - %v", created, err)
+	}
+	original, _ := stateStore.Load("gs")
+	created, err = stateStore.Upsert(NewStorageItem("gs", "https://github.com/kouzant"))
+	if err != nil || created {
+		t.Errorf("stateStore.Upsert of existing key expected to replace it gotten %t - %v", created, err)
+	}
+
+	item := NewStorageItem("gs", "https://github.com/kouzant/go-short")
+	item.Value.Description = "go-short repository"
+	if err = stateStore.Update(item); err != nil {
+		t.Fatalf("stateStore.Update(%v) returned error %v", item, err)
+	}
+	link, err := stateStore.Load("gs")
+	if err != nil || link.URL != "https://github.com/kouzant/go-short" || link.Description != "go-short repository" {
+		t.Errorf("Expected updated link gotten %v - %v", link, err)
+	}
+	if !link.CreatedAt.Equal(original.CreatedAt) || link.UpdatedAt.Before(original.UpdatedAt) {
+		t.Errorf("Expected update to keep creation time %v gotten %v", original, link)
+	}
+}
+
+func testRename(t *testing.T, stateStore StateStore) {
+	stateStore.SaveAll([]*StorageItem{
+		NewStorageItem("gs", "https://github.com/kouzant/go-short"),
+		NewStorageItem("go", "https://golang.org"),
+	})
+	now := time.Now()
+	stateStore.RecordHit(&HitEvent{Key: "gs", Time: now, Status: 307})
+
+	var tests = []struct {
+		from StorageKey
+		to   StorageKey
+		err  error
+	}{
+		{"missing", "other", KeyNotFound{Key: "missing"}},
+		{"gs", "go", KeyAlreadyExists{Key: "go"}},
+		{"gs", "go-short", nil},
+	}
+	for _, test := range tests {
+		if err := stateStore.Rename(test.from, test.to, "antonis"); err != test.err {
+			t.Errorf("stateStore.Rename(%s, %s) expected %v gotten %v", test.from, test.to, test.err, err)
+		}
+	}
+
+	if _, err := stateStore.Load("gs"); err == nil {
+		t.Errorf("Expected gs to be gone after rename")
+	}
+	link, err := stateStore.Load("go-short")
+	if err != nil || link.URL != "https://github.com/kouzant/go-short" || link.Hits != 1 {
+		t.Errorf("Expected renamed link with one hit gotten %v - %v", link, err)
+	}
+	dailyHits, _ := stateStore.LoadDailyHits("go-short", now)
+	events, _ := stateStore.LoadHitEvents("go-short", 10)
+	if len(dailyHits) != 1 || dailyHits[0].Count != 1 || len(events) != 1 {
+		t.Errorf("Expected hits to follow the renamed link gotten %v and %v", dailyHits, events)
+	}
+	dailyHits, _ = stateStore.LoadDailyHits("gs", now)
+	events, _ = stateStore.LoadHitEvents("gs", 10)
+	if len(dailyHits) != 0 || len(events) != 0 {
+		t.Errorf("Expected no hits left for gs gotten %v and %v", dailyHits, events)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, stateStore StateStore) {
+	stateStore.Save(NewStorageItem("gs", "https://github.com"))
+	stateStore.SaveAll([]*StorageItem{NewStorageItem("gs", "https://github.com/kouzant")})
+	stateStore.RecordHit(&HitEvent{Key: "gs", Time: time.Now(), Status: 307})
+	link, _ := stateStore.Load("gs")
+	if link.Revision != 2 {
+		t.Errorf("Expected revision 2 after two writes and a hit gotten %d", link.Revision)
+	}
+
+	var tests = []struct {
+		key      StorageKey
+		revision uint64
+		url      string
+		err      error
+	}{
+		{"missing", 1, "https://github.com", KeyNotFound{Key: "missing"}},
+		{"gs", 1, "https://github.com", RevisionMismatch{Key: "gs", Expected: 1, Actual: 2}},
+		{"gs", 2, "https://github.com/kouzant/go-short", nil},
+		{"gs", 2, "https://golang.org", RevisionMismatch{Key: "gs", Expected: 2, Actual: 3}},
+	}
+	for _, test := range tests {
+		link := NewLink(test.url)
+		if err := stateStore.CompareAndSwap(test.key, test.revision, link); err != test.err {
+			t.Errorf("stateStore.CompareAndSwap(%s, %d, %s) expected %v gotten %v", test.key, test.revision,
+				test.url, test.err, err)
+		}
+		if test.err == nil {
+			stored, _ := stateStore.Load(test.key)
+			if stored.URL != test.url || stored.Revision != test.revision+1 {
+				t.Errorf("Expected %s at revision %d gotten %v", test.url, test.revision+1, stored)
+			}
+		}
+	}
+
+	var deletes = []struct {
+		revision uint64
+		err      error
+	}{
+		{2, RevisionMismatch{Key: "gs", Expected: 2, Actual: 3}},
+		{3, nil},
+		{4, KeyNotFound{Key: "gs"}},
+	}
+	for _, test := range deletes {
+		if err := stateStore.CompareAndDelete("gs", test.revision, "antonis"); err != test.err {
+			t.Errorf("stateStore.CompareAndDelete(gs, %d) expected %v gotten %v", test.revision, test.err, err)
+		}
+	}
+}
+
+func testHistory(t *testing.T, stateStore StateStore) {
+	item := NewStorageItem("gs", "https://github.com")
+	item.Value.UpdatedBy = "antonis"
+	stateStore.Save(item)
+	item = NewStorageItem("gs", "https://github.com/kouzant/go-short")
+	item.Value.UpdatedBy = "other"
+	stateStore.Update(item)
+	batch := NewStorageItem("go", "https://golang.org")
+	stateStore.SaveAll([]*StorageItem{batch})
+	stateStore.Rename("gs", "go-short", "antonis")
+	stateStore.Delete("go-short", "other")
+
+	history, err := stateStore.LoadHistory("go-short", 10)
+	if err != nil {
+		t.Fatalf("stateStore.LoadHistory returned error %v", err)
+	}
+	var want = []struct {
+		action   RevisionAction
+		actor    string
+		revision uint64
+		old      string
+		new      string
+	}{
+		{ActionDelete, "other", 3, "https://github.com/kouzant/go-short", ""},
+		{ActionRename, "antonis", 3, "https://github.com/kouzant/go-short", "https://github.com/kouzant/go-short"},
+		{ActionUpdate, "other", 2, "https://github.com", "https://github.com/kouzant/go-short"},
+		{ActionCreate, "antonis", 1, "", "https://github.com"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("Expected %d revisions gotten %d", len(want), len(history))
+	}
+	for i, w := range want {
+		revision := history[i]
+		if revision.Action != w.action || revision.Actor != w.actor || revision.Revision() != w.revision {
+			t.Errorf("Expected revision %d %s by %s gotten %d %s by %s", w.revision, w.action, w.actor,
+				revision.Revision(), revision.Action, revision.Actor)
+		}
+		if (w.old == "") != (revision.Old == nil) || (revision.Old != nil && revision.Old.URL != w.old) {
+			t.Errorf("Expected old value %s of %s gotten %v", w.old, w.action, revision.Old)
+		}
+		if (w.new == "") != (revision.New == nil) || (revision.New != nil && revision.New.URL != w.new) {
+			t.Errorf("Expected new value %s of %s gotten %v", w.new, w.action, revision.New)
+		}
+	}
+	if history[1].From != "gs" {
+		t.Errorf("Expected rename from gs gotten %s", history[1].From)
+	}
+
+	if history, _ = stateStore.LoadHistory("gs", 10); len(history) != 0 {
+		t.Errorf("Expected history of gs to move along gotten %d revisions", len(history))
+	}
+	if history, _ = stateStore.LoadHistory("go", 1); len(history) != 1 || history[0].Action != ActionCreate {
+		t.Errorf("Expected batch to record a creation gotten %v", history)
+	}
+}
+
+func testTrash(t *testing.T, stateStore StateStore) {
+	stateStore.Save(NewStorageItem("gs", "https://github.com/kouzant/go-short"))
+	stateStore.Save(NewStorageItem("go", "https://golang.org"))
+	stateStore.Delete("gs", "antonis")
+
+	trash, err := stateStore.LoadTrash()
+	if err != nil || len(trash) != 1 || trash[0].Key != "gs" || trash[0].DeletedBy != "antonis" ||
+		trash[0].Link.URL != "https://github.com/kouzant/go-short" {
+		t.Fatalf("Expected gs in the trash gotten %v - %v", trash, err)
+	}
+	if _, err = stateStore.Restore("go", "antonis"); err != (KeyNotFound{Key: "go"}) {
+		t.Errorf("Restoring a link that is not in the trash expected %v gotten %v", KeyNotFound{Key: "go"}, err)
+	}
+	link, err := stateStore.Restore("gs", "other")
+	if err != nil || link.URL != "https://github.com/kouzant/go-short" || link.Revision != 2 {
+		t.Errorf("Expected gs restored at revision 2 gotten %v - %v", link, err)
+	}
+	if trash, _ = stateStore.LoadTrash(); len(trash) != 0 {
+		t.Errorf("Expected empty trash after restoring gotten %v", trash)
+	}
+	history, _ := stateStore.LoadHistory("gs", 1)
+	if len(history) != 1 || history[0].Action != ActionRestore || history[0].Actor != "other" {
+		t.Errorf("Expected restore by other in the history gotten %v", history)
+	}
+
+	stateStore.Delete("gs", "antonis")
+	stateStore.Save(NewStorageItem("gs", "https://github.com"))
+	if _, err = stateStore.Restore("gs", "antonis"); err != (KeyAlreadyExists{Key: "gs"}) {
+		t.Errorf("Restoring a taken key expected %v gotten %v", KeyAlreadyExists{Key: "gs"}, err)
+	}
+
+	stateStore.RecordHit(&HitEvent{Key: "go", Time: time.Now(), Status: 307})
+	stateStore.RecordHit(&HitEvent{Key: "gs", Time: time.Now(), Status: 307})
+	stateStore.Delete("go", "antonis")
+	purged, err := stateStore.PurgeTrash(time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Errorf("Expected nothing purged before the retention period gotten %d - %v", purged, err)
+	}
+	purged, err = stateStore.PurgeTrash(time.Now().Add(time.Second))
+	if err != nil || purged != 2 {
+		t.Errorf("Expected 2 links purged gotten %d - %v", purged, err)
+	}
+	if trash, _ = stateStore.LoadTrash(); len(trash) != 0 {
+		t.Errorf("Expected empty trash after purging gotten %v", trash)
+	}
+	// The hits of a purged link go with it, those of a new link with the same key stay
+	events, _ := stateStore.LoadHitEvents("go", 10)
+	days, _ := stateStore.LoadDailyHits("go", time.Now().AddDate(0, 0, -1))
+	if len(events) != 0 || len(days) != 0 {
+		t.Errorf("Expected the hits of purged go removed gotten %v and %v", events, days)
+	}
+	if events, _ = stateStore.LoadHitEvents("gs", 10); len(events) != 1 {
+		t.Errorf("Expected the hit of the new gs kept gotten %v", events)
+	}
+}
+
+func testExpiry(t *testing.T, stateStore StateStore) {
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+	longExpired := now.Add(-30 * 24 * time.Hour)
+	notBefore := now.Add(time.Hour)
+	stateStore.Save(&StorageItem{"gs", &Link{URL: "https://github.com/kouzant/go-short", ExpiresAt: &expired}})
+	stateStore.Save(&StorageItem{"go", &Link{URL: "https://golang.org", ExpiresAt: &longExpired}})
+	stateStore.Save(&StorageItem{"gh", &Link{URL: "https://github.com", NotBefore: &notBefore}})
+
+	// Expired links are kept for a while so that they can answer with Gone
+	link, err := stateStore.Load("gs")
+	if err != nil || !link.ExpiresAt.Equal(expired) || !link.IsExpired(now) {
+		t.Errorf("Expected expired gs to be kept gotten %v - %v", link, err)
+	}
+	if link, err = stateStore.Load("go"); err != (KeyNotFound{Key: "go"}) {
+		t.Errorf("Expected go to be removed after the expired retention gotten %v - %v", link, err)
+	}
+	link, err = stateStore.Load("gh")
+	if err != nil || link.IsActive(now) || !link.IsActive(notBefore) {
+		t.Errorf("Expected gh to be active from %v gotten %v - %v", notBefore, link, err)
+	}
+
+	if err = stateStore.RecordHit(&HitEvent{Key: "gs", Time: now, Status: 307}); err != nil {
+		t.Errorf("Recording a hit on expired gs returned error %v", err)
+	}
+	if link, err = stateStore.Load("gs"); err != nil || link.Hits != 1 || !link.ExpiresAt.Equal(expired) {
+		t.Errorf("Expected expired gs with one hit gotten %v - %v", link, err)
+	}
+}
+
+func testConsumeUse(t *testing.T, stateStore StateStore) {
+	stateStore.Save(&StorageItem{"gs", &Link{URL: "https://github.com/kouzant/go-short", MaxUses: 2}})
+
+	link, err := stateStore.ConsumeUse("gs")
+	if err != nil || link.Uses != 1 || link.Revision != 1 {
+		t.Errorf("Expected first use of gs at revision 1 gotten %v - %v", link, err)
+	}
+	// Uses are counted by the state store, so updating does not reset them
+	link.URL = "https://github.com"
+	link.Uses = 0
+	stateStore.Update(&StorageItem{"gs", link})
+	if link, err = stateStore.ConsumeUse("gs"); err != nil || link.Uses != 2 || link.URL != "https://github.com" {
+		t.Errorf("Expected second use of gs gotten %v - %v", link, err)
+	}
+	if link, err = stateStore.ConsumeUse("gs"); err != (UsesExhausted{Key: "gs", MaxUses: 2}) {
+		t.Errorf("Expected gs to be used up gotten %v - %v", link, err)
+	}
+	if link, _ = stateStore.Load("gs"); !link.IsUsedUp() || link.IsActive(time.Now()) {
+		t.Errorf("Expected gs to be inactive once used up gotten %v", link)
+	}
+	if _, err = stateStore.ConsumeUse("go"); err != (KeyNotFound{Key: "go"}) {
+		t.Errorf("Using a missing key expected %v gotten %v", KeyNotFound{Key: "go"}, err)
+	}
+}
+
+func testSearch(t *testing.T, stateStore StateStore) {
+	stateStore.Save(&StorageItem{"gs", &Link{URL: "https://github.com/kouzant/go-short",
+		Description: "Go URL shortener", Tags: []string{"Code", "go"}}})
+	stateStore.Save(&StorageItem{"docs/api", &Link{URL: "https://golang.org/pkg", Tags: []string{"docs"}}})
+	stateStore.Save(&StorageItem{"wiki", &Link{URL: "https://wiki.example.com", Description: "Team wiki"}})
+
+	var tests = []struct {
+		query string
+		tag   string
+		want  []StorageKey
+	}{
+		{"shortener", "", []StorageKey{"gs"}},
+		{"GOLANG", "", []StorageKey{"docs/api"}},
+		{"go", "", []StorageKey{"docs/api", "gs"}},
+		{"api", "", []StorageKey{"docs/api"}},
+		{"kouz short", "", []StorageKey{"gs"}},
+		{"team github", "", []StorageKey{}},
+		{"", "code", []StorageKey{"gs"}},
+		{"", "cod", []StorageKey{}},
+		{"https", "docs", []StorageKey{"docs/api"}},
+		{"", "", []StorageKey{"docs/api", "gs", "wiki"}},
+	}
+	for _, test := range tests {
+		items, err := stateStore.Search(test.query, test.tag)
+		keys := make([]StorageKey, 0, len(items))
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		if err != nil || !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("Search(%q, %q) expected %v gotten %v - %v", test.query, test.tag, test.want, keys, err)
+		}
+	}
+
+	// The index follows changes of the links
+	link, _ := stateStore.Load("gs")
+	link.Description = "Link shortener"
+	link.Tags = nil
+	stateStore.Update(&StorageItem{"gs", link})
+	stateStore.Rename("wiki", "handbook", "antonis")
+	stateStore.Delete("docs/api", "antonis")
+	tests = []struct {
+		query string
+		tag   string
+		want  []StorageKey
+	}{
+		{"link", "", []StorageKey{"gs"}},
+		{"go", "", []StorageKey{"gs"}},
+		{"", "code", []StorageKey{}},
+		{"golang", "", []StorageKey{}},
+		{"wiki", "", []StorageKey{"handbook"}},
+		{"handbook", "", []StorageKey{"handbook"}},
+	}
+	for _, test := range tests {
+		items, err := stateStore.Search(test.query, test.tag)
+		keys := make([]StorageKey, 0, len(items))
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		if err != nil || !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("Search(%q, %q) after changes expected %v gotten %v - %v", test.query, test.tag, test.want,
+				keys, err)
+		}
+	}
+	stateStore.Restore("docs/api", "antonis")
+	if items, _ := stateStore.Search("golang", ""); len(items) != 1 || items[0].Key != "docs/api" {
+		t.Errorf("Expected restored docs/api to be found gotten %v", items)
+	}
+}
+
+func testPagination(t *testing.T, stateStore StateStore) {
+	created := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	// Created one day apart in reverse key order, with as many hits as their position
+	keys := []StorageKey{"a", "b", "c", "d", "e"}
+	for i, key := range keys {
+		stateStore.Save(&StorageItem{key, &Link{URL: "https://example.com/" + string(key),
+			CreatedAt: created.AddDate(0, 0, -i)}})
+		for hit := 0; hit < i%3; hit++ {
+			stateStore.RecordHit(&HitEvent{Key: key, Time: created, Status: 307})
+		}
+	}
+
+	var tests = []struct {
+		sort SortOrder
+		want []StorageKey
+	}{
+		{SortByKey, []StorageKey{"a", "b", "c", "d", "e"}},
+		{SortByCreated, []StorageKey{"a", "b", "c", "d", "e"}},
+		{SortByHits, []StorageKey{"c", "b", "e", "a", "d"}},
+	}
+	for _, test := range tests {
+		listed := make([]StorageKey, 0)
+		options := &ListOptions{Limit: 2, Sort: test.sort}
+		for pages := 0; pages < 10; pages++ {
+			page, err := stateStore.LoadPage(options)
+			if err != nil {
+				t.Fatalf("LoadPage(%v) returned error %v", options, err)
+			}
+			if len(page.Items) > 2 {
+				t.Errorf("LoadPage(%v) returned %d items", options, len(page.Items))
+			}
+			for _, item := range page.Items {
+				listed = append(listed, item.Key)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			options.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(listed, test.want) {
+			t.Errorf("Pages sorted by %s expected %v gotten %v", test.sort, test.want, listed)
+		}
+	}
+
+	page, err := stateStore.LoadPage(&ListOptions{Limit: 5, Sort: SortByKey})
+	if err != nil || len(page.Items) != 5 || page.NextCursor != "" {
+		t.Errorf("Expected a single page of 5 items gotten %v - %v", page, err)
+	}
+	if _, err = stateStore.LoadPage(&ListOptions{Cursor: "%%%", Limit: 2, Sort: SortByKey}); err != (InvalidCursor{"%%%"}) {
+		t.Errorf("Expected %v gotten %v", InvalidCursor{"%%%"}, err)
+	}
+
+	streamed := make([]StorageKey, 0)
+	err = stateStore.Iterate("b", func(item *StorageItem) bool {
+		streamed = append(streamed, item.Key)
+		return len(streamed) < 3
+	})
+	if err != nil || !reflect.DeepEqual(streamed, []StorageKey{"b", "c", "d"}) {
+		t.Errorf("Expected to stream b, c, d gotten %v - %v", streamed, err)
+	}
+}
+
+func testNamespaces(t *testing.T, stateStore StateStore) {
+	keys := []StorageKey{"docs", "jira:123", "ops:docs", "team:docs", "team:wiki", "team:zoo", "zoo"}
+	for _, key := range keys {
+		stateStore.Save(&StorageItem{key, NewLink("https://example.com/" + string(key))})
+	}
+
+	var tests = []struct {
+		namespace string
+		want      []StorageKey
+	}{
+		// jira is not a namespace
+		{"", []StorageKey{"docs", "jira:123", "zoo"}},
+		{"team", []StorageKey{"team:docs", "team:wiki", "team:zoo"}},
+		{"ops", []StorageKey{"ops:docs"}},
+		{"infra", []StorageKey{}},
+	}
+	for _, test := range tests {
+		listed := make([]StorageKey, 0)
+		options := &ListOptions{Limit: 2, Sort: SortByKey, Namespace: test.namespace,
+			Namespaces: NewNamespaceSet("team", "ops", "infra")}
+		for pages := 0; pages < 10; pages++ {
+			page, err := stateStore.LoadPage(options)
+			if err != nil {
+				t.Fatalf("LoadPage(%v) returned error %v", options, err)
+			}
+			for _, item := range page.Items {
+				listed = append(listed, item.Key)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			options.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(listed, test.want) {
+			t.Errorf("Pages of namespace %q expected %v gotten %v", test.namespace, test.want, listed)
+		}
+	}
+
+	page, err := stateStore.LoadPage(&ListOptions{Limit: 10, Sort: SortByCreated, Namespace: "team"})
+	if err != nil || len(page.Items) != 3 {
+		t.Errorf("Expected the 3 links of namespace team gotten %v - %v", page, err)
+	}
+}
+
+func testAliases(t *testing.T, stateStore StateStore) {
+	stateStore.SaveAll([]*StorageItem{
+		NewStorageItem("kubernetes", "https://kubernetes.io"),
+		NewStorageItem("gs", "https://github.com/kouzant/go-short"),
+	})
+
+	var saves = []struct {
+		key    StorageKey
+		target StorageKey
+		err    error
+	}{
+		{"k8s", "kubernetes", nil},
+		{"kube", "k8s", nil},
+		{"gs", "kubernetes", KeyAlreadyExists{Key: "gs"}},
+		{"missing", "nowhere", KeyNotFound{Key: "nowhere"}},
+		{"k8s", "kube", AliasCycle{Key: "k8s"}},
+		{"loop", "loop", AliasCycle{Key: "loop"}},
+	}
+	for _, test := range saves {
+		alias := &Alias{Key: test.key, Target: test.target, CreatedAt: time.Now()}
+		if err := stateStore.SaveAlias(alias); !reflect.DeepEqual(err, test.err) {
+			t.Errorf("stateStore.SaveAlias(%s -> %s) expected %v gotten %v", test.key, test.target, test.err, err)
+		}
+	}
+	if err := stateStore.Save(NewStorageItem("k8s", "https://k8s.io")); err != (KeyAlreadyExists{Key: "k8s"}) {
+		t.Errorf("stateStore.Save of alias key expected %v gotten %v", KeyAlreadyExists{Key: "k8s"}, err)
+	}
+	batch := []*StorageItem{NewStorageItem("helm", "https://helm.sh"), NewStorageItem("k8s", "https://k8s.io")}
+	if err := stateStore.SaveAll(batch); err != (KeyAlreadyExists{Key: "k8s"}) {
+		t.Errorf("stateStore.SaveAll of alias key expected %v gotten %v", KeyAlreadyExists{Key: "k8s"}, err)
+	}
+	if _, err := stateStore.Load("helm"); err == nil {
+		t.Errorf("Expected no link of the failed batch saved")
+	}
+
+	match, err := stateStore.LoadLongestPrefix("kube/docs")
+	if err != nil || match.Prefix != "kube" || match.Item.Key != "kubernetes" {
+		t.Errorf("stateStore.LoadLongestPrefix(kube/docs) expected kube of kubernetes gotten %v - %v", match, err)
+	}
+	aliases, err := stateStore.LoadAllAliases()
+	if groups := GroupAliases(aliases); err != nil ||
+		!reflect.DeepEqual(groups, map[StorageKey][]StorageKey{"kubernetes": {"k8s", "kube"}}) {
+		t.Errorf("GroupAliases expected k8s and kube under kubernetes gotten %v - %v", groups, err)
+	}
+
+	_, err = stateStore.Delete("kubernetes", "antonis")
+	if !reflect.DeepEqual(err, HasAliases{Key: "kubernetes", Aliases: []StorageKey{"k8s", "kube"}}) {
+		t.Errorf("stateStore.Delete of aliased key expected %v gotten %v", HasAliases{}, err)
+	}
+	if err = stateStore.Rename("kubernetes", "k8s-docs", "antonis"); err != nil {
+		t.Fatalf("stateStore.Rename of aliased key returned error %v", err)
+	}
+	if alias, err := stateStore.LoadAlias("k8s"); err != nil || alias.Target != "k8s-docs" {
+		t.Errorf("Expected alias k8s to follow the rename gotten %v - %v", alias, err)
+	}
+
+	if _, err = stateStore.DeleteAlias("k8s"); err != nil {
+		t.Fatalf("stateStore.DeleteAlias(k8s) returned error %v", err)
+	}
+	if alias, err := stateStore.LoadAlias("kube"); err != nil || alias.Target != "k8s-docs" {
+		t.Errorf("Expected alias kube to point to k8s-docs gotten %v - %v", alias, err)
+	}
+	if _, err = stateStore.DeleteAlias("k8s"); err != (KeyNotFound{Key: "k8s"}) {
+		t.Errorf("stateStore.DeleteAlias of missing alias expected %v gotten %v", KeyNotFound{Key: "k8s"}, err)
+	}
+
+	deleted, removed, err := stateStore.DeleteWithAliases("k8s-docs", "antonis")
+	if err != nil || deleted.URL != "https://kubernetes.io" || !reflect.DeepEqual(removed, []StorageKey{"kube"}) {
+		t.Errorf("stateStore.DeleteWithAliases expected kube deleted gotten %v %v - %v", deleted, removed, err)
+	}
+	if aliases, err = stateStore.LoadAllAliases(); err != nil || len(aliases) != 0 {
+		t.Errorf("Expected no aliases left gotten %v - %v", aliases, err)
+	}
+}
+
+func testKeyNormalization(t *testing.T, stateStore StateStore) {
+	if err := stateStore.Save(NewStorageItem("Docs/", "https://docs.example.com")); err != nil {
+		t.Fatalf("stateStore.Save(Docs/) returned error %v", err)
+	}
+	if err := stateStore.Save(NewStorageItem("docs", "https://other.example.com")); err != (KeyAlreadyExists{Key: "docs"}) {
+		t.Errorf("stateStore.Save(docs) expected %v gotten %v", KeyAlreadyExists{Key: "docs"}, err)
+	}
+	stateStore.Save(NewStorageItem("my_wiki", "https://wiki.example.com"))
+
+	for _, key := range []StorageKey{"docs", "DOCS", "docs/", "My-Wiki", "my_wiki"} {
+		if _, err := stateStore.Load(key); err != nil {
+			t.Errorf("stateStore.Load(%s) returned error %v", key, err)
+		}
+	}
+	match, err := stateStore.LoadLongestPrefix("Docs/Setup")
+	if err != nil || match.Prefix != "Docs" || match.Item.Key != "docs" {
+		t.Errorf("stateStore.LoadLongestPrefix(Docs/Setup) expected Docs of docs gotten %v - %v", match, err)
+	}
+	if deleted, err := stateStore.Delete("MY_WIKI", "antonis"); err != nil || deleted == nil {
+		t.Errorf("stateStore.Delete(MY_WIKI) expected my-wiki deleted gotten %v - %v", deleted, err)
+	}
+	if _, err = stateStore.Load("my-wiki"); err != (KeyNotFound{Key: "my-wiki"}) {
+		t.Errorf("stateStore.Load(my-wiki) expected %v gotten %v", KeyNotFound{Key: "my-wiki"}, err)
+	}
+}
+
+func testMigrateKeys(t *testing.T, stateStore StateStore) {
+	expected := &KeyMigration{
+		Renamed:    map[StorageKey]StorageKey{"Docs": "docs", "K8s": "k8s"},
+		Collisions: map[StorageKey][]StorageKey{"my-wiki": {"My-Wiki", "my_wiki"}},
+	}
+	migration, err := stateStore.MigrateKeys(false)
+	if err != nil || !reflect.DeepEqual(migration, expected) {
+		t.Errorf("stateStore.MigrateKeys(false) expected %v gotten %v - %v", expected, migration, err)
+	}
+	if _, err = stateStore.Load("Docs"); err == nil {
+		t.Errorf("Expected Docs to stay where it was without apply")
+	}
+
+	expected.Applied = true
+	migration, err = stateStore.MigrateKeys(true)
+	if err != nil || !reflect.DeepEqual(migration, expected) {
+		t.Errorf("stateStore.MigrateKeys(true) expected %v gotten %v - %v", expected, migration, err)
+	}
+	if link, err := stateStore.Load("DOCS"); err != nil || link.URL != "https://docs.example.com" {
+		t.Errorf("stateStore.Load(DOCS) after migration expected docs gotten %v - %v", link, err)
+	}
+	if alias, err := stateStore.LoadAlias("K8S"); err != nil || alias.Target != "docs" {
+		t.Errorf("stateStore.LoadAlias(K8S) after migration expected docs gotten %v - %v", alias, err)
+	}
+	if migration, err = stateStore.MigrateKeys(false); err != nil || len(migration.Renamed) != 0 {
+		t.Errorf("Expected nothing left to rename gotten %v - %v", migration, err)
+	}
+}
+
+// Links and aliases stored before normalization was enabled
+func saveUnnormalizedKeys(stateStore StateStore) {
+	stateStore.SaveAll([]*StorageItem{
+		NewStorageItem("Docs", "https://docs.example.com"),
+		NewStorageItem("My-Wiki", "https://wiki.example.com"),
+		NewStorageItem("my_wiki", "https://other-wiki.example.com"),
+		NewStorageItem("gs", "https://github.com/kouzant/go-short"),
+	})
+	stateStore.SaveAlias(&Alias{Key: "K8s", Target: "Docs", CreatedAt: time.Now()})
+}
+
+func testSplitLinks(t *testing.T, stateStore StateStore) {
+	item := NewStorageItem("wiki", "")
+	item.Value.SetDestinations([]*Destination{{URL: "https://old.example.com", Weight: 90},
+		{URL: "https://new.example.com", Weight: 10}})
+	if err := stateStore.Save(item); err != nil {
+		t.Fatalf("stateStore.Save(wiki) returned error %v", err)
+	}
+	now := time.Now()
+	for _, destination := range []string{"https://old.example.com", "https://new.example.com", "https://new.example.com"} {
+		stateStore.RecordHit(&HitEvent{Key: "wiki", Time: now, Status: 307, Destination: destination})
+	}
+	link, err := stateStore.Load("wiki")
+	if err != nil || link.URL != "https://old.example.com" || link.Hits != 3 ||
+		link.Destinations[0].Hits != 1 || link.Destinations[1].Hits != 2 {
+		t.Fatalf("Expected 1 hit of old and 2 of new gotten %v - %v", link, err)
+	}
+	events, _ := stateStore.LoadHitEvents("wiki", 1)
+	if len(events) != 1 || events[0].Destination != "https://new.example.com" {
+		t.Errorf("Expected the destination recorded with the hit gotten %v", events)
+	}
+
+	// Kept destinations keep their hits
+	link.SetDestinations([]*Destination{{URL: "https://new.example.com", Weight: 50, Hits: 100},
+		{URL: "https://newer.example.com", Weight: 50}})
+	if err = stateStore.Update(&StorageItem{Key: "wiki", Value: link}); err != nil {
+		t.Fatalf("stateStore.Update(wiki) returned error %v", err)
+	}
+	link, _ = stateStore.Load("wiki")
+	if link.URL != "https://new.example.com" || link.Destinations[0].Hits != 2 || link.Destinations[1].Hits != 0 {
+		t.Errorf("Expected new to keep its 2 hits gotten %v", link.Destinations)
+	}
+}
+
+func testTokens(t *testing.T, stateStore StateStore) {
+	token := &Token{Name: "antonis", Hash: "hash_0", CreatedAt: time.Now()}
+	if err := stateStore.SaveToken(token); err != nil {
+		t.Fatalf("stateStore.SaveToken(%v) returned error %v", token, err)
+	}
+	duplicate := &Token{Name: "antonis", Hash: "hash_1", CreatedAt: time.Now()}
+	if err := stateStore.SaveToken(duplicate); err != (TokenAlreadyExists{Name: "antonis"}) {
+		t.Errorf("stateStore.SaveToken(%v) expected %v gotten %v", duplicate, TokenAlreadyExists{}, err)
+	}
+	// Names are only unique within a namespace
+	team := &Token{Name: "antonis", Hash: "hash_2", CreatedAt: time.Now(), Namespace: "team"}
+	if err := stateStore.SaveToken(team); err != nil {
+		t.Errorf("stateStore.SaveToken(%v) returned error %v", team, err)
+	}
+	duplicate = &Token{Name: "antonis", Hash: "hash_3", CreatedAt: time.Now(), Namespace: "team"}
+	if err := stateStore.SaveToken(duplicate); err != (TokenAlreadyExists{Name: "antonis", Namespace: "team"}) {
+		t.Errorf("stateStore.SaveToken(%v) expected %v gotten %v", duplicate, TokenAlreadyExists{}, err)
+	}
+
+	loaded, err := stateStore.LoadTokenByHash("hash_0")
+	if err != nil || loaded.Name != "antonis" {
+		t.Errorf("stateStore.LoadTokenByHash(hash_0) expected antonis gotten %v - %v", loaded, err)
+	}
+	if _, err = stateStore.LoadTokenByHash("hash_1"); err == nil {
+		t.Errorf("stateStore.LoadTokenByHash(hash_1) expected %v", TokenNotFound{})
+	}
+	tokens, err := stateStore.LoadAllTokens()
+	if err != nil || len(tokens) != 2 {
+		t.Errorf("stateStore.LoadAllTokens() expected two tokens gotten %v - %v", tokens, err)
+	}
+
+	if _, err = stateStore.DeleteToken("", "antonis"); err != nil {
+		t.Errorf("stateStore.DeleteToken(antonis) returned error %v", err)
+	}
+	if _, err = stateStore.LoadTokenByHash("hash_0"); err == nil {
+		t.Errorf("stateStore.LoadTokenByHash(hash_0) after delete expected %v", TokenNotFound{})
+	}
+	if _, err = stateStore.LoadTokenByHash("hash_2"); err != nil {
+		t.Errorf("Expected antonis of team kept after deleting the global antonis gotten %v", err)
+	}
+	if _, err = stateStore.DeleteToken("", "antonis"); err != (TokenNotFound{Name: "antonis"}) {
+		t.Errorf("stateStore.DeleteToken(antonis) twice expected %v gotten %v", TokenNotFound{}, err)
+	}
+	if deleted, err := stateStore.DeleteToken("team", "antonis"); err != nil || deleted.Hash != "hash_2" {
+		t.Errorf("stateStore.DeleteToken(team, antonis) expected hash_2 gotten %v - %v", deleted, err)
+	}
+}
+
+func testLinkRecord(t *testing.T, stateStore StateStore) {
+	item := &StorageItem{Key: "gs", Value: &Link{URL: "https://github.com/kouzant/go-short",
+		Creator: "antonis", Description: "go-short repository", Tags: []string{"go"}}}
+	if err := stateStore.Save(item); err != nil {
+		t.Fatalf("stateStore.Save(%v) returned error %v", item, err)
+	}
+	link, err := stateStore.Load(item.Key)
+	if err != nil {
+		t.Fatalf("stateStore.Load(%v) returned error %v", item.Key, err)
+	}
+	if link.CreatedAt.IsZero() || link.UpdatedAt.IsZero() {
+		t.Errorf("Saved link %v is missing timestamps", link)
+	}
+	if link.Creator != "antonis" || link.Description != "go-short repository" ||
+		!reflect.DeepEqual(link.Tags, []string{"go"}) {
+		t.Errorf("Loaded link %v is different than %v", link, item.Value)
+	}
+
+	link.Tags[0] = "modified"
+	reloaded, _ := stateStore.Load(item.Key)
+	if reloaded.Tags[0] != "go" {
+		t.Errorf("Modifying a loaded link should not modify the stored link")
+	}
+}
+
 func testWriteBatch(t *testing.T, stateStore StateStore) {
 	numOfItems := 10
 	items := make([]*StorageItem, 0, numOfItems)
@@ -46,17 +1203,26 @@ func testWriteBatch(t *testing.T, stateStore StateStore) {
 		if err != nil {
 			t.Errorf("stateStore.Load(%v) returned error %v", i.Key, err)
 		}
-		if value != i.Value {
-			t.Errorf("Loaded value %s is different than %s", value, i.Value)
+		if value.URL != i.Value.URL {
+			t.Errorf("Loaded value %s is different than %s", value.URL, i.Value.URL)
 		}
 	}
+
+	// Replacing a link keeps its hits
+	stateStore.RecordHit(&HitEvent{Key: "key_0", Time: time.Now(), Status: 307})
+	if err = stateStore.SaveAll([]*StorageItem{NewStorageItem("key_0", "other_value")}); err != nil {
+		t.Errorf("stateStore.SaveAll of key_0 returned error %v", err)
+	}
+	if value, _ := stateStore.Load("key_0"); value.URL != "other_value" || value.Hits != 1 {
+		t.Errorf("Expected key_0 replaced with its hit kept gotten %v", value)
+	}
 }
 
 func testWriteRead(t *testing.T, stateStore StateStore) {
 	var tests = []struct {
 		key         string
 		value       string
-		want        StorageValue
+		want        string
 		shouldWrite bool
 		saveError   error
 		loadError   error
@@ -64,7 +1230,7 @@ func testWriteRead(t *testing.T, stateStore StateStore) {
 		{"key0", "value0", "value0", true, nil, nil},
 		{"key1", "value1", "value1", true, nil, nil},
 		{"key0", "value0", "value0", true, KeyAlreadyExists{Key: "key0"}, nil},
-		{"_key3", "_value3", nil, false, nil, KeyNotFound{Key: "_key3"}},
+		{"_key3", "_value3", "", false, nil, KeyNotFound{Key: "_key3"}},
 	}
 
 	for _, test := range tests {
@@ -81,7 +1247,10 @@ func testWriteRead(t *testing.T, stateStore StateStore) {
 			t.Errorf("stateStore.Load(%v) expected error %v - gotten %v",
 				item, test.loadError, loadError)
 		}
-		if test.want != value {
+		if test.want == "" && value != nil {
+			t.Errorf("stateStore.Load(%v) expected no value - gotten %v", item, value)
+		}
+		if test.want != "" && (value == nil || test.want != value.URL) {
 			t.Errorf("stateStore.Load(%v) expected value %v - gotten %v",
 				item, test.want, value)
 		}
@@ -116,7 +1285,7 @@ func testListAll(t *testing.T, stateStore StateStore) {
 		item := NewStorageItem(i.key, i.value)
 		found := false
 		for _, j := range storedItems {
-			if item.Key == j.Key && item.Value == j.Value {
+			if item.Key == j.Key && item.Value.URL == j.Value.URL {
 				found = true
 				break
 			}
@@ -138,15 +1307,15 @@ func testDelete(t *testing.T, stateStore StateStore) {
 	if error != nil {
 		t.Errorf("stateStore.Load(%v) did not expect any error but gotten %v", item, error)
 	}
-	if value != item.Value {
+	if value.URL != item.Value.URL {
 		t.Errorf("stateStore.Load(%v) expected value %v but gotten %v", item, item.Value, value)
 	}
 
-	value, error = stateStore.Delete(item.Key)
+	value, error = stateStore.Delete(item.Key, "antonis")
 	if error != nil {
 		t.Errorf("stateStore.Delete(%v) did not expect any error but gotten %v", item, error)
 	}
-	if value != item.Value {
+	if value == nil || value.URL != item.Value.URL {
 		t.Errorf("stateStore.Delete(%v) expected to return value %v but returned %v",
 			item, item.Value, value)
 	}
@@ -196,6 +1365,245 @@ func testListAllMemory(t *testing.T) {
 	testListAll(t, stateStore)
 }
 
+func testLinkRecordBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testLinkRecord(t, stateStore)
+}
+
+func testLinkRecordMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testLinkRecord(t, stateStore)
+}
+
+func testHitsBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testHits(t, stateStore)
+}
+
+func testHitsMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testHits(t, stateStore)
+}
+
+func testLongestPrefixBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testLongestPrefix(t, stateStore)
+}
+
+func testLongestPrefixMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testLongestPrefix(t, stateStore)
+}
+
+func testUpdateBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testUpdate(t, stateStore)
+}
+
+func testUpdateMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testUpdate(t, stateStore)
+}
+
+func testRenameBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testRename(t, stateStore)
+}
+
+func testRenameMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testRename(t, stateStore)
+}
+
+func testCompareAndSwapBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testCompareAndSwap(t, stateStore)
+}
+
+func testCompareAndSwapMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testCompareAndSwap(t, stateStore)
+}
+
+func testHistoryBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testHistory(t, stateStore)
+}
+
+func testHistoryMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testHistory(t, stateStore)
+}
+
+func testTrashBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testTrash(t, stateStore)
+}
+
+func testTrashMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testTrash(t, stateStore)
+}
+
+func testExpiryBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testExpiry(t, stateStore)
+}
+
+func testExpiryMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testExpiry(t, stateStore)
+}
+
+func testConsumeUseBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testConsumeUse(t, stateStore)
+}
+
+func testConsumeUseMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testConsumeUse(t, stateStore)
+}
+
+func testSearchBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testSearch(t, stateStore)
+}
+
+func testSearchMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testSearch(t, stateStore)
+}
+
+func testPaginationBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testPagination(t, stateStore)
+}
+
+func testPaginationMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testPagination(t, stateStore)
+}
+
+func testNamespacesBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testNamespaces(t, stateStore)
+}
+
+func testNamespacesMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testNamespaces(t, stateStore)
+}
+
+func testAliasesBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testAliases(t, stateStore)
+}
+
+func testAliasesMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testAliases(t, stateStore)
+}
+
+func testKeyNormalizationBadger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_badger_state_store")
+	if err != nil {
+		t.Fatal("Error creating tmp directory for Badger")
+	}
+	defer os.RemoveAll(dir)
+	stateStore := &BadgerStateStore{Config: createNormalizingConfig(dir)}
+	if err = stateStore.Init(); err != nil {
+		t.Fatalf("stateStore.Init() failed with %s", err)
+	}
+	defer stateStore.Close()
+	testKeyNormalization(t, stateStore)
+}
+
+func testKeyNormalizationMemory(t *testing.T) {
+	stateStore := &MemoryStateStore{Config: createNormalizingConfig("")}
+	stateStore.Init()
+	defer stateStore.Close()
+	testKeyNormalization(t, stateStore)
+}
+
+func testMigrateKeysBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	saveUnnormalizedKeys(stateStore)
+	stateStore.Close()
+
+	stateStore = &BadgerStateStore{Config: createNormalizingConfig(dir)}
+	if err := stateStore.Init(); err != nil {
+		t.Fatalf("stateStore.Init() failed with %s", err)
+	}
+	defer stateStore.Close()
+	testMigrateKeys(t, stateStore)
+}
+
+func testMigrateKeysMemory(t *testing.T) {
+	stateStore := &MemoryStateStore{}
+	stateStore.Init()
+	defer stateStore.Close()
+	saveUnnormalizedKeys(stateStore)
+	stateStore.normalizer = NewKeyNormalizer(createNormalizingConfig(""))
+	testMigrateKeys(t, stateStore)
+}
+
+func testTokensBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testTokens(t, stateStore)
+}
+
+func testTokensMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testTokens(t, stateStore)
+}
+
 func testDeleteBadger(t *testing.T) {
 	stateStore, dir := createBadgerStateStore(t)
 	defer os.RemoveAll(dir)
@@ -209,6 +1617,19 @@ func testDeleteMemory(t *testing.T) {
 	testDelete(t, stateStore)
 }
 
+func testSplitLinksBadger(t *testing.T) {
+	stateStore, dir := createBadgerStateStore(t)
+	defer os.RemoveAll(dir)
+	defer stateStore.Close()
+	testSplitLinks(t, stateStore)
+}
+
+func testSplitLinksMemory(t *testing.T) {
+	stateStore := createMemoryStateStore(t)
+	defer stateStore.Close()
+	testSplitLinks(t, stateStore)
+}
+
 func createBadgerStateStore(t *testing.T) (StateStore, string) {
 	dir, err := ioutil.TempDir("", "test_badger_state_store")
 	if err != nil {
@@ -229,6 +1650,15 @@ func createConfig(dir string) *viper.Viper {
 	vp.SetConfigType("yaml")
 	vp.Set(context.StateStorePathKey, dir)
 	vp.Set(context.StateStoreGCKey, "2s")
+	vp.Set(context.StateStoreHitEventsRetentionKey, "1h")
+	return vp
+}
+
+func createNormalizingConfig(dir string) *viper.Viper {
+	vp := createConfig(dir)
+	vp.Set(context.StateStoreNormalizeFoldCaseKey, true)
+	vp.Set(context.StateStoreNormalizeTrailingSlashKey, true)
+	vp.Set(context.StateStoreNormalizeSeparatorsKey, true)
 	return vp
 }
 
@@ -2,14 +2,15 @@ package storage
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
 type StorageKey string
-type StorageValue interface{}
 
 type StorageItem struct {
 	Key   StorageKey
-	Value StorageValue
+	Value *Link
 }
 
 type Pair struct {
@@ -17,8 +18,21 @@ type Pair struct {
 	Right interface{}
 }
 
-func NewStorageItem(key, value string) *StorageItem {
-	return &StorageItem{StorageKey(key), StorageValue(value)}
+func NewStorageItem(key, url string) *StorageItem {
+	return &StorageItem{StorageKey(key), NewLink(url)}
+}
+
+// Keys made of the leading path segments of key, longest first
+func keyPrefixes(key StorageKey) []StorageKey {
+	segments := strings.Split(string(key), "/")
+	prefixes := make([]StorageKey, 0, len(segments))
+	for i := len(segments); i > 0; i-- {
+		prefix := strings.Join(segments[:i], "/")
+		if prefix != "" {
+			prefixes = append(prefixes, StorageKey(prefix))
+		}
+	}
+	return prefixes
 }
 
 type KeyAlreadyExists struct {
@@ -37,12 +51,47 @@ func (e KeyNotFound) Error() string {
 	return fmt.Sprintf("Key %s does not exist", e.Key)
 }
 
+type UnknownSchemaVersion struct {
+	Version int
+}
+
+func (e UnknownSchemaVersion) Error() string {
+	return fmt.Sprintf("State store schema version %d is newer than this binary supports", e.Version)
+}
+
 type StateStore interface {
 	Init() error
 	Save(item *StorageItem) error
 	SaveAll(items []*StorageItem) error
-	Load(key StorageKey) (StorageValue, error)
+	Update(item *StorageItem) error
+	Upsert(item *StorageItem) (bool, error)
+	Rename(from, to StorageKey, actor string) error
+	CompareAndSwap(key StorageKey, revision uint64, link *Link) error
+	CompareAndDelete(key StorageKey, revision uint64, actor string) error
+	Load(key StorageKey) (*Link, error)
+	LoadLongestPrefix(key StorageKey) (*PrefixMatch, error)
 	LoadAll() ([]*StorageItem, error)
-	Delete(key StorageKey) (StorageValue, error)
+	Iterate(start StorageKey, fn func(item *StorageItem) bool) error
+	LoadPage(options *ListOptions) (*Page, error)
+	Search(query, tag string) ([]*StorageItem, error)
+	Delete(key StorageKey, actor string) (*Link, error)
+	DeleteWithAliases(key StorageKey, actor string) (*Link, []StorageKey, error)
+	LoadTrash() ([]*TrashItem, error)
+	Restore(key StorageKey, actor string) (*Link, error)
+	PurgeTrash(before time.Time) (int, error)
+	RecordHit(event *HitEvent) error
+	ConsumeUse(key StorageKey) (*Link, error)
+	LoadDailyHits(key StorageKey, since time.Time) ([]*DailyHits, error)
+	LoadHitEvents(key StorageKey, limit int) ([]*HitEvent, error)
+	LoadHistory(key StorageKey, limit int) ([]*LinkRevision, error)
+	SaveToken(token *Token) error
+	LoadTokenByHash(hash string) (*Token, error)
+	LoadAllTokens() ([]*Token, error)
+	DeleteToken(namespace, name string) (*Token, error)
+	SaveAlias(alias *Alias) error
+	LoadAlias(key StorageKey) (*Alias, error)
+	LoadAllAliases() ([]*Alias, error)
+	DeleteAlias(key StorageKey) (*Alias, error)
+	MigrateKeys(apply bool) (*KeyMigration, error)
 	Close() error
 }
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+type Role string
+
+const (
+	// Can only read
+	RoleViewer Role = "viewer"
+	// Can create links and modify the links it owns
+	RoleEditor Role = "editor"
+	// Can modify any link and manage tokens
+	RoleAdmin Role = "admin"
+)
+
+func ParseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleViewer, RoleEditor, RoleAdmin:
+		return Role(role), nil
+	default:
+		return "", fmt.Errorf("Unknown role %s, it should be one of %s, %s, %s", role,
+			RoleViewer, RoleEditor, RoleAdmin)
+	}
+}
+
+// API token of a client, only the hash of the secret is ever stored
+type Token struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	// The token can only be used for links of its namespace, empty for all of them
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func (t *Token) Copy() *Token {
+	token := *t
+	return &token
+}
+
+type TokenNotFound struct {
+	Name string
+}
+
+func (e TokenNotFound) Error() string {
+	return fmt.Sprintf("Token %s does not exist", e.Name)
+}
+
+// Token names are unique within their namespace
+type TokenAlreadyExists struct {
+	Name      string
+	Namespace string
+}
+
+func (e TokenAlreadyExists) Error() string {
+	if e.Namespace != "" {
+		return fmt.Sprintf("Token %s already exists in namespace %s", e.Name, e.Namespace)
+	}
+	return fmt.Sprintf("Token %s already exists", e.Name)
+}
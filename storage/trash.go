@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"time"
+)
+
+// Deleted link kept around until the trash retention period is over
+type TrashItem struct {
+	Key       StorageKey `json:"key"`
+	Link      *Link      `json:"link"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+}
+
+func (t *TrashItem) Copy() *TrashItem {
+	item := *t
+	item.Link = t.Link.Copy()
+	return &item
+}